@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"go/token"
@@ -21,6 +22,11 @@ type (
 		codecName    string // withPayloadCodec
 		PayloadCodec codec.PayloadCodec
 		push         bool // not wait reply
+		multiArgs    bool // Args is []any
+		multiReply   bool // Reply is []any
+		trace        string
+		ctx          context.Context
+		waitForReady bool // wait in TransientFailure until connected or timeout
 	}
 )
 
@@ -39,6 +45,43 @@ func (c *Caller) WithReply(reply any) *Caller {
 	return c
 }
 
+// WithMultiArgs every arg is sent as a lua value. like cluster.call(node, addr, cmd, ...)
+// It needs a multi payload codec. eg: WithPayloadCodec("luaseri")
+func (c *Caller) WithMultiArgs(args ...any) *Caller {
+	c.Args = args
+	c.multiArgs = true
+	return c
+}
+
+// WithMultiReply lua return values are unmarshal into replies in order. every reply must be ptr
+// It needs a multi payload codec. eg: WithPayloadCodec("luaseri")
+func (c *Caller) WithMultiReply(replies ...any) *Caller {
+	c.Reply = replies
+	c.multiReply = true
+	return c
+}
+
+// WithContext cancellation or deadline of ctx abort waiting reply
+func (c *Caller) WithContext(ctx context.Context) *Caller {
+	c.ctx = ctx
+	return c
+}
+
+// Context returns the caller context. default context.Background()
+func (c *Caller) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// WithWaitForReady waits reconnecting until ready or timeout.
+// Default call fail fast if the client is in TransientFailure.
+func (c *Caller) WithWaitForReady() *Caller {
+	c.waitForReady = true
+	return c
+}
+
 func (c *Caller) WithTimeout(timeout time.Duration) *Caller {
 	c.Timeout = timeout
 	return c
@@ -50,6 +93,13 @@ func (c *Caller) WithPush() *Caller {
 	return c
 }
 
+// WithTrace send skynet trace tag before request. like skynet.trace() with cluster.call
+// Use SkynetContext.Trace() to follow the request. push not support trace same as skynet
+func (c *Caller) WithTrace(tag string) *Caller {
+	c.trace = tag
+	return c
+}
+
 // WithPayloadCodec registered name, For this call only
 func (c *Caller) WithPayloadCodec(name string) *Caller {
 	c.codecName = name
@@ -70,14 +120,15 @@ func (c *Caller) Done() (*Caller, error) {
 		return nil, errors.New("caller skynet service addr invalid. need name or id")
 	}
 
-	if c.Reply != nil {
-		// Reply type must be exported.
-		var replyType = reflect.TypeOf(c.Reply)
-		if replyType.Kind() != reflect.Ptr {
-			return nil, fmt.Errorf("srpc.Call: reply type must be ptr or nil, got %q", replyType)
+	if c.multiReply {
+		for _, reply := range c.Reply.([]any) {
+			if err := checkReplyType(reply); err != nil {
+				return nil, err
+			}
 		}
-		if !isExportedOrBuiltinType(replyType) {
-			return nil, fmt.Errorf("srpc.Call: reply type is not exported: %q", replyType)
+	} else if c.Reply != nil {
+		if err := checkReplyType(c.Reply); err != nil {
+			return nil, err
 		}
 	}
 
@@ -92,6 +143,18 @@ func (c *Caller) Done() (*Caller, error) {
 	return c, nil
 }
 
+func checkReplyType(reply any) error {
+	// Reply type must be exported.
+	var replyType = reflect.TypeOf(reply)
+	if replyType == nil || replyType.Kind() != reflect.Ptr {
+		return fmt.Errorf("srpc.Call: reply type must be ptr or nil, got %q", replyType)
+	}
+	if !isExportedOrBuiltinType(replyType) {
+		return fmt.Errorf("srpc.Call: reply type is not exported: %q", replyType)
+	}
+	return nil
+}
+
 func (c *Caller) String() string {
 	return fmt.Sprintf("[%s.%s] [%s]", c.Node, c.Addr.String(), c.Method)
 }
@@ -1,48 +1,55 @@
 package client
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/changlongH/srpc/codec"
-	"github.com/cloudwego/netpoll"
-	"github.com/cloudwego/netpoll/mux"
 )
 
 type (
 	Req struct {
 		Caller *Caller
 		Error  error
-		Done   chan *Req
+		Done   chan *Req // Receives *Req when Go is complete.
+
+		timer   *time.Timer // call timeout
+		stopCtx func() bool // stop caller ctx watching
 	}
 
 	Client struct {
-		// connecting lock
+		// protects state
 		sync.Mutex
 
 		Options Options
 		Address string
 
-		mutex   sync.Mutex
-		seq     uint32
-		pending map[uint32]*Req
+		mutex sync.Mutex
+		seq   uint32
+
+		conns []*clientConn // connection pool
+		next  atomic.Uint32 // round robin
+
+		state      State         // aggregated connectivity state. Shutdown if address changed or use has called Close
+		stateCh    chan struct{} // closed when state changed
+		connStates []State
 
-		conn   netpoll.Connection
-		wqueue *mux.ShardQueue // use for write
+		notifyMu    sync.Mutex // protects states queued for Options.StateHdle
+		notifyQueue []State
+		notifying   bool
 
-		closing bool // address changed or use has called Close
-		//shutdown bool // server has told us to stop
+		interceptor UnaryInterceptor // chained Options.Interceptors
 	}
 )
 
 var ErrClosing = errors.New("client is closing")
 
 func (c *Client) IsClosing() bool {
-	return c.closing
+	return c.GetState() == Shutdown
 }
 
 func (c *Client) Seq() uint32 {
@@ -54,7 +61,33 @@ func (c *Client) Seq() uint32 {
 	return seq
 }
 
+// done should be called once only after it's removed from pending
+func (req *Req) done() {
+	if req.timer != nil {
+		req.timer.Stop()
+	}
+	if req.stopCtx != nil {
+		req.stopCtx()
+	}
+	select {
+	case req.Done <- req:
+		// ok
+	default:
+		// We don't want to block here. It is the caller's responsibility to make
+		// sure the channel has enough buffer space. See comment in Go().
+		log.Println("srpc: discarding Req reply due to insufficient Done chan capacity")
+	}
+}
+
 func (c *Client) decodeRspArgs(req *Req, msg *codec.RespPack) {
+	if !msg.Ok {
+		remoteErr := codec.ParseError(msg.Payload)
+		caller := req.Caller
+		remoteErr.Node, remoteErr.Service, remoteErr.Method = caller.Node, caller.Addr.String(), caller.Method
+		req.Error = remoteErr
+		return
+	}
+
 	if req.Caller.Reply == nil {
 		return
 	}
@@ -63,288 +96,266 @@ func (c *Client) decodeRspArgs(req *Req, msg *codec.RespPack) {
 		return
 	}
 
-	if !msg.Ok {
-		req.Error = errors.New(string(msg.Payload))
+	pcodec := c.payloadCodec(req.Caller)
+	payload, err := codec.UnpackPayload(pcodec, msg.Payload)
+	if err != nil {
+		req.Error = errors.New("payload unpack err: " + err.Error())
 		return
 	}
-
-	pcodec := c.Options.PayloadCodec
-	if req.Caller.PayloadCodec != nil {
-		pcodec = req.Caller.PayloadCodec
+	// void reply. eg: nil *Reply or error only
+	if len(payload) == 0 || (!req.Caller.multiReply && pcodec.IsNull(payload)) {
+		return
 	}
-	if err := pcodec.Unmarshal(msg.Payload, req.Caller.Reply); err != nil {
-		req.Error = errors.New("payload unmarshal err: " + err.Error())
+	if req.Caller.multiReply {
+		mcodec, ok := pcodec.(codec.MultiPayloadCodec)
+		if !ok {
+			req.Error = fmt.Errorf("payload codec %s not support multi reply", pcodec.Name())
+			return
+		}
+		err = mcodec.UnmarshalMulti(payload, req.Caller.Reply.([]any)...)
+	} else {
+		err = pcodec.Unmarshal(payload, req.Caller.Reply)
+	}
+	if errors.Is(err, codec.ErrVerifyFailed) {
+		req.Error = fmt.Errorf("invoke %s reply verify failed. %w", req.Caller.String(), err)
+	} else if err != nil {
+		req.Error = fmt.Errorf("payload unmarshal err: %w", err)
 	}
 }
 
-func (c *Client) readResponse(conn netpoll.Connection) {
-	var bizErr error
-	defer func() {
-		var errmsg string
-		if err := recover(); err != nil {
-			// TODO: need handle?
-			log.Println(err)
-			errmsg = "panic on read mesage"
-		}
-
-		c.mutex.Lock()
-		pending := c.pending
-		c.pending = map[uint32]*Req{}
-		conn.Close()
-		c.mutex.Unlock()
-
-		if bizErr != nil {
-			if errmsg != "" {
-				errmsg += ": "
-			}
-			errmsg = errmsg + bizErr.Error()
-		}
-		for _, req := range pending {
-			req.Error = errors.New(errmsg)
-			close(req.Done)
-		}
-	}()
-
-	var closeCh = make(chan struct{})
-	var errChan = make(chan error)
-	var recv = make(chan netpoll.Reader, 1000)
-	var headerSize = 2
-	go func() {
-		defer close(closeCh)
-		for {
-			reader := conn.Reader()
-			bLen, err := reader.ReadBinary(headerSize)
-			if err != nil {
-				errChan <- err
-				return
-			}
-			// header bigEndian
-			pkgsize := int(binary.BigEndian.Uint16(bLen))
-			pkg, err := reader.Slice(pkgsize)
-			if err != nil {
-				errChan <- err
-				return
-			}
-			recv <- pkg
+// Invoke send request and waits for it to complete if not push.
+// caller.Context() cancellation or deadline stop waiting and returns error wrapped ctx.Err()
+func (c *Client) Invoke(caller *Caller) error {
+	if c.interceptor != nil {
+		// interceptors wait for the reply in the caller goroutine
+		payload, err := c.encode(caller)
+		if err != nil {
+			return err
 		}
-	}()
+		return c.interceptor(caller, payload, c.invoke)
+	}
+	req := c.Go(caller, make(chan *Req, 1))
+	<-req.Done
+	return req.Error
+}
 
-	var pendingPack = make(map[uint32]*codec.RespPack)
-	var msg *codec.RespPack
-	for {
-		select {
-		case pkg := <-recv:
-			msg, bizErr = codec.ReadResp(pkg, pendingPack)
-			if bizErr != nil {
-				return
-			}
-			if msg == nil {
-				continue
-			}
-			session := msg.Session
-			c.mutex.Lock()
-			req, ok := c.pending[session]
-			delete(c.pending, session)
-			c.mutex.Unlock()
-
-			if ok {
-				c.decodeRspArgs(req, msg)
-				req.Done <- req
-			} else {
-				// invalid session
-			}
-		case <-closeCh:
-			return
-		case bizErr = <-errChan:
-			return
-		}
+// invoke is the final Invoker of interceptors
+func (c *Client) invoke(caller *Caller, payload []byte) error {
+	req := &Req{
+		Caller: caller,
+		Done:   make(chan *Req, 1),
 	}
+	c.send(req, payload)
+	<-req.Done
+	return req.Error
 }
 
-// should check closing before connect
-func (c *Client) syncConnect() error {
-	c.Lock()
-	defer func() {
-		if err := recover(); err != nil {
-			c.Unlock()
-			return
-		}
-		c.Unlock()
-	}()
+/*
+Go invokes the caller asynchronously. It returns the Req representing the invocation.
+The done channel will signal when the call is complete(reply, error, timeout or ctx done) by returning the same Req.
 
-	// connected
-	if c.conn != nil && c.conn.IsActive() {
-		return nil
+If done is nil, Go will allocate a new channel. If non-nil, done must be buffered or Go will deliberately crash.
+Many calls can share one done channel to collect the results as they complete:
+
+	done := make(chan *client.Req, len(callers))
+	for _, caller := range callers {
+		c.Go(caller, done)
+	}
+	for range callers {
+		req := <-done
+		// req.Caller.Reply, req.Error
 	}
 
-	if c.wqueue != nil {
-		c.wqueue.Close()
-		c.wqueue = nil
+push caller is done once the request is sent.
+Go never starts a goroutine unless client has interceptors. Interceptors wait for the reply like Invoke,
+so they run in a goroutine per call and req is done with the result of the chain. eg: retried by interceptor.
+*/
+func (c *Client) Go(caller *Caller, done chan *Req) *Req {
+	if done == nil {
+		done = make(chan *Req, 1)
+	} else if cap(done) == 0 {
+		log.Panic("srpc: done channel is unbuffered")
+	}
+	req := &Req{
+		Caller: caller,
+		Done:   done,
 	}
 
-	conn, err := netpoll.DialConnection("tcp", c.Address, time.Second*5)
+	payload, err := c.encode(caller)
 	if err != nil {
-		return err
+		req.Error = err
+		req.done()
+		return req
 	}
-
-	conn.AddCloseCallback(func(connection netpoll.Connection) error {
-		c.Lock()
-		defer c.Unlock()
-		if c.Options.DisconnectHdle != nil {
-			c.Options.DisconnectHdle(connection.RemoteAddr().String())
-		}
-		return nil
-	})
-
-	//conn.SetReadTimeout(3 * time.Second)
-	conn.SetWriteTimeout(2 * time.Second)
-
-	c.conn = conn
-	c.wqueue = mux.NewShardQueue(mux.ShardSize, conn)
-	go c.readResponse(conn)
-	if c.Options.ConnectHdle != nil {
-		c.Options.ConnectHdle(conn.RemoteAddr().String())
+	if c.interceptor != nil {
+		return c.goIntercepted(req, payload)
 	}
-	return nil
+	return c.send(req, payload)
 }
 
-func (c *Client) Invoke(caller *Caller) error {
+// encode payload of caller unless ctx is done
+func (c *Client) encode(caller *Caller) ([]byte, error) {
+	if err := caller.Context().Err(); err != nil {
+		return nil, fmt.Errorf("invoke %s canceled. %w", caller.String(), err)
+	}
 	payload, err := c.EncodePayload(caller)
 	if err != nil {
-		return fmt.Errorf("invoke %s encode failed. %s", caller.String(), err.Error())
+		return nil, fmt.Errorf("invoke %s encode failed. %s", caller.String(), err.Error())
 	}
+	return payload, nil
+}
 
-	if c.conn == nil || !c.conn.IsActive() {
-		if c.closing {
-			return ErrClosing
-		}
-		if caller.IsPush() {
-			// try async connect once
+// goIntercepted runs interceptors of Go. req is done with the result of the chain
+func (c *Client) goIntercepted(req *Req, payload []byte) *Req {
+	go func() {
+		req.Error = c.interceptor(req.Caller, payload, c.invoke)
+		req.done()
+	}()
+	return req
+}
+
+// send the encoded payload. req is done when reply received or failed
+func (c *Client) send(req *Req, payload []byte) *Req {
+	caller := req.Caller
+	ctx := caller.Context()
+	timeout := caller.Timeout
+	if timeout == 0 {
+		timeout = c.Options.CallTimeout
+	}
+
+	cc := c.pick(caller)
+	if state := cc.getState(); state != Ready && caller.IsPush() {
+		cc.Lock()
+		lastErr := cc.lastErr
+		cc.Unlock()
+		if state == Shutdown {
+			req.Error = ErrClosing
+		} else if state == TransientFailure && !caller.waitForReady {
+			req.Error = fmt.Errorf("invoke %s connect failed. %w: %v", caller.String(), ErrTransientFailure, lastErr)
+		} else {
+			// send after connected
 			go func() {
-				if err := c.syncConnect(); err != nil {
+				timer := time.NewTimer(timeout)
+				defer timer.Stop()
+				if err := cc.waitForReady(ctx, timer.C, caller.waitForReady); err != nil {
 					log.Printf("invoke %s connect failed. %s", caller.String(), err.Error())
 				} else {
 					c.mutex.Lock()
 					var seq = c.Seq()
 					c.mutex.Unlock()
-					c.invoke(caller.Addr, seq, caller.Method, payload, caller.IsPush())
+					cc.invoke(caller, seq, payload)
 				}
 			}()
-			// return immediately
-			return nil
-		} else {
-			// try connect once
-			if err := c.syncConnect(); err != nil {
-				return fmt.Errorf("invoke %s connect failed. %s", caller.String(), err.Error())
-			}
+		}
+		// return immediately
+		req.done()
+		return req
+	} else if state != Ready {
+		// wait connecting. fail fast in TransientFailure unless caller.WithWaitForReady
+		start := time.Now()
+		timer := time.NewTimer(timeout)
+		err := cc.waitForReady(ctx, timer.C, caller.waitForReady)
+		timer.Stop()
+		if err != nil {
+			req.Error = fmt.Errorf("invoke %s connect failed. %w", caller.String(), err)
+			req.done()
+			return req
+		}
+		if timeout -= time.Since(start); timeout <= 0 {
+			timeout = time.Millisecond
 		}
 	}
 
-	var req *Req
 	c.mutex.Lock()
 	var seq = c.Seq()
+	c.mutex.Unlock()
 	if !caller.IsPush() {
-		req = &Req{
-			Caller: caller,
-			Done:   make(chan *Req),
-		}
-		c.pending[seq] = req
+		cc.addPending(seq, req, timeout)
 	}
-	c.mutex.Unlock()
 
-	if err := c.invoke(caller.Addr, seq, caller.Method, payload, caller.IsPush()); err != nil {
+	if err := cc.invoke(caller, seq, payload); err != nil {
+		err = fmt.Errorf("invoke (%s) socket failed. %s", caller.String(), err.Error())
 		if !caller.IsPush() {
-			c.mutex.Lock()
-			delete(c.pending, seq)
-			c.mutex.Unlock()
+			cc.abort(seq, err)
+		} else {
+			req.Error = err
+			req.done()
 		}
-		return fmt.Errorf("invoke (%s) socket failed. %s", caller.String(), err.Error())
+		return req
 	}
 
 	if caller.IsPush() {
-		return nil
-	}
-
-	if caller.Timeout == 0 {
-		caller.Timeout = c.Options.CallTimeout
-	}
-
-	// wait call done
-	select {
-	case <-req.Done:
-		return req.Error
-	case <-time.After(caller.Timeout):
-		c.mutex.Lock()
-		delete(c.pending, seq)
-		c.mutex.Unlock()
-		return fmt.Errorf("invoke %s timeout %0.1fs", caller.String(), caller.Timeout.Seconds())
+		req.done()
 	}
-}
-
-func (c *Client) invoke(addr *codec.Addr, seq uint32, method string, payload []byte, push bool) error {
-	pack := &codec.ReqPack{
-		Addr:    *addr,
-		Session: seq,
-		Method:  method,
-		Payload: payload,
-		Push:    push,
-	}
-	writer := netpoll.NewLinkBuffer()
-	if err := codec.EncodeReq(writer, pack); err != nil {
-		return err
-	}
-
-	if c.wqueue == nil {
-		return fmt.Errorf("invalid wqueue addr:%s", c.Address)
-	}
-
-	// Put puts the buffer getter back to the queue.
-	c.wqueue.Add(func() (buf netpoll.Writer, isNil bool) {
-		return writer, false
-	})
-	return nil
+	return req
 }
 
 func NewClient(address string, opts ...Option) (*Client, error) {
-	options := defaultClientOptions
-	for _, opt := range opts {
-		opt(&options)
-	}
-
+	options := NewOptions(opts...)
 	c := &Client{
-		Options: options,
-		Address: address,
-		pending: map[uint32]*Req{},
+		Options:     options,
+		Address:     address,
+		state:       Idle,
+		stateCh:     make(chan struct{}),
+		connStates:  make([]State, options.PoolSize),
+		interceptor: chainUnaryInterceptors(options.Interceptors),
+	}
+	c.conns = make([]*clientConn, options.PoolSize)
+	for i := range c.conns {
+		c.conns[i] = newClientConn(c, i)
 	}
 	// __waiting = false
 	return c, nil
 }
 
+// Close shutdown client. never reconnect again. connections will be closed after 15s to receive pending responses
 func (c *Client) Close() error {
-	c.closing = true
-	// delay close socket
-	var addr = c.Address
-	time.AfterFunc(time.Second*15, func() {
-		if c.conn != nil && c.conn.IsActive() {
-			if err := c.conn.Close(); err != nil {
-				log.Printf("close address:[%s] err:%s", addr, err.Error())
-			}
-			c.conn = nil
-		}
-	})
+	for _, cc := range c.conns {
+		cc.close(time.Second * 15)
+	}
 	return nil
 }
 
+// ConnStats health of every pool connection
+func (c *Client) ConnStats() []ConnStat {
+	stats := make([]ConnStat, len(c.conns))
+	for i, cc := range c.conns {
+		stats[i] = cc.stat()
+	}
+	return stats
+}
+
+// EncodePayload marshal caller args and pack as skynet message args
 func (c *Client) EncodePayload(caller *Caller) ([]byte, error) {
-	if caller.Args == nil {
-		return nil, nil
+	pcodec := c.payloadCodec(caller)
+	var data []byte
+	var err error
+	if caller.multiArgs {
+		mcodec, ok := pcodec.(codec.MultiPayloadCodec)
+		if !ok {
+			return nil, fmt.Errorf("payload codec %s not support multi args", pcodec.Name())
+		}
+		data, err = mcodec.MarshalMulti(caller.Args.([]any)...)
+	} else if caller.Args != nil {
+		data, err = pcodec.Marshal(caller.Args)
 	}
+	if err != nil {
+		return nil, err
+	}
+	// null is sealed too
+	if sc, ok := pcodec.(codec.SealedPayloadCodec); ok && data == nil {
+		if data, err = sc.SealNull(); err != nil {
+			return nil, err
+		}
+	}
+	return codec.PackPayload(pcodec, data)
+}
 
-	pcodec := c.Options.PayloadCodec
+func (c *Client) payloadCodec(caller *Caller) codec.PayloadCodec {
 	// caller codec preference
 	if caller.PayloadCodec != nil {
-		pcodec = caller.PayloadCodec
+		return caller.PayloadCodec
 	}
 	// client codec default
-	return pcodec.Marshal(caller.Args)
+	return c.Options.PayloadCodec
 }
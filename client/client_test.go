@@ -0,0 +1,268 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// called from connection goroutines
+	var mu sync.Mutex
+	var states []State
+	c, _ := NewClient(addr,
+		WithDialTimeout(time.Second),
+		WithConnectBackoff(Backoff{BaseDelay: 50 * time.Millisecond, Multiplier: 1.6, MaxDelay: 200 * time.Millisecond}),
+		WithStateHandle(func(address string, state State) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+		}),
+	)
+	if c.GetState() != Idle {
+		t.Fatalf("new client state %s", c.GetState())
+	}
+
+	// fail fast
+	err = c.Invoke(NewCaller("test", "sdb", "PING", nil))
+	if !errors.Is(err, ErrTransientFailure) {
+		t.Fatalf("expect transient failure got %v", err)
+	}
+
+	// wait for ready
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = c.WaitForReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reconnect in background after disconnect
+	conn.Close()
+	if conn, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = c.WaitForReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+	if c.GetState() != Shutdown || !errors.Is(c.WaitForReady(ctx), ErrClosing) {
+		t.Fatalf("close client state %s", c.GetState())
+	}
+	ln.Close()
+	mu.Lock()
+	t.Log("states:", states)
+	mu.Unlock()
+}
+
+func TestStateHandleReentrant(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the handler queries the client, it would deadlock if called with client lock
+	states := make(chan State, 8)
+	var c *Client
+	c, _ = NewClient(ln.Addr().String(), WithStateHandle(func(address string, state State) {
+		c.GetState()
+		c.ConnStats()
+		states <- state
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = c.WaitForReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	for _, expect := range []State{Connecting, Ready, Shutdown} {
+		select {
+		case state := <-states:
+			if state != expect {
+				t.Fatalf("state %s expect %s", state, expect)
+			}
+		case <-ctx.Done():
+			t.Fatalf("state handle timeout, expect %s", expect)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := DefaultBackoff
+	if b.Delay(0) != b.BaseDelay {
+		t.Fatalf("first delay %s", b.Delay(0))
+	}
+	for i := 1; i < 20; i++ {
+		if d := b.Delay(i); d > time.Duration(float64(b.MaxDelay)*(1+b.Jitter)) || d < b.BaseDelay/2 {
+			t.Fatalf("delay(%d)=%s out of range", i, d)
+		}
+	}
+}
+
+func TestOptionsEqual(t *testing.T) {
+	hdl := func(address string, state State) {}
+	a := NewOptions(WithCallTimeout(time.Second), WithStateHandle(hdl))
+	if b := NewOptions(WithCallTimeout(time.Second), WithStateHandle(hdl)); !a.Equal(&b) {
+		t.Fatal("same options not equal")
+	}
+	if b := NewOptions(WithCallTimeout(time.Second)); a.Equal(&b) {
+		t.Fatal("handler not compared")
+	}
+	if b := NewOptions(WithCallTimeout(2*time.Second), WithStateHandle(hdl)); a.Equal(&b) {
+		t.Fatal("timeout not compared")
+	}
+}
+
+func TestConnPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	for _, policy := range []PoolPolicy{PolicyRoundRobin, PolicyLeastPending, PolicyHashAddr} {
+		c, _ := NewClient(ln.Addr().String(), WithConnPool(3, policy))
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err = c.WaitForReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		for ready := 0; ready < 3; {
+			ready = 0
+			for _, stat := range c.ConnStats() {
+				if stat.State == Ready {
+					ready++
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		picked := map[*clientConn]bool{}
+		caller := NewCaller("test", "sdb", "PING", nil)
+		for range 3 {
+			picked[c.pick(caller)] = true
+		}
+		if policy == PolicyHashAddr && len(picked) != 1 {
+			t.Fatalf("%s: same address picked %d connections", policy, len(picked))
+		}
+		if policy == PolicyRoundRobin && len(picked) != 3 {
+			t.Fatalf("%s: picked %d connections", policy, len(picked))
+		}
+		if policy == PolicyLeastPending {
+			cc := c.pick(caller)
+			cc.addPending(1, &Req{Caller: caller, Done: make(chan *Req, 1)}, time.Second)
+			if c.pick(caller) == cc {
+				t.Fatalf("%s: picked busy connection", policy)
+			}
+			cc.abort(1, ErrClosing)
+		}
+		c.Close()
+	}
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var trace []string
+	var sentPayload []byte
+	var invokeErr error
+	outer := func(caller *Caller, payload []byte, invoker Invoker) error {
+		trace = append(trace, "outer")
+		err := invoker(caller, payload)
+		trace = append(trace, "outer done")
+		return err
+	}
+	inner := func(caller *Caller, payload []byte, invoker Invoker) error {
+		trace = append(trace, "inner")
+		sentPayload = payload
+		invokeErr = invoker(caller, payload)
+		return fmt.Errorf("inner: %w", invokeErr)
+	}
+	c, _ := NewClient(addr, WithUnaryInterceptor(outer), WithChainUnaryInterceptor(inner))
+	defer c.Close()
+
+	err = c.Invoke(NewCaller("test", "sdb", "GET", "key"))
+	if !errors.Is(err, ErrTransientFailure) || !errors.Is(err, invokeErr) {
+		t.Fatalf("expect interceptor wrapped err got %v", err)
+	}
+	if fmt.Sprint(trace) != "[outer inner outer done]" {
+		t.Fatalf("interceptor order %v", trace)
+	}
+	if expect, _ := c.EncodePayload(NewCaller("test", "sdb", "GET", "key")); !bytes.Equal(sentPayload, expect) {
+		t.Fatalf("interceptor payload %v expect %v", sentPayload, expect)
+	}
+
+	// async Go waits for the reply in interceptors like Invoke
+	trace = nil
+	req := <-c.Go(NewCaller("test", "sdb", "GET", "key"), nil).Done
+	if !errors.Is(req.Error, ErrTransientFailure) || !errors.Is(req.Error, invokeErr) || fmt.Sprint(trace) != "[outer inner outer done]" {
+		t.Fatalf("go interceptor err %v trace %v", req.Error, trace)
+	}
+
+	// retried by interceptor, req is done with the final result
+	var attempts atomic.Int32
+	retry := func(caller *Caller, payload []byte, invoker Invoker) error {
+		err := invoker(caller, payload)
+		for i := 0; err != nil && i < 2; i++ {
+			err = invoker(caller, payload)
+		}
+		return fmt.Errorf("retried: %w", err)
+	}
+	c3, _ := NewClient(addr, WithUnaryInterceptor(retry), WithChainUnaryInterceptor(func(caller *Caller, payload []byte, invoker Invoker) error {
+		attempts.Add(1)
+		return invoker(caller, payload)
+	}))
+	defer c3.Close()
+	req = <-c3.Go(NewCaller("test", "sdb", "GET", "key"), nil).Done
+	if !errors.Is(req.Error, ErrTransientFailure) || !strings.HasPrefix(req.Error.Error(), "retried: ") || attempts.Load() != 3 {
+		t.Fatalf("go retry err %v attempts %d", req.Error, attempts.Load())
+	}
+
+	// interceptor returns without invoking
+	rejected := errors.New("rejected")
+	c2, _ := NewClient(addr, WithUnaryInterceptor(func(caller *Caller, payload []byte, invoker Invoker) error {
+		return rejected
+	}))
+	defer c2.Close()
+	if req := <-c2.Go(NewCaller("test", "sdb", "GET", "key"), nil).Done; req.Error != rejected {
+		t.Fatalf("go interceptor rejected err %v", req.Error)
+	}
+}
@@ -0,0 +1,385 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/changlongH/srpc/codec"
+	"github.com/cloudwego/netpoll"
+	"github.com/cloudwego/netpoll/mux"
+)
+
+type (
+	// clientConn one connection of client pool. It reconnects by itself
+	clientConn struct {
+		// connecting lock. protects state and conn
+		sync.Mutex
+
+		client *Client
+		index  int // index of client pool
+
+		mutex   sync.Mutex
+		pending map[uint32]*Req
+
+		conn   netpoll.Connection
+		wqueue *mux.ShardQueue // use for write
+
+		state   State         // connectivity state
+		stateCh chan struct{} // closed when state changed
+		lastErr error         // last connect error
+	}
+
+	// ConnStat health of a pool connection
+	ConnStat struct {
+		State      State
+		Pending    int   // waiting reply requests
+		LastErr    error // last connect or read error
+		RemoteAddr string
+	}
+)
+
+func newClientConn(c *Client, index int) *clientConn {
+	return &clientConn{
+		client:  c,
+		index:   index,
+		pending: map[uint32]*Req{},
+		state:   Idle,
+		stateCh: make(chan struct{}),
+	}
+}
+
+func (cc *clientConn) getState() State {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.state
+}
+
+func (cc *clientConn) pendingCount() int {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return len(cc.pending)
+}
+
+func (cc *clientConn) stat() ConnStat {
+	cc.Lock()
+	stat := ConnStat{State: cc.state, LastErr: cc.lastErr}
+	if cc.conn != nil {
+		stat.RemoteAddr = cc.conn.RemoteAddr().String()
+	}
+	cc.Unlock()
+	stat.Pending = cc.pendingCount()
+	return stat
+}
+
+// waitForReady failFast returns error in TransientFailure. timeout channel stop waiting
+func (cc *clientConn) waitForReady(ctx context.Context, timeout <-chan time.Time, waitForReady bool) error {
+	for {
+		cc.Lock()
+		if cc.state == Idle {
+			cc.startConnecting()
+		}
+		state, stateCh, lastErr := cc.state, cc.stateCh, cc.lastErr
+		cc.Unlock()
+
+		switch state {
+		case Ready:
+			return nil
+		case Shutdown:
+			return ErrClosing
+		case TransientFailure:
+			if !waitForReady {
+				return fmt.Errorf("%w: %v", ErrTransientFailure, lastErr)
+			}
+		}
+
+		select {
+		case <-stateCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("wait for ready timeout. state: %s", state)
+		}
+	}
+}
+
+// setState must hold cc.Lock
+func (cc *clientConn) setState(state State) {
+	if cc.state == state {
+		return
+	}
+	cc.state = state
+	close(cc.stateCh)
+	cc.stateCh = make(chan struct{})
+	cc.client.updateState(cc.index, state)
+}
+
+// startConnecting must hold cc.Lock. only one connect loop at a time
+func (cc *clientConn) startConnecting() {
+	cc.setState(Connecting)
+	go cc.connectLoop()
+}
+
+// connectLoop keep connecting until ready or shutdown
+func (cc *clientConn) connectLoop() {
+	c := cc.client
+	for retries := 0; ; retries++ {
+		conn, err := netpoll.DialConnection("tcp", c.Address, c.Options.DialTimeout)
+
+		cc.Lock()
+		if cc.state == Shutdown {
+			cc.Unlock()
+			// conn is a typed nil if dialing failed
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		if err == nil {
+			cc.onConnected(conn)
+			cc.Unlock()
+			if c.Options.ConnectHdle != nil {
+				c.Options.ConnectHdle(conn.RemoteAddr().String())
+			}
+			return
+		}
+		cc.lastErr = err
+		cc.setState(TransientFailure)
+		stateCh := cc.stateCh
+		cc.Unlock()
+
+		delay := c.Options.Backoff.Delay(retries)
+		log.Printf("connect address:[%s] failed. retry after %dms. %s", c.Address, delay.Milliseconds(), err.Error())
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-stateCh:
+			// shutdown
+			timer.Stop()
+		}
+
+		cc.Lock()
+		if cc.state == Shutdown {
+			cc.Unlock()
+			return
+		}
+		cc.setState(Connecting)
+		cc.Unlock()
+	}
+}
+
+// onConnected must hold cc.Lock
+func (cc *clientConn) onConnected(conn netpoll.Connection) {
+	c := cc.client
+	conn.AddCloseCallback(func(connection netpoll.Connection) error {
+		if c.Options.DisconnectHdle != nil {
+			c.Options.DisconnectHdle(connection.RemoteAddr().String())
+		}
+		return nil
+	})
+
+	//conn.SetReadTimeout(3 * time.Second)
+	conn.SetWriteTimeout(2 * time.Second)
+
+	cc.conn = conn
+	cc.wqueue = mux.NewShardQueue(mux.ShardSize, conn)
+	cc.lastErr = nil
+	cc.setState(Ready)
+	go cc.readResponse(conn)
+}
+
+// onDisconnected reconnect in background if conn is current connection
+func (cc *clientConn) onDisconnected(conn netpoll.Connection, err error) {
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.conn != conn {
+		return
+	}
+	cc.conn = nil
+	if cc.wqueue != nil {
+		cc.wqueue.Close()
+		cc.wqueue = nil
+	}
+	if cc.state == Shutdown {
+		return
+	}
+	cc.lastErr = err
+	cc.startConnecting()
+}
+
+// close shutdown and close socket after delay to receive pending responses
+func (cc *clientConn) close(delay time.Duration) {
+	cc.Lock()
+	cc.setState(Shutdown)
+	conn := cc.conn
+	cc.Unlock()
+
+	// delay close socket
+	var addr = cc.client.Address
+	time.AfterFunc(delay, func() {
+		if conn != nil && conn.IsActive() {
+			if err := conn.Close(); err != nil {
+				log.Printf("close address:[%s] err:%s", addr, err.Error())
+			}
+		}
+	})
+}
+
+func (cc *clientConn) readResponse(conn netpoll.Connection) {
+	var bizErr error
+	defer func() {
+		var errmsg string
+		if err := recover(); err != nil {
+			// TODO: need handle?
+			log.Println(err)
+			errmsg = "panic on read mesage"
+		}
+
+		cc.mutex.Lock()
+		pending := cc.pending
+		cc.pending = map[uint32]*Req{}
+		conn.Close()
+		cc.mutex.Unlock()
+
+		if bizErr != nil {
+			if errmsg != "" {
+				errmsg += ": "
+			}
+			errmsg = errmsg + bizErr.Error()
+		}
+		for _, req := range pending {
+			req.Error = errors.New(errmsg)
+			req.done()
+		}
+		cc.onDisconnected(conn, bizErr)
+	}()
+
+	var closeCh = make(chan struct{})
+	var errChan = make(chan error, 1)
+	var recv = make(chan netpoll.Reader, 1000)
+	var headerSize = 2
+	go func() {
+		defer close(closeCh)
+		for {
+			reader := conn.Reader()
+			bLen, err := reader.ReadBinary(headerSize)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			// header bigEndian
+			pkgsize := int(binary.BigEndian.Uint16(bLen))
+			pkg, err := reader.Slice(pkgsize)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			recv <- pkg
+		}
+	}()
+
+	var limits = cc.client.Options.Limits
+	var pendingPack = make(map[uint32]*codec.RespPack)
+	var msg *codec.RespPack
+
+	// discard partial responses. the request will be timeout
+	var expireCh <-chan time.Time
+	if limits.PendingTimeout > 0 {
+		ticker := time.NewTicker(max(limits.PendingTimeout/2, time.Second))
+		defer ticker.Stop()
+		expireCh = ticker.C
+	}
+	for {
+		select {
+		case pkg := <-recv:
+			msg, bizErr = codec.ReadRespWithLimits(pkg, pendingPack, limits)
+			if bizErr != nil {
+				return
+			}
+			if msg == nil {
+				continue
+			}
+			session := msg.Session
+			cc.mutex.Lock()
+			req, ok := cc.pending[session]
+			delete(cc.pending, session)
+			cc.mutex.Unlock()
+
+			if ok {
+				cc.client.decodeRspArgs(req, msg)
+				req.done()
+			} else {
+				// invalid session
+			}
+		case <-expireCh:
+			for _, resp := range codec.ExpirePendingResp(pendingPack, limits.PendingTimeout) {
+				log.Printf("discard partial response session=%d from %s", resp.Session, cc.client.Address)
+			}
+		case <-closeCh:
+			return
+		case bizErr = <-errChan:
+			return
+		}
+	}
+}
+
+// addPending req will be aborted after timeout or ctx done
+func (cc *clientConn) addPending(seq uint32, req *Req, timeout time.Duration) {
+	caller := req.Caller
+	ctx := caller.Context()
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	req.timer = time.AfterFunc(timeout, func() {
+		cc.abort(seq, fmt.Errorf("invoke %s timeout %0.1fs", caller.String(), timeout.Seconds()))
+	})
+	req.stopCtx = context.AfterFunc(ctx, func() {
+		cc.abort(seq, fmt.Errorf("invoke %s canceled. %w", caller.String(), ctx.Err()))
+	})
+	cc.pending[seq] = req
+}
+
+// abort complete pending req with err. do nothing if it's done
+func (cc *clientConn) abort(seq uint32, err error) {
+	cc.mutex.Lock()
+	req, ok := cc.pending[seq]
+	delete(cc.pending, seq)
+	cc.mutex.Unlock()
+	if ok {
+		req.Error = err
+		req.done()
+	}
+}
+
+func (cc *clientConn) invoke(caller *Caller, seq uint32, payload []byte) error {
+	pack := &codec.ReqPack{
+		Addr:    *caller.Addr,
+		Session: seq,
+		Method:  caller.Method,
+		Payload: payload,
+		Push:    caller.IsPush(),
+	}
+	if !pack.Push {
+		pack.Trace = caller.trace
+	}
+	writer := netpoll.NewLinkBuffer()
+	if err := codec.EncodeReq(writer, pack); err != nil {
+		return err
+	}
+
+	cc.Lock()
+	wqueue := cc.wqueue
+	cc.Unlock()
+	if wqueue == nil {
+		return fmt.Errorf("invalid wqueue addr:%s", cc.client.Address)
+	}
+
+	// Put puts the buffer getter back to the queue.
+	wqueue.Add(func() (buf netpoll.Writer, isNil bool) {
+		return writer, false
+	})
+	return nil
+}
@@ -0,0 +1,39 @@
+package client
+
+// Invoker sends the caller with encoded payload. It waits for reply if not push
+type Invoker func(caller *Caller, payload []byte) error
+
+/*
+UnaryInterceptor intercepts the invocation on client. It's used for logging, metrics, retries, auth injection...
+payload has been encoded by payload codec. Call invoker to complete the invocation.
+
+	func logging(caller *client.Caller, payload []byte, invoker client.Invoker) error {
+		start := time.Now()
+		err := invoker(caller, payload)
+		log.Printf("call %s %dms err=%v", caller.String(), time.Since(start).Milliseconds(), err)
+		return err
+	}
+*/
+type UnaryInterceptor func(caller *Caller, payload []byte, invoker Invoker) error
+
+// chainUnaryInterceptors first interceptor is the outer most
+func chainUnaryInterceptors(interceptors []UnaryInterceptor) UnaryInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(caller *Caller, payload []byte, invoker Invoker) error {
+		return interceptors[0](caller, payload, getChainInvoker(interceptors, 0, invoker))
+	}
+}
+
+func getChainInvoker(interceptors []UnaryInterceptor, curr int, final Invoker) Invoker {
+	if curr == len(interceptors)-1 {
+		return final
+	}
+	return func(caller *Caller, payload []byte) error {
+		return interceptors[curr+1](caller, payload, getChainInvoker(interceptors, curr+1, final))
+	}
+}
@@ -1,6 +1,8 @@
 package client
 
 import (
+	"reflect"
+	"slices"
 	"time"
 
 	"github.com/changlongH/srpc/codec"
@@ -9,12 +11,20 @@ import (
 
 type ConnectHandle func(remoteAddr string)
 type DisconnectHandle func(remoteAddr string)
+type StateHandle func(address string, state State)
 
 type Options struct {
 	PayloadCodec   codec.PayloadCodec
 	CallTimeout    time.Duration
+	DialTimeout    time.Duration
+	Backoff        Backoff
 	ConnectHdle    ConnectHandle
 	DisconnectHdle DisconnectHandle
+	StateHdle      StateHandle
+	PoolSize       int
+	PoolPolicy     PoolPolicy
+	Interceptors   []UnaryInterceptor
+	Limits         codec.Limits
 }
 
 type Option func(*Options)
@@ -43,7 +53,97 @@ func WithDisConnectHandle(hdl DisconnectHandle) Option {
 	}
 }
 
+// WithDialTimeout connect timeout. Default 5s
+func WithDialTimeout(t time.Duration) Option {
+	return func(o *Options) {
+		o.DialTimeout = t
+	}
+}
+
+// WithConnectBackoff reconnect backoff. Default DefaultBackoff
+func WithConnectBackoff(b Backoff) Option {
+	return func(o *Options) {
+		o.Backoff = b
+	}
+}
+
+// WithStateHandle called on connectivity state changed. It's called in order without client lock,
+// so the handler may query the client. eg: GetState, WaitForReady
+func WithStateHandle(hdl StateHandle) Option {
+	return func(o *Options) {
+		o.StateHdle = hdl
+	}
+}
+
+// WithConnPool n connections per node. calls select a connection by policy. Default 1 connection
+func WithConnPool(n int, policy PoolPolicy) Option {
+	return func(o *Options) {
+		o.PoolSize = n
+		o.PoolPolicy = policy
+	}
+}
+
+// WithUnaryInterceptor wraps every invocation of the client. It replace interceptors set before
+func WithUnaryInterceptor(i UnaryInterceptor) Option {
+	return func(o *Options) {
+		o.Interceptors = []UnaryInterceptor{i}
+	}
+}
+
+// WithChainUnaryInterceptor append interceptors. The first one will be the outer most
+func WithChainUnaryInterceptor(interceptors ...UnaryInterceptor) Option {
+	return func(o *Options) {
+		o.Interceptors = append(o.Interceptors[:len(o.Interceptors):len(o.Interceptors)], interceptors...)
+	}
+}
+
+// WithLimits limits of multi part responses. Default codec.DefaultLimits. The connection violate the limits will be closed
+func WithLimits(limits codec.Limits) Option {
+	return func(o *Options) {
+		o.Limits = limits
+	}
+}
+
 var defaultClientOptions = Options{
 	CallTimeout:  time.Second * 5,
+	DialTimeout:  time.Second * 5,
+	Backoff:      DefaultBackoff,
+	PoolSize:     1,
 	PayloadCodec: payloadcodec.MsgPack{},
 }
+
+// NewOptions default options with opts applied, the same as clients created by NewClient
+func NewOptions(opts ...Option) Options {
+	options := defaultClientOptions
+	options.Limits = codec.DefaultLimits
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = 1
+	}
+	return options
+}
+
+// Equal reports whether options are the same. Handlers and interceptors are compared by function,
+// closures of the same function with different captured values are treated as equal
+func (o *Options) Equal(other *Options) bool {
+	sameFunc := func(a, b any) bool {
+		va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+		if va.IsNil() || vb.IsNil() {
+			return va.IsNil() == vb.IsNil()
+		}
+		return va.Pointer() == vb.Pointer()
+	}
+	return o.CallTimeout == other.CallTimeout &&
+		o.DialTimeout == other.DialTimeout &&
+		o.Backoff == other.Backoff &&
+		o.PoolSize == other.PoolSize &&
+		o.PoolPolicy == other.PoolPolicy &&
+		o.Limits == other.Limits &&
+		reflect.DeepEqual(o.PayloadCodec, other.PayloadCodec) &&
+		sameFunc(o.ConnectHdle, other.ConnectHdle) &&
+		sameFunc(o.DisconnectHdle, other.DisconnectHdle) &&
+		sameFunc(o.StateHdle, other.StateHdle) &&
+		slices.EqualFunc(o.Interceptors, other.Interceptors, func(a, b UnaryInterceptor) bool { return sameFunc(a, b) })
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"hash/fnv"
+)
+
+// PoolPolicy select a pool connection for every call
+type PoolPolicy int
+
+const (
+	// PolicyRoundRobin prefer ready connections in turn. Default
+	PolicyRoundRobin PoolPolicy = iota
+	// PolicyLeastPending ready connection with least waiting reply requests
+	PolicyLeastPending
+	// PolicyHashAddr same skynet service address always use same connection. keep messages order of the service
+	PolicyHashAddr
+)
+
+func (p PoolPolicy) String() string {
+	switch p {
+	case PolicyRoundRobin:
+		return "round_robin"
+	case PolicyLeastPending:
+		return "least_pending"
+	case PolicyHashAddr:
+		return "hash_addr"
+	default:
+		return "unknown"
+	}
+}
+
+func (c *Client) pick(caller *Caller) *clientConn {
+	n := len(c.conns)
+	if n == 1 {
+		return c.conns[0]
+	}
+
+	switch c.Options.PoolPolicy {
+	case PolicyHashAddr:
+		h := fnv.New32a()
+		h.Write([]byte(caller.Addr.String()))
+		return c.conns[h.Sum32()%uint32(n)]
+	case PolicyLeastPending:
+		var picked *clientConn
+		var least int
+		for _, cc := range c.conns {
+			if cc.getState() != Ready {
+				continue
+			}
+			if pending := cc.pendingCount(); picked == nil || pending < least {
+				picked, least = cc, pending
+			}
+		}
+		if picked != nil {
+			return picked
+		}
+	}
+
+	// round robin. skip not ready connections if possible
+	start := int(c.next.Add(1))
+	for i := 0; i < n; i++ {
+		if cc := c.conns[(start+i)%n]; cc.getState() == Ready {
+			return cc
+		}
+	}
+	return c.conns[start%n]
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// State connectivity state of client
+//
+//	Idle -> Connecting -> Ready -> (disconnect) -> Connecting ...
+//	Connecting -> TransientFailure -> (backoff) -> Connecting ...
+//	Any -> Shutdown (Close)
+type State int
+
+const (
+	Idle State = iota // not connected yet. first call start connecting
+	Connecting
+	Ready
+	TransientFailure // connect failed, waiting backoff to reconnect
+	Shutdown         // closed, never reconnect
+)
+
+func (s State) String() string {
+	switch s {
+	case Idle:
+		return "IDLE"
+	case Connecting:
+		return "CONNECTING"
+	case Ready:
+		return "READY"
+	case TransientFailure:
+		return "TRANSIENT_FAILURE"
+	case Shutdown:
+		return "SHUTDOWN"
+	default:
+		return fmt.Sprintf("INVALID_STATE(%d)", int(s))
+	}
+}
+
+// Backoff reconnect delay. BaseDelay * Multiplier^retries randomized by Jitter and limited by MaxDelay
+type Backoff struct {
+	BaseDelay  time.Duration
+	Multiplier float64
+	Jitter     float64
+	MaxDelay   time.Duration
+}
+
+var DefaultBackoff = Backoff{
+	BaseDelay:  time.Second,
+	Multiplier: 1.6,
+	Jitter:     0.2,
+	MaxDelay:   15 * time.Second,
+}
+
+func (b Backoff) Delay(retries int) time.Duration {
+	if retries == 0 {
+		return b.BaseDelay
+	}
+	backoff, max := float64(b.BaseDelay), float64(b.MaxDelay)
+	for backoff < max && retries > 0 {
+		backoff *= b.Multiplier
+		retries--
+	}
+	if backoff > max {
+		backoff = max
+	}
+	// Randomize backoff delays so that if a cluster of requests start at
+	// the same time, they won't operate in lockstep.
+	backoff *= 1 + b.Jitter*(rand.Float64()*2-1)
+	if backoff < 0 {
+		return 0
+	}
+	return time.Duration(backoff)
+}
+
+var ErrTransientFailure = errors.New("client connection is in transient failure")
+
+// GetState returns the connectivity state of client.
+// It's aggregated by pool connections: Ready if any connection is ready
+func (c *Client) GetState() State {
+	c.Lock()
+	defer c.Unlock()
+	return c.state
+}
+
+// WaitForReady start connecting if idle and blocks until the client is ready
+// Returns ctx.Err() if ctx is done or ErrClosing if client is shutdown
+func (c *Client) WaitForReady(ctx context.Context) error {
+	for _, cc := range c.conns {
+		cc.Lock()
+		if cc.state == Idle {
+			cc.startConnecting()
+		}
+		cc.Unlock()
+	}
+	for {
+		c.Lock()
+		state, stateCh := c.state, c.stateCh
+		c.Unlock()
+
+		switch state {
+		case Ready:
+			return nil
+		case Shutdown:
+			return ErrClosing
+		}
+
+		select {
+		case <-stateCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// updateState aggregate state of pool connections. called with clientConn lock
+func (c *Client) updateState(index int, state State) {
+	c.Lock()
+	defer c.Unlock()
+	c.connStates[index] = state
+
+	var counts [Shutdown + 1]int
+	for _, s := range c.connStates {
+		counts[s]++
+	}
+	var newState State
+	switch {
+	case counts[Ready] > 0:
+		newState = Ready
+	case counts[Connecting] > 0:
+		newState = Connecting
+	case counts[TransientFailure] > 0:
+		newState = TransientFailure
+	case counts[Idle] > 0:
+		newState = Idle
+	default:
+		newState = Shutdown
+	}
+	if c.state == newState {
+		return
+	}
+	c.state = newState
+	close(c.stateCh)
+	c.stateCh = make(chan struct{})
+	if c.Options.StateHdle != nil {
+		c.notifyState(newState)
+	}
+}
+
+// notifyState queue state for StateHdle. called with locks, the handler runs without them in order
+func (c *Client) notifyState(state State) {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+	c.notifyQueue = append(c.notifyQueue, state)
+	if !c.notifying {
+		c.notifying = true
+		go c.runStateHdle()
+	}
+}
+
+// runStateHdle until queued states are handled. only one at a time
+func (c *Client) runStateHdle() {
+	for {
+		c.notifyMu.Lock()
+		if len(c.notifyQueue) == 0 {
+			c.notifying = false
+			c.notifyMu.Unlock()
+			return
+		}
+		state := c.notifyQueue[0]
+		c.notifyQueue = c.notifyQueue[1:]
+		c.notifyMu.Unlock()
+		c.Options.StateHdle(c.Address, state)
+	}
+}
@@ -8,7 +8,9 @@ import (
 
 type Cluster struct {
 	sync.RWMutex
-	nodes map[string]*client.Client
+	nodes     map[string]*client.Client
+	resolvers map[string]*resolvedNode // nodes address managed by resolver
+	failovers map[string]*failoverNode // nodes of multi addresses
 }
 
 var (
@@ -19,19 +21,26 @@ var (
 func GetCluster() *Cluster {
 	if inst == nil {
 		once.Do(func() {
-			inst = &Cluster{
-				nodes: map[string]*client.Client{},
-			}
+			inst = newCluster()
 		})
 	}
 	return inst
 }
 
+func newCluster() *Cluster {
+	return &Cluster{
+		nodes:     map[string]*client.Client{},
+		resolvers: map[string]*resolvedNode{},
+		failovers: map[string]*failoverNode{},
+	}
+}
+
 func (cs *Cluster) register(name, address string, opts ...client.Option) (*client.Client, error) {
 	cs.Lock()
 	defer cs.Unlock()
 	if c, ok := cs.nodes[name]; ok {
 		if c.Address != address {
+			cs.release(name)
 			c.Close()
 			delete(cs.nodes, name)
 		} else {
@@ -47,9 +56,16 @@ func (cs *Cluster) register(name, address string, opts ...client.Option) (*clien
 	return c, nil
 }
 
+// release stop resolver or failover of node. must hold cs.Lock
+func (cs *Cluster) release(name string) {
+	cs.stopResolver(name)
+	cs.stopFailover(name)
+}
+
 func (cs *Cluster) remove(name string) {
 	cs.Lock()
 	defer cs.Unlock()
+	cs.release(name)
 	var c, ok = cs.nodes[name]
 	if !ok {
 		return
@@ -61,6 +77,11 @@ func (cs *Cluster) remove(name string) {
 func (cs *Cluster) query(name string) *client.Client {
 	cs.RLock()
 	defer cs.RUnlock()
+	if fn, ok := cs.failovers[name]; ok {
+		if c := fn.pick(); c != nil {
+			return c
+		}
+	}
 	if c, ok := cs.nodes[name]; ok && !c.IsClosing() {
 		return c
 	}
@@ -107,6 +128,7 @@ Default withArgsCodec(json) and Timeout(5*second)
 
 # It's safely to Reload multi times with same config
 # If client connecting. It will closed after 30s
+# Nodes absent are kept. Use SyncCluster to remove them
 
 Examples:
 
@@ -0,0 +1,372 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/changlongH/srpc/client"
+	payloadcodec "github.com/changlongH/srpc/payload_codec"
+)
+
+func TestClusterName(t *testing.T) {
+	config := `
+-- skynet clustername.lua
+__nowaiting = true	-- cluster.call fail immediately
+--[==[
+gameold = "127.0.0.1:2000"
+]==]
+db = "127.0.0.1:2528"
+db2 = '127.0.0.1:2529'; db3 = false
+gonode = "127.0.0.1:\x32\05330"
+removed = "127.0.0.1:1"
+removed = nil
+`
+	c, err := ParseClusterName([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &ClusterName{
+		Nodes:     map[string]string{"db": "127.0.0.1:2528", "db2": "127.0.0.1:2529", "gonode": "127.0.0.1:2530"},
+		Down:      []string{"db3"},
+		NoWaiting: true,
+	}
+	if !reflect.DeepEqual(c, expect) {
+		t.Fatalf("clustername: %+v", c)
+	}
+	if _, err = ParseClusterName([]byte("db = \"a\"\nport = 2528")); err == nil || err.Error() != `line 2: unsupported value of port "2", need string or false` {
+		t.Fatalf("clustername invalid value: %v", err)
+	}
+	if _, err = ParseClusterName([]byte(`db = "127.0.0.1`)); err == nil {
+		t.Fatal("clustername unfinished string not detected")
+	}
+
+	// db3 is down now
+	if _, err = Register("db3", "127.0.0.1:2531"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, name := range []string{"db", "db2", "db3", "gonode"} {
+			Remove(name)
+		}
+	})
+	path := filepath.Join(t.TempDir(), "clustername.lua")
+	if err = os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	listen, err := LoadClusterConfig(path, "gonode")
+	if err != nil || listen != "127.0.0.1:2530" {
+		t.Fatalf("self listen address: %s %v", listen, err)
+	}
+	if Query("db") == nil || Query("db2").Address != "127.0.0.1:2529" || Query("db3") != nil {
+		t.Fatal("clustername nodes not registered")
+	}
+	if _, err = LoadClusterConfig(path, "unknown"); err == nil {
+		t.Fatal("unknown self node not detected")
+	}
+}
+
+func TestSyncCluster(t *testing.T) {
+	cs := newCluster()
+	apply := func(nodes map[string]string, opts ...SyncOption) *SyncResult {
+		o := &syncOptions{}
+		for _, opt := range opts {
+			opt(o)
+		}
+		return cs.sync(nodes, o)
+	}
+	res := apply(map[string]string{"a": "127.0.0.1:3001", "b": "127.0.0.1:3002", "c": "127.0.0.1:3003"},
+		WithClientOptions(client.WithPayloadCodec(payloadcodec.MsgPack{})),
+		WithNodeOptions("b", client.WithPayloadCodec(payloadcodec.Json{})))
+	if !reflect.DeepEqual(res.Added, []string{"a", "b", "c"}) || len(res.Failed) != 0 {
+		t.Fatalf("sync add: %s", res)
+	}
+	if cs.query("a").Options.PayloadCodec.Name() != "msgpack" || cs.query("b").Options.PayloadCodec.Name() != "json" {
+		t.Fatal("sync per node options")
+	}
+
+	a, b := cs.query("a"), cs.query("b")
+	res = apply(map[string]string{"a": "127.0.0.1:3001", "b": "127.0.0.1:3012", "d": "127.0.0.1:3004"})
+	expect := &SyncResult{
+		Added:     []string{"d"},
+		Changed:   []string{"b"},
+		Removed:   []string{"c"},
+		Unchanged: []string{"a"},
+		Failed:    map[string]error{},
+	}
+	if !reflect.DeepEqual(res, expect) {
+		t.Fatalf("sync diff: %s", res)
+	}
+	if cs.query("a") != a || cs.query("b") == b || cs.query("b").Address != "127.0.0.1:3012" || cs.query("c") != nil || !b.IsClosing() {
+		t.Fatal("sync clients")
+	}
+
+	// options changed with the same address
+	nodes := map[string]string{"a": "127.0.0.1:3001", "b": "127.0.0.1:3012", "d": "127.0.0.1:3004"}
+	a = cs.query("a")
+	res = apply(nodes, WithNodeOptions("a", client.WithCallTimeout(time.Second)))
+	if !reflect.DeepEqual(res.Changed, []string{"a"}) || !reflect.DeepEqual(res.Unchanged, []string{"b", "d"}) ||
+		cs.query("a") == a || cs.query("a").Options.CallTimeout != time.Second || !a.IsClosing() {
+		t.Fatalf("sync options changed: %s", res)
+	}
+	a = cs.query("a")
+	res = apply(nodes, WithNodeOptions("a", client.WithCallTimeout(time.Second)))
+	if len(res.Changed) != 0 || len(res.Unchanged) != 3 || cs.query("a") != a {
+		t.Fatalf("sync same options: %s", res)
+	}
+	apply(map[string]string{})
+}
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cluster.json")
+	if err := os.WriteFile(path, []byte(`{"w1": "127.0.0.1:3101", "w2": "127.0.0.1:3102"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	type reload struct {
+		res *SyncResult
+		err error
+	}
+	reloads := make(chan reload, 16)
+	w, err := WatchFile(path, WithDebounce(20*time.Millisecond), WithReloadHandle(func(_ string, res *SyncResult, err error) {
+		reloads <- reload{res, err}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	t.Cleanup(func() {
+		for _, name := range []string{"w1", "w2", "w3"} {
+			Remove(name)
+		}
+	})
+	wait := func() reload {
+		select {
+		case r := <-reloads:
+			return r
+		case <-time.After(3 * time.Second):
+			t.Fatal("reload timeout")
+		}
+		return reload{}
+	}
+	if r := wait(); r.err != nil || len(r.res.Added) != 2 {
+		t.Fatalf("watch first load: %v %v", r.res, r.err)
+	}
+
+	os.WriteFile(path, []byte(`{"w1": "127.0.0.1:3111", "w2": false, "w3": "127.0.0.1:3103"}`), 0644)
+	r := wait()
+	if r.err != nil || !reflect.DeepEqual(r.res.Changed, []string{"w1"}) || !reflect.DeepEqual(r.res.Removed, []string{"w2"}) ||
+		!reflect.DeepEqual(r.res.Added, []string{"w3"}) {
+		t.Fatalf("watch edit: %v %v", r.res, r.err)
+	}
+	if Query("w1").Address != "127.0.0.1:3111" || Query("w2") != nil {
+		t.Fatal("watch edit not applied")
+	}
+
+	// broken file never touches the cluster
+	os.WriteFile(path, []byte(`{"w1": `), 0644)
+	if r := wait(); r.err == nil {
+		t.Fatal("watch broken file not reported")
+	}
+	os.WriteFile(path, nil, 0644)
+	if r := wait(); r.err == nil {
+		t.Fatal("watch empty file not reported")
+	}
+	if Query("w1") == nil || Query("w3") == nil {
+		t.Fatal("watch broken file removed nodes")
+	}
+
+	c, err := parseClusterFile([]byte("w4: 127.0.0.1:3104\nw5: false\n__nowaiting: true\n"), "yaml")
+	if err != nil || !reflect.DeepEqual(c, &ClusterName{Nodes: map[string]string{"w4": "127.0.0.1:3104"}, Down: []string{"w5"}, NoWaiting: true}) {
+		t.Fatalf("watch yaml: %+v %v", c, err)
+	}
+}
+
+func TestRegisterResolver(t *testing.T) {
+	var mu sync.Mutex
+	addrs := []string{"127.0.0.1:3201", "127.0.0.1:3202"}
+	resolver := ResolverFunc(func(ctx context.Context) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(addrs) == 0 {
+			return nil, errors.New("nxdomain")
+		}
+		return addrs, nil
+	})
+	t.Cleanup(func() { Remove("r1") })
+	// client of the same address registered before is replaced to trigger resolving on reconnecting
+	registered, err := Register("r1", "127.0.0.1:3201")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated := make(chan string, 16)
+	c, err := RegisterResolver("r1", resolver, WithResolveInterval(20*time.Millisecond),
+		WithResolveHandle(func(node, address string, err error) {
+			if err == nil {
+				migrated <- address
+			}
+		}))
+	if err != nil || c.Address != "127.0.0.1:3201" || c == registered || !registered.IsClosing() {
+		t.Fatalf("resolver register: %v", err)
+	}
+
+	// current address is kept while still resolved, failure keeps the node
+	mu.Lock()
+	addrs = []string{"127.0.0.1:3203", "127.0.0.1:3201"}
+	mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	addrs = nil
+	mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	if Query("r1") != c {
+		t.Fatal("resolver migrated while address is resolved")
+	}
+	mu.Lock()
+	addrs = []string{"127.0.0.1:3203"}
+	mu.Unlock()
+	select {
+	case address := <-migrated:
+		if address != "127.0.0.1:3203" || Query("r1").Address != address || !c.IsClosing() {
+			t.Fatalf("resolver migrate to %s", address)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("resolver migrate timeout")
+	}
+
+	Register("r1", "127.0.0.1:3204")
+	mu.Lock()
+	addrs = []string{"127.0.0.1:3205"}
+	mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	if Query("r1").Address != "127.0.0.1:3204" {
+		t.Fatal("resolver not stopped by Register")
+	}
+	Remove("r1")
+
+	// no periodic resolving
+	t.Cleanup(func() { Remove("r2") })
+	if c, err := RegisterResolver("r2", StaticResolver{"127.0.0.1:3206"}, WithResolveInterval(0)); err != nil || c.Address != "127.0.0.1:3206" {
+		t.Fatalf("resolver without interval: %v", err)
+	}
+
+	if addrs, err := (&DNSResolver{Host: "127.0.0.1", Port: 2528}).Resolve(context.Background()); err != nil || !reflect.DeepEqual(addrs, []string{"127.0.0.1:2528"}) {
+		t.Fatalf("dns resolver: %v %v", addrs, err)
+	}
+	path := filepath.Join(t.TempDir(), "clustername.lua")
+	os.WriteFile(path, []byte(`db = "127.0.0.1:2528"`), 0644)
+	if addrs, err := (&FileResolver{Path: path, Node: "db"}).Resolve(context.Background()); err != nil || !reflect.DeepEqual(addrs, []string{"127.0.0.1:2528"}) {
+		t.Fatalf("file resolver: %v %v", addrs, err)
+	}
+}
+
+func TestRegisterFailover(t *testing.T) {
+	type server struct {
+		ln    net.Listener
+		mu    sync.Mutex
+		conns []net.Conn
+	}
+	listen := func(address string) *server {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &server{ln: ln}
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				s.mu.Lock()
+				s.conns = append(s.conns, conn)
+				s.mu.Unlock()
+			}
+		}()
+		return s
+	}
+	shutdown := func(s *server) {
+		s.ln.Close()
+		s.mu.Lock()
+		for _, conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	}
+	primary, standby := listen("127.0.0.1:0"), listen("127.0.0.1:0")
+	t.Cleanup(func() { Remove("f1") })
+	defer shutdown(standby)
+	primaryAddr, standbyAddr := primary.ln.Addr().String(), standby.ln.Addr().String()
+
+	type switchover struct {
+		from, to string
+		reason   error
+	}
+	switches := make(chan switchover, 16)
+	c, err := RegisterFailover("f1", []NodeAddress{{Address: standbyAddr, Priority: 1}, {Address: primaryAddr}},
+		WithFailoverClientOptions(client.WithConnectBackoff(client.Backoff{BaseDelay: 20 * time.Millisecond, Multiplier: 1, MaxDelay: 20 * time.Millisecond})),
+		WithSwitchHandle(func(node, from, to string, reason error) {
+			switches <- switchover{from, to, reason}
+		}))
+	if err != nil || c.Address != primaryAddr || Query("f1") != c {
+		t.Fatalf("failover register: %v", err)
+	}
+	wait := func() switchover {
+		select {
+		case s := <-switches:
+			return s
+		case <-time.After(5 * time.Second):
+			t.Fatal("failover switch timeout")
+		}
+		return switchover{}
+	}
+
+	shutdown(primary)
+	if s := wait(); s.from != primaryAddr || s.to != standbyAddr || s.reason == nil || Query("f1").Address != standbyAddr {
+		t.Fatalf("failover to standby: %+v", s)
+	}
+	primary = listen(primaryAddr)
+	defer shutdown(primary)
+	if s := wait(); s.from != standbyAddr || s.to != primaryAddr || s.reason != nil || Query("f1") != c {
+		t.Fatalf("failover back to primary: %+v", s)
+	}
+
+	// calls are spread by weight over the ready addresses of same priority
+	spare := listen("127.0.0.1:0")
+	defer shutdown(spare)
+	spareAddr := spare.ln.Addr().String()
+	t.Cleanup(func() { Remove("f3") })
+	if _, err = RegisterFailover("f3", []NodeAddress{{Address: primaryAddr, Weight: 3}, {Address: spareAddr}, {Address: standbyAddr, Priority: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	GetCluster().RLock()
+	fn := GetCluster().failovers["f3"]
+	GetCluster().RUnlock()
+	for _, c := range fn.clients[:2] {
+		if err := c.WaitForReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	picked := map[string]int{}
+	for i := 0; i < 400; i++ {
+		picked[Query("f3").Address]++
+	}
+	if picked[standbyAddr] != 0 || picked[spareAddr] == 0 || picked[primaryAddr] <= picked[spareAddr] {
+		t.Fatalf("failover weighted: %v", picked)
+	}
+
+	if _, err := RegisterFailover("f2", []NodeAddress{{Address: primaryAddr}, {Address: primaryAddr, Priority: 1}}); err == nil {
+		t.Fatal("failover duplicated address not detected")
+	}
+	Remove("f1")
+	if !c.IsClosing() || Query("f1") != nil {
+		t.Fatal("failover remove")
+	}
+}
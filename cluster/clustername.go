@@ -0,0 +1,316 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/changlongH/srpc/client"
+)
+
+/*
+ClusterName skynet cluster config file (clustername.lua). Only assignments of string, true, false and nil are supported:
+
+	__nowaiting = true -- cluster.call fail immediately if node is absent
+	db = "127.0.0.1:2528"
+	db2 = false        -- node is down
+*/
+type ClusterName struct {
+	Nodes     map[string]string // node name -> address
+	Down      []string          // nodes set to false
+	NoWaiting bool              // __nowaiting. go client never wait for absent node
+}
+
+// LoadClusterName read and parse clustername.lua
+func LoadClusterName(path string) (*ClusterName, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ParseClusterName(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return c, nil
+}
+
+// ParseClusterName parse clustername.lua content
+func ParseClusterName(data []byte) (*ClusterName, error) {
+	c := &ClusterName{Nodes: map[string]string{}}
+	lex := &luaLexer{src: string(data), line: 1}
+	for {
+		tok, err := lex.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind == luaEOF {
+			break
+		}
+		if tok.kind == luaSymbol && tok.text == ";" {
+			continue
+		}
+		if tok.kind != luaName {
+			return nil, lex.errorf("expect node name got %q", tok.text)
+		}
+		name := tok.text
+		if tok, err = lex.next(); err != nil {
+			return nil, err
+		}
+		if tok.kind != luaSymbol || tok.text != "=" {
+			return nil, lex.errorf("expect '=' after %s got %q", name, tok.text)
+		}
+		if tok, err = lex.next(); err != nil {
+			return nil, err
+		}
+		delete(c.Nodes, name)
+		c.Down = removeString(c.Down, name)
+		switch {
+		case name == "__nowaiting":
+			// lua truth
+			c.NoWaiting = tok.kind != luaName || (tok.text != "false" && tok.text != "nil")
+		case tok.kind == luaString:
+			c.Nodes[name] = tok.text
+		case tok.kind == luaName && tok.text == "false":
+			c.Down = append(c.Down, name)
+		case tok.kind == luaName && tok.text == "nil":
+		default:
+			return nil, lex.errorf("unsupported value of %s %q, need string or false", name, tok.text)
+		}
+	}
+	return c, nil
+}
+
+func removeString(ss []string, s string) []string {
+	for i, v := range ss {
+		if v == s {
+			return append(ss[:i], ss[i+1:]...)
+		}
+	}
+	return ss
+}
+
+// Address address of node name. eg: listen address of self node
+func (c *ClusterName) Address(name string) (string, bool) {
+	addr, ok := c.Nodes[name]
+	return addr, ok
+}
+
+// Apply register nodes and remove down nodes. Returns register fail nodesErr like ReloadCluster
+func (c *ClusterName) Apply(opts ...client.Option) map[string]error {
+	for _, name := range c.Down {
+		Remove(name)
+	}
+	return ReloadCluster(c.Nodes, opts...)
+}
+
+/*
+LoadClusterConfig load clustername.lua, register every node and returns the listen address of self.
+skynet and go nodes share one config:
+
+	listen, err := cluster.LoadClusterConfig("clustername.lua", "gonode")
+	gate, err := server.NewGate(listen)
+*/
+func LoadClusterConfig(path string, self string, opts ...client.Option) (string, error) {
+	c, err := LoadClusterName(path)
+	if err != nil {
+		return "", err
+	}
+	listen, ok := c.Address(self)
+	if !ok {
+		return "", fmt.Errorf("%s: self node %s not found", path, self)
+	}
+	if errNodes := c.Apply(opts...); len(errNodes) > 0 {
+		return listen, fmt.Errorf("%s: register nodes failed: %v", path, errNodes)
+	}
+	return listen, nil
+}
+
+type luaTokenKind int
+
+const (
+	luaEOF luaTokenKind = iota
+	luaName
+	luaString
+	luaSymbol
+)
+
+type luaToken struct {
+	kind luaTokenKind
+	text string
+}
+
+// luaLexer tokens of lua config. names, strings and symbols, comments are skipped
+type luaLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *luaLexer) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", l.line, fmt.Sprintf(format, args...))
+}
+
+func (l *luaLexer) next() (luaToken, error) {
+	if err := l.skip(); err != nil {
+		return luaToken{}, err
+	}
+	if l.pos >= len(l.src) {
+		return luaToken{kind: luaEOF}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case c == '_' || isLetter(c):
+		start := l.pos
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return luaToken{kind: luaName, text: l.src[start:l.pos]}, nil
+	case c == '"' || c == '\'':
+		s, err := l.quoted(c)
+		return luaToken{kind: luaString, text: s}, err
+	case c == '[' && l.longBracket() >= 0:
+		s, err := l.long()
+		return luaToken{kind: luaString, text: s}, err
+	}
+	l.pos++
+	return luaToken{kind: luaSymbol, text: string(c)}, nil
+}
+
+// skip spaces and comments
+func (l *luaLexer) skip() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "--"):
+			l.pos += 2
+			if l.pos < len(l.src) && l.src[l.pos] == '[' && l.longBracket() >= 0 {
+				if _, err := l.long(); err != nil {
+					return err
+				}
+				continue
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// longBracket level of [==[ at pos, -1 if not
+func (l *luaLexer) longBracket() int {
+	i := l.pos + 1
+	for i < len(l.src) && l.src[i] == '=' {
+		i++
+	}
+	if i < len(l.src) && l.src[i] == '[' {
+		return i - l.pos - 1
+	}
+	return -1
+}
+
+// long string or comment [==[ ... ]==]. the first newline is skipped
+func (l *luaLexer) long() (string, error) {
+	level := l.longBracket()
+	l.pos += level + 2
+	if strings.HasPrefix(l.src[l.pos:], "\r\n") {
+		l.pos += 2
+		l.line++
+	} else if strings.HasPrefix(l.src[l.pos:], "\n") {
+		l.pos++
+		l.line++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(l.src[l.pos:], closing)
+	if end < 0 {
+		return "", l.errorf("unfinished long string")
+	}
+	s := l.src[l.pos : l.pos+end]
+	l.line += strings.Count(s, "\n")
+	l.pos += end + len(closing)
+	return s, nil
+}
+
+func (l *luaLexer) quoted(quote byte) (string, error) {
+	var b strings.Builder
+	l.pos++
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case quote:
+			return b.String(), nil
+		case '\n':
+			return "", l.errorf("unfinished string")
+		case '\\':
+			if l.pos >= len(l.src) {
+				return "", l.errorf("unfinished string")
+			}
+			e := l.src[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'a':
+				b.WriteByte('\a')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'v':
+				b.WriteByte('\v')
+			case '\\', '"', '\'':
+				b.WriteByte(e)
+			case '\n':
+				l.line++
+				b.WriteByte('\n')
+			case 'x':
+				if l.pos+2 > len(l.src) {
+					return "", l.errorf("invalid escape \\x")
+				}
+				n, err := strconv.ParseUint(l.src[l.pos:l.pos+2], 16, 8)
+				if err != nil {
+					return "", l.errorf("invalid escape \\x%s", l.src[l.pos:l.pos+2])
+				}
+				b.WriteByte(byte(n))
+				l.pos += 2
+			default:
+				if !isDigit(e) {
+					return "", l.errorf("invalid escape \\%c", e)
+				}
+				start := l.pos - 1
+				for l.pos < len(l.src) && l.pos-start < 3 && isDigit(l.src[l.pos]) {
+					l.pos++
+				}
+				n, err := strconv.ParseUint(l.src[start:l.pos], 10, 8)
+				if err != nil {
+					return "", l.errorf("invalid escape \\%s", l.src[start:l.pos])
+				}
+				b.WriteByte(byte(n))
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", l.errorf("unfinished string")
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
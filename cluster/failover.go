@@ -0,0 +1,276 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+
+	"github.com/changlongH/srpc/client"
+)
+
+// NodeAddress one address of multi address node
+type NodeAddress struct {
+	Address  string
+	Priority int // lower is preferred. eg: primary 0, hot standby 1
+	Weight   int // every call selects one of the ready addresses of same priority by weight. Default 1
+}
+
+// SwitchHandle called after node switched from address to address. reason is nil if switched back to preferred address
+type SwitchHandle func(node string, from, to string, reason error)
+
+type failoverOptions struct {
+	handle     SwitchHandle
+	clientOpts []client.Option
+}
+
+type FailoverOption func(*failoverOptions)
+
+// WithSwitchHandle callback on switchover
+func WithSwitchHandle(handle SwitchHandle) FailoverOption {
+	return func(o *failoverOptions) {
+		o.handle = handle
+	}
+}
+
+// WithFailoverClientOptions client options of every address
+func WithFailoverClientOptions(opts ...client.Option) FailoverOption {
+	return func(o *failoverOptions) {
+		o.clientOpts = append(o.clientOpts, opts...)
+	}
+}
+
+// failoverNode node with multi addresses. The active client is cs.nodes[name], calls are spread by pick
+type failoverNode struct {
+	name    string
+	addrs   []NodeAddress
+	clients []*client.Client
+	opts    *failoverOptions
+	trigger chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// clientOptions connectivity state change triggers evaluation
+func (fn *failoverNode) clientOptions() []client.Option {
+	return append(slices.Clip(fn.opts.clientOpts), func(o *client.Options) {
+		hdl := o.StateHdle
+		o.StateHdle = func(address string, state client.State) {
+			if hdl != nil {
+				hdl(address, state)
+			}
+			select {
+			case fn.trigger <- struct{}{}:
+			default:
+			}
+		}
+	})
+}
+
+func (fn *failoverNode) loop() {
+	for {
+		select {
+		case <-fn.ctx.Done():
+			return
+		case <-fn.trigger:
+			fn.evaluate()
+		}
+	}
+}
+
+// evaluate switch to the preferred ready address
+func (fn *failoverNode) evaluate() {
+	cs := GetCluster()
+	cs.Lock()
+	if cs.failovers[fn.name] != fn {
+		cs.Unlock()
+		return
+	}
+	active := cs.nodes[fn.name]
+	next := fn.choose(active)
+	if next == nil || next == active {
+		cs.Unlock()
+		return
+	}
+	cs.nodes[fn.name] = next
+	cs.Unlock()
+
+	if fn.opts.handle != nil {
+		fn.opts.handle(fn.name, active.Address, next.Address, switchReason(active))
+	}
+}
+
+func switchReason(c *client.Client) error {
+	state := c.GetState()
+	if state == client.Ready {
+		return nil
+	}
+	for _, stat := range c.ConnStats() {
+		if stat.LastErr != nil {
+			return fmt.Errorf("%s %s: %w", c.Address, state, stat.LastErr)
+		}
+	}
+	return fmt.Errorf("%s %s", c.Address, state)
+}
+
+// candidates ready addresses of the lowest priority
+func (fn *failoverNode) candidates() []int {
+	var candidates []int
+	for i, c := range fn.clients {
+		if c.GetState() != client.Ready {
+			continue
+		}
+		if len(candidates) > 0 {
+			if p := fn.addrs[candidates[0]].Priority; fn.addrs[i].Priority > p {
+				continue
+			} else if fn.addrs[i].Priority < p {
+				candidates = candidates[:0]
+			}
+		}
+		candidates = append(candidates, i)
+	}
+	return candidates
+}
+
+// weighted select one of candidates by weight
+func (fn *failoverNode) weighted(candidates []int) *client.Client {
+	total := 0
+	for _, i := range candidates {
+		total += fn.addrs[i].Weight
+	}
+	n := rand.Intn(total)
+	for _, i := range candidates {
+		if n -= fn.addrs[i].Weight; n < 0 {
+			return fn.clients[i]
+		}
+	}
+	return fn.clients[candidates[0]]
+}
+
+/*
+choose the active client of the ready addresses of the lowest priority.
+Keep the active client if it's one of them. nil if no address is ready
+*/
+func (fn *failoverNode) choose(active *client.Client) *client.Client {
+	candidates := fn.candidates()
+	if len(candidates) == 0 {
+		return nil
+	}
+	for _, i := range candidates {
+		if fn.clients[i] == active {
+			return active
+		}
+	}
+	return fn.weighted(candidates)
+}
+
+// pick client of one call, selected by weight from the ready addresses of the lowest priority. nil if no address is ready
+func (fn *failoverNode) pick() *client.Client {
+	candidates := fn.candidates()
+	if len(candidates) == 0 {
+		return nil
+	}
+	return fn.weighted(candidates)
+}
+
+// stopFailover must hold cs.Lock. close clients except the active one which is cs.nodes[name]
+func (cs *Cluster) stopFailover(name string) {
+	fn, ok := cs.failovers[name]
+	if !ok {
+		return
+	}
+	delete(cs.failovers, name)
+	fn.cancel()
+	for _, c := range fn.clients {
+		if c != cs.nodes[name] {
+			c.Close()
+		}
+	}
+}
+
+/*
+RegisterFailover register node of multi addresses. eg: skynet primary and hot standby.
+
+Every address is connected and reconnected in background. Query and srpc.Call are unchanged,
+every Query selects one of the ready addresses of the lowest Priority by Weight.
+The node switches to the ready addresses of the next Priority after the preferred ones failed to connect or disconnected,
+and switches back when a preferred address is ready again. The client returned is the first preferred address.
+Register, SyncCluster with a new address or client options or Remove the node close all addresses.
+
+Examples:
+
+	RegisterFailover("db", []cluster.NodeAddress{
+		{Address: "10.0.0.1:2528", Priority: 0},
+		{Address: "10.0.0.2:2528", Priority: 1},
+	}, cluster.WithSwitchHandle(func(node, from, to string, reason error) {
+		log.Printf("node %s switch from %s to %s. %v", node, from, to, reason)
+	}))
+	srpc.Call("db", ".db", "get", args, &reply)
+*/
+func RegisterFailover(node string, addrs []NodeAddress, opts ...FailoverOption) (*client.Client, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("failover node " + node + " has no address")
+	}
+	addrs = slices.Clone(addrs)
+	for i := range addrs {
+		if addrs[i].Weight < 0 {
+			return nil, fmt.Errorf("failover node %s address %s weight %d < 0", node, addrs[i].Address, addrs[i].Weight)
+		}
+		if addrs[i].Weight == 0 {
+			addrs[i].Weight = 1
+		}
+		for _, a := range addrs[:i] {
+			if a.Address == addrs[i].Address {
+				return nil, fmt.Errorf("failover node %s duplicated address %s", node, a.Address)
+			}
+		}
+	}
+	slices.SortStableFunc(addrs, func(a, b NodeAddress) int {
+		if a.Priority != b.Priority {
+			return a.Priority - b.Priority
+		}
+		return b.Weight - a.Weight
+	})
+
+	o := &failoverOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	fn := &failoverNode{
+		name:    node,
+		addrs:   addrs,
+		opts:    o,
+		trigger: make(chan struct{}, 1),
+	}
+	fn.ctx, fn.cancel = context.WithCancel(context.Background())
+	for _, addr := range addrs {
+		c, err := client.NewClient(addr.Address, fn.clientOptions()...)
+		if err != nil {
+			fn.cancel()
+			for _, c := range fn.clients {
+				c.Close()
+			}
+			return nil, err
+		}
+		fn.clients = append(fn.clients, c)
+	}
+
+	cs := GetCluster()
+	cs.Lock()
+	old, ok := cs.nodes[node]
+	cs.release(node)
+	cs.failovers[node] = fn
+	cs.nodes[node] = fn.clients[0]
+	if ok {
+		old.Close()
+	}
+	cs.Unlock()
+
+	go fn.loop()
+	for _, c := range fn.clients {
+		// keep every address connected to know its health
+		go c.WaitForReady(fn.ctx)
+	}
+	return fn.clients[0], nil
+}
@@ -0,0 +1,332 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/changlongH/srpc/client"
+)
+
+/*
+Resolver resolves addresses of one node. The first address is used unless the current address is still resolved,
+so resolver returns addresses in preference order.
+*/
+type Resolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+// ResolverFunc adapter of func as Resolver
+type ResolverFunc func(ctx context.Context) ([]string, error)
+
+func (f ResolverFunc) Resolve(ctx context.Context) ([]string, error) {
+	return f(ctx)
+}
+
+// StaticResolver fixed addresses
+type StaticResolver []string
+
+func (r StaticResolver) Resolve(ctx context.Context) ([]string, error) {
+	return r, nil
+}
+
+// FileResolver address of Node in cluster config file. json, yaml or clustername.lua, see WatchFile
+type FileResolver struct {
+	Path   string
+	Node   string
+	Format string // default by file extension
+}
+
+func (r *FileResolver) Resolve(ctx context.Context) ([]string, error) {
+	data, err := os.ReadFile(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	format := r.Format
+	if format == "" {
+		format = formatOf(r.Path)
+	}
+	c, err := parseClusterFile(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", r.Path, err)
+	}
+	address, ok := c.Address(r.Node)
+	if !ok {
+		return nil, fmt.Errorf("%s: node %s not found", r.Path, r.Node)
+	}
+	return []string{address}, nil
+}
+
+// DNSResolver A/AAAA records of Host. Addresses are sorted to be stable
+type DNSResolver struct {
+	Host     string
+	Port     int
+	Resolver *net.Resolver // default net.DefaultResolver
+}
+
+func (r *DNSResolver) Resolve(ctx context.Context) ([]string, error) {
+	hosts, err := lookupResolver(r.Resolver).LookupHost(ctx, r.Host)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(hosts)
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, strconv.Itoa(r.Port))
+	}
+	return addrs, nil
+}
+
+// SRVResolver SRV records of _Service._Proto.Name. ordered by priority then weight. eg: {Service: "skynet", Proto: "tcp", Name: "db.local"}
+type SRVResolver struct {
+	Service  string
+	Proto    string
+	Name     string
+	Resolver *net.Resolver // default net.DefaultResolver
+}
+
+func (r *SRVResolver) Resolve(ctx context.Context) ([]string, error) {
+	_, records, err := lookupResolver(r.Resolver).LookupSRV(ctx, r.Service, r.Proto, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(records, func(a, b *net.SRV) int {
+		if a.Priority != b.Priority {
+			return int(a.Priority) - int(b.Priority)
+		}
+		return int(b.Weight) - int(a.Weight)
+	})
+	addrs := make([]string, len(records))
+	for i, srv := range records {
+		addrs[i] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+	}
+	return addrs, nil
+}
+
+func lookupResolver(r *net.Resolver) *net.Resolver {
+	if r == nil {
+		return net.DefaultResolver
+	}
+	return r
+}
+
+const (
+	DefaultResolveInterval = 30 * time.Second
+	resolveTimeout         = 5 * time.Second
+	minResolveInterval     = time.Second // reconnect triggered resolving
+)
+
+// ResolveHandle called after node migrated to address, or resolving failed with err
+type ResolveHandle func(node string, address string, err error)
+
+type resolveOptions struct {
+	interval   time.Duration
+	handle     ResolveHandle
+	clientOpts []client.Option
+}
+
+type ResolveOption func(*resolveOptions)
+
+// WithResolveInterval re-resolve periodically. <= 0 only re-resolve on reconnecting. Default DefaultResolveInterval
+func WithResolveInterval(d time.Duration) ResolveOption {
+	return func(o *resolveOptions) {
+		o.interval = d
+	}
+}
+
+// WithResolveHandle callback on migration and resolving error
+func WithResolveHandle(handle ResolveHandle) ResolveOption {
+	return func(o *resolveOptions) {
+		o.handle = handle
+	}
+}
+
+// WithResolveClientOptions client options of node
+func WithResolveClientOptions(opts ...client.Option) ResolveOption {
+	return func(o *resolveOptions) {
+		o.clientOpts = append(o.clientOpts, opts...)
+	}
+}
+
+// resolvedNode node address managed by resolver
+type resolvedNode struct {
+	name     string
+	resolver Resolver
+	opts     *resolveOptions
+	trigger  chan struct{}
+	stop     chan struct{}
+	client   *client.Client // created by clientOptions, guarded by cs.Lock
+}
+
+// clientOptions options of node, reconnecting triggers resolving
+func (rn *resolvedNode) clientOptions() []client.Option {
+	return append(slices.Clip(rn.opts.clientOpts), func(o *client.Options) {
+		hdl := o.StateHdle
+		o.StateHdle = func(address string, state client.State) {
+			if hdl != nil {
+				hdl(address, state)
+			}
+			if state == client.TransientFailure || state == client.Connecting {
+				select {
+				case rn.trigger <- struct{}{}:
+				default:
+				}
+			}
+		}
+	})
+}
+
+func (rn *resolvedNode) resolve(current string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := rn.resolver.Resolve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("resolve node %s err: %w", rn.name, err)
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("resolve node %s err: no address", rn.name)
+	}
+	if slices.Contains(addrs, current) {
+		return current, nil
+	}
+	return addrs[0], nil
+}
+
+func (rn *resolvedNode) loop() {
+	var tick <-chan time.Time
+	if rn.opts.interval > 0 {
+		ticker := time.NewTicker(rn.opts.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var last time.Time
+	for {
+		select {
+		case <-rn.stop:
+			return
+		case <-tick:
+		case <-rn.trigger:
+			if time.Since(last) < minResolveInterval {
+				continue
+			}
+		}
+		last = time.Now()
+
+		cs := GetCluster()
+		var current string
+		if c := cs.query(rn.name); c != nil {
+			current = c.Address
+		}
+		address, err := rn.resolve(current)
+		if err == nil {
+			var migrated bool
+			if migrated, err = cs.migrate(rn, address); !migrated && err == nil {
+				continue
+			}
+		}
+		if rn.opts.handle != nil {
+			rn.opts.handle(rn.name, address, err)
+		}
+	}
+}
+
+/*
+migrate node to address like register. false if address unchanged or resolver stopped.
+A client not created by the resolver is replaced even if address unchanged, its reconnecting doesn't trigger resolving
+*/
+func (cs *Cluster) migrate(rn *resolvedNode, address string) (bool, error) {
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.resolvers[rn.name] != rn {
+		return false, nil
+	}
+	old, ok := cs.nodes[rn.name]
+	if ok && old == rn.client && old.Address == address && !old.IsClosing() {
+		return false, nil
+	}
+	c, err := client.NewClient(address, rn.clientOptions()...)
+	if err != nil {
+		return false, err
+	}
+	cs.nodes[rn.name] = c
+	rn.client = c
+	if ok {
+		old.Close()
+	}
+	return true, nil
+}
+
+// stopResolver must hold cs.Lock
+func (cs *Cluster) stopResolver(name string) {
+	if rn, ok := cs.resolvers[name]; ok {
+		delete(cs.resolvers, name)
+		close(rn.stop)
+	}
+}
+
+var errResolverStopped = errors.New("resolver stopped")
+
+/*
+RegisterResolver register node with address resolved by resolver.
+
+The node is resolved now, then re-resolved periodically and whenever the client is reconnecting.
+If the current address is no longer resolved, the node migrates to the new address like Register:
+the old client is closed gracefully. An existing client is replaced even if it has the same address.
+Register, SyncCluster with a new address or client options or Remove the node stop resolving.
+
+Examples:
+
+	RegisterResolver("db", &cluster.SRVResolver{Service: "skynet", Proto: "tcp", Name: "db.local"},
+		cluster.WithResolveInterval(time.Minute),
+		cluster.WithResolveClientOptions(client.WithCallTimeout(3*time.Second)),
+		cluster.WithResolveHandle(func(node, address string, err error) {
+			log.Println(node, address, err)
+		}))
+*/
+func RegisterResolver(node string, resolver Resolver, opts ...ResolveOption) (*client.Client, error) {
+	o := &resolveOptions{interval: DefaultResolveInterval}
+	for _, opt := range opts {
+		opt(o)
+	}
+	rn := &resolvedNode{
+		name:     node,
+		resolver: resolver,
+		opts:     o,
+		trigger:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	cs := GetCluster()
+	var current string
+	if c := cs.query(node); c != nil {
+		current = c.Address
+	}
+	address, err := rn.resolve(current)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.Lock()
+	cs.release(node)
+	cs.resolvers[node] = rn
+	cs.Unlock()
+	if _, err = cs.migrate(rn, address); err != nil {
+		cs.Lock()
+		if cs.resolvers[node] == rn {
+			cs.stopResolver(node)
+		}
+		cs.Unlock()
+		return nil, err
+	}
+	go rn.loop()
+	c := cs.query(node)
+	if c == nil {
+		return nil, errResolverStopped
+	}
+	return c, nil
+}
@@ -0,0 +1,122 @@
+package cluster
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/changlongH/srpc/client"
+)
+
+// SyncResult diff of SyncCluster. Node names are sorted
+type SyncResult struct {
+	Added     []string
+	Changed   []string // address or client options changed, the old client is closed gracefully
+	Removed   []string
+	Unchanged []string
+	Failed    map[string]error // the old client is kept if any
+}
+
+func (r *SyncResult) String() string {
+	return fmt.Sprintf("added=%v changed=%v removed=%v unchanged=%d failed=%v",
+		r.Added, r.Changed, r.Removed, len(r.Unchanged), r.Failed)
+}
+
+type syncOptions struct {
+	clientOpts []client.Option
+	nodeOpts   map[string][]client.Option
+	// keepAbsent nodes absent are kept unless they are down. like ReloadCluster
+	keepAbsent bool
+	down       []string
+}
+
+type SyncOption func(*syncOptions)
+
+// WithClientOptions client options of all nodes
+func WithClientOptions(opts ...client.Option) SyncOption {
+	return func(o *syncOptions) {
+		o.clientOpts = append(o.clientOpts, opts...)
+	}
+}
+
+// WithNodeOptions client options of node. applied after WithClientOptions
+func WithNodeOptions(node string, opts ...client.Option) SyncOption {
+	return func(o *syncOptions) {
+		if o.nodeOpts == nil {
+			o.nodeOpts = map[string][]client.Option{}
+		}
+		o.nodeOpts[node] = append(o.nodeOpts[node], opts...)
+	}
+}
+
+func (o *syncOptions) options(node string) []client.Option {
+	return append(slices.Clip(o.clientOpts), o.nodeOpts[node]...)
+}
+
+func (cs *Cluster) sync(nodes map[string]string, o *syncOptions) *SyncResult {
+	res := &SyncResult{Failed: map[string]error{}}
+	var closing []*client.Client
+
+	cs.Lock()
+	for name, address := range nodes {
+		old, ok := cs.nodes[name]
+		opts := o.options(name)
+		if ok && old.Address == address && !old.IsClosing() {
+			if options := client.NewOptions(opts...); old.Options.Equal(&options) {
+				res.Unchanged = append(res.Unchanged, name)
+				continue
+			}
+		}
+		c, err := client.NewClient(address, opts...)
+		if err != nil {
+			res.Failed[name] = err
+			continue
+		}
+		cs.release(name)
+		cs.nodes[name] = c
+		if ok {
+			closing = append(closing, old)
+			res.Changed = append(res.Changed, name)
+		} else {
+			res.Added = append(res.Added, name)
+		}
+	}
+	for name, c := range cs.nodes {
+		if _, ok := nodes[name]; !ok && (!o.keepAbsent || slices.Contains(o.down, name)) {
+			cs.release(name)
+			delete(cs.nodes, name)
+			closing = append(closing, c)
+			res.Removed = append(res.Removed, name)
+		}
+	}
+	cs.Unlock()
+
+	for _, c := range closing {
+		c.Close()
+	}
+	slices.Sort(res.Added)
+	slices.Sort(res.Changed)
+	slices.Sort(res.Removed)
+	slices.Sort(res.Unchanged)
+	return res
+}
+
+/*
+SyncCluster treat nodes as the full desired state of cluster.
+
+Nodes absent are removed and closed gracefully, unchanged nodes are untouched. Nodes with new address or client options
+are recreated, options are compared by client.Options.Equal. Failed nodes keep the old client if any.
+
+Examples:
+
+	res := SyncCluster(map[string]string{"db": "127.0.0.1:2528", "web": "127.0.0.1:2529"},
+		WithClientOptions(client.WithPayloadCodec(&payloadcodec.MsgPack{})),
+		WithNodeOptions("web", client.WithPayloadCodec(&payloadcodec.Json{})))
+	log.Println(res)
+*/
+func SyncCluster(nodes map[string]string, opts ...SyncOption) *SyncResult {
+	o := &syncOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return GetCluster().sync(nodes, o)
+}
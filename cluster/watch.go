@@ -0,0 +1,292 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultWatchDebounce edits within debounce are applied once
+const DefaultWatchDebounce = 500 * time.Millisecond
+
+// ReloadHandle result of applying the watched file. err is not nil if the file is broken and nothing is applied
+type ReloadHandle func(path string, res *SyncResult, err error)
+
+type watchOptions struct {
+	debounce time.Duration
+	format   string
+	prune    bool
+	handle   ReloadHandle
+	syncOpts []SyncOption
+}
+
+type WatchOption func(*watchOptions)
+
+// WithDebounce wait d after the last edit before reload. Default DefaultWatchDebounce
+func WithDebounce(d time.Duration) WatchOption {
+	return func(o *watchOptions) {
+		o.debounce = d
+	}
+}
+
+// WithFormat file format: json, yaml or lua. Default by file extension
+func WithFormat(format string) WatchOption {
+	return func(o *watchOptions) {
+		o.format = format
+	}
+}
+
+// WithPrune remove nodes absent from the file like SyncCluster. Default absent nodes are kept like ReloadCluster
+func WithPrune() WatchOption {
+	return func(o *watchOptions) {
+		o.prune = true
+	}
+}
+
+// WithReloadHandle callback after every reload, including the first one
+func WithReloadHandle(handle ReloadHandle) WatchOption {
+	return func(o *watchOptions) {
+		o.handle = handle
+	}
+}
+
+// WithSyncOptions client options of nodes. see WithClientOptions and WithNodeOptions
+func WithSyncOptions(opts ...SyncOption) WatchOption {
+	return func(o *watchOptions) {
+		o.syncOpts = append(o.syncOpts, opts...)
+	}
+}
+
+// Watcher watching cluster config file. see WatchFile
+type Watcher struct {
+	path string
+	opts *watchOptions
+	fsw  *fsnotify.Watcher
+
+	mu   sync.Mutex // serialize reload
+	last []byte     // content applied last time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+/*
+WatchFile load cluster config file and reload it after every edit.
+
+Supported formats: json and yaml object of node name to address, or skynet clustername.lua.
+Node set to false is down and removed, "__nowaiting" is ignored:
+
+	{"db": "127.0.0.1:2528", "db2": false}
+
+A broken file (unreadable, syntax error or no nodes) is reported to ReloadHandle and never touches the cluster.
+The parent directory is watched, so editors replacing the file and kubernetes configmap are supported.
+Returns error if the first load failed.
+
+Examples:
+
+	w, err := cluster.WatchFile("clustername.lua",
+		cluster.WithSyncOptions(cluster.WithClientOptions(client.WithCallTimeout(3*time.Second))),
+		cluster.WithReloadHandle(func(path string, res *cluster.SyncResult, err error) {
+			log.Println(path, res, err)
+		}))
+	defer w.Close()
+*/
+func WatchFile(path string, opts ...WatchOption) (*Watcher, error) {
+	o := &watchOptions{debounce: DefaultWatchDebounce}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.format == "" {
+		o.format = formatOf(path)
+	}
+	if o.format == "" {
+		return nil, fmt.Errorf("%s: unknown cluster config format", path)
+	}
+	path = filepath.Clean(path)
+	w := &Watcher{
+		path:   path,
+		opts:   o,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if _, err := w.reload(); err != nil {
+		return nil, err
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := fsw.Add(filepath.Dir(path)); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+	w.fsw = fsw
+	go w.loop()
+	return w, nil
+}
+
+func formatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".lua":
+		return "lua"
+	}
+	return ""
+}
+
+// Path the watched file
+func (w *Watcher) Path() string {
+	return w.path
+}
+
+// Reload load the file and apply it now. Unchanged content is applied again
+func (w *Watcher) Reload() (*SyncResult, error) {
+	w.mu.Lock()
+	w.last = nil
+	w.mu.Unlock()
+	return w.reload()
+}
+
+// Close stop watching. Registered nodes are kept
+func (w *Watcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		if w.fsw != nil {
+			err = w.fsw.Close()
+			<-w.done
+		}
+	})
+	return err
+}
+
+func (w *Watcher) loop() {
+	defer close(w.done)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.closed:
+			return
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			// configmap swaps symlinks of other names in directory, the content is compared before apply
+			if ev.Op == fsnotify.Chmod && filepath.Clean(ev.Name) != w.path {
+				continue
+			}
+			timer.Reset(w.opts.debounce)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			w.notify(nil, fmt.Errorf("%s: watch err: %w", w.path, err))
+		case <-timer.C:
+			w.reload()
+		}
+	}
+}
+
+// reload apply the file if content changed. res is nil if unchanged
+func (w *Watcher) reload() (*SyncResult, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data, err := os.ReadFile(w.path)
+	if err == nil && w.last != nil && bytes.Equal(data, w.last) {
+		return nil, nil
+	}
+	var c *ClusterName
+	if err == nil {
+		if c, err = parseClusterFile(data, w.opts.format); err != nil {
+			err = fmt.Errorf("%s:%w", w.path, err)
+		}
+	}
+	if err != nil {
+		w.notify(nil, err)
+		return nil, err
+	}
+
+	o := &syncOptions{keepAbsent: !w.opts.prune, down: c.Down}
+	for _, opt := range w.opts.syncOpts {
+		opt(o)
+	}
+	res := GetCluster().sync(c.Nodes, o)
+	w.last = data
+	w.notify(res, nil)
+	return res, nil
+}
+
+func (w *Watcher) notify(res *SyncResult, err error) {
+	if w.opts.handle != nil {
+		w.opts.handle(w.path, res, err)
+	}
+}
+
+// parseClusterFile json, yaml or clustername.lua. empty config is an error, it's likely being written
+func parseClusterFile(data []byte, format string) (*ClusterName, error) {
+	var c *ClusterName
+	var err error
+	switch format {
+	case "lua":
+		c, err = ParseClusterName(data)
+	case "json":
+		var m map[string]any
+		if err = json.Unmarshal(data, &m); err == nil {
+			c, err = clusterNameOf(m)
+		}
+	case "yaml":
+		var m map[string]any
+		if err = yaml.Unmarshal(data, &m); err == nil {
+			c, err = clusterNameOf(m)
+		}
+	default:
+		err = fmt.Errorf("unknown cluster config format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Nodes) == 0 && len(c.Down) == 0 {
+		return nil, errors.New("no nodes in cluster config")
+	}
+	return c, nil
+}
+
+func clusterNameOf(m map[string]any) (*ClusterName, error) {
+	c := &ClusterName{Nodes: map[string]string{}}
+	for name, v := range m {
+		if name == "__nowaiting" {
+			b, _ := v.(bool)
+			c.NoWaiting = b
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			c.Nodes[name] = v
+		case bool:
+			if v {
+				return nil, fmt.Errorf("unsupported value of %s true, need string or false", name)
+			}
+			c.Down = append(c.Down, name)
+		case nil:
+		default:
+			return nil, fmt.Errorf("unsupported value of %s %v, need string or false", name, v)
+		}
+	}
+	return c, nil
+}
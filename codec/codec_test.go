@@ -3,9 +3,20 @@ package codec
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	payloadcodec "github.com/changlongH/srpc/payload_codec"
+	"github.com/cloudwego/netpoll"
+	"github.com/vmihailenco/msgpack"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyz0123456789"
@@ -129,4 +140,824 @@ func TestPayloadCodec(t *testing.T) {
 			t.Errorf("text: raw=%v,dec=%v", msg, v)
 		}
 	}
+
+	if c, ok = GetPayloadCodec("protobuf"); ok {
+		st, _ := structpb.NewStruct(map[string]any{"key": "foo", "val": 1.5})
+		out, err := c.Marshal(st)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		v := &structpb.Struct{}
+		if err = c.Unmarshal(out, v); err != nil {
+			t.Error(err)
+			return
+		}
+		if !proto.Equal(v, st) {
+			t.Errorf("protobuf: raw=%v,dec=%v", st, v)
+		}
+		if _, err = c.Marshal(args); err == nil {
+			t.Error("protobuf: expect error for non proto.Message")
+		}
+		// nil and empty message are null
+		if out, _ = c.Marshal((*structpb.Struct)(nil)); !c.IsNull(out) {
+			t.Errorf("protobuf: nil message is not null %v", out)
+		}
+	}
+}
+
+func TestLuaSeri(t *testing.T) {
+	type Item struct {
+		Id    int               `lua:"id"`
+		Name  string            `lua:"name"`
+		Tags  []string          `lua:"tags"`
+		Attrs map[string]int64  `lua:"attrs"`
+		Rate  float64           `lua:"rate,omitempty"`
+		Extra map[int64]float32 `lua:"extra"`
+	}
+	pc, ok := GetPayloadCodec("luaseri")
+	if !ok {
+		t.Fatal("luaseri not registered")
+	}
+	mc, ok := pc.(MultiPayloadCodec)
+	if !ok {
+		t.Fatal("luaseri not multi payload codec")
+	}
+
+	// lua string compatible with cluster string args
+	str := generateRandomString(0x10000)
+	buf := &bytes.Buffer{}
+	if err := WriteStringToBuf(buf, []byte(str)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := pc.Marshal(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, buf.Bytes()) {
+		t.Fatal("luaseri string not equal cluster string")
+	}
+
+	item := Item{
+		Id:    10001,
+		Name:  "sword",
+		Tags:  []string{"a", "b", generateRandomString(40)},
+		Attrs: map[string]int64{"atk": -1, "def": 0x7fffffff + 1, "hp": 0xffff},
+		Extra: map[int64]float32{1: 0.5, 3: 2},
+	}
+	nums := []int64{0, 1, 255, 256, 0xffff, 0x10000, -1, -0x80000000, 0x7fffffff, 1 << 40, -1 << 40}
+	array := make([]int, 40)
+	for i := range array {
+		array[i] = i
+	}
+	if out, err = mc.MarshalMulti(item, nums, true, nil, 3.5, array); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		item2  Item
+		nums2  []int64
+		b2     bool
+		nil2   *Item
+		real2  float64
+		array2 []int
+		miss   = "miss"
+	)
+	if err = mc.UnmarshalMulti(out, &item2, &nums2, &b2, &nil2, &real2, &array2, &miss); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(item, item2) || !reflect.DeepEqual(nums, nums2) || !b2 || nil2 != nil ||
+		real2 != 3.5 || !reflect.DeepEqual(array, array2) || miss != "" {
+		t.Fatalf("luaseri multi values not equal: %v %v %v %v %v %v %q", item2, nums2, b2, nil2, real2, array2, miss)
+	}
+
+	// decode as generic lua values
+	var values [3]any
+	if err = mc.UnmarshalMulti(out, &values[0], &values[1], &values[2]); err != nil {
+		t.Fatal(err)
+	}
+	generic := values[0].(map[string]any)
+	if generic["id"] != int64(10001) || generic["tags"].([]any)[1] != "b" || values[1].([]any)[10] != int64(-1<<40) || values[2] != true {
+		t.Fatalf("luaseri generic values: %v", values)
+	}
+
+	// lua 5.3 integral real number is acceptable for integer
+	if out, err = pc.Marshal(2.0); err != nil {
+		t.Fatal(err)
+	}
+	var n int8
+	if err = pc.Unmarshal(out, &n); err != nil || n != 2 {
+		t.Fatalf("luaseri real to integer: %d %v", n, err)
+	}
+	if out, err = pc.Marshal(300); err != nil {
+		t.Fatal(err)
+	}
+	if err = pc.Unmarshal(out, &n); err == nil {
+		t.Fatal("luaseri integer overflow not detected")
+	}
+
+	// corrupted stream
+	if out, err = pc.Marshal(item); err != nil {
+		t.Fatal(err)
+	}
+	if err = pc.Unmarshal(out[:len(out)-3], &item2); err == nil {
+		t.Fatal("luaseri truncated stream not detected")
+	}
+	if !pc.IsNull(nil) || !pc.IsNull([]byte{0}) || pc.IsNull(out) {
+		t.Fatal("luaseri IsNull")
+	}
+}
+
+func TestSproto(t *testing.T) {
+	type Person struct {
+		Name     string    `sproto:"name"`
+		Age      int       `sproto:"age"`
+		Marital  *bool     `sproto:"marital"`
+		Children []*Person `sproto:"children"`
+	}
+	type Data struct {
+		Numbers   []int64   `sproto:"numbers"`
+		Bools     []bool    `sproto:"bools"`
+		Number    *int32    `sproto:"number"`
+		BigNumber *int64    `sproto:"bignumber"`
+		Double    *float64  `sproto:"double"`
+		Doubles   []float64 `sproto:"doubles"`
+		Fpn       *float64  `sproto:"fpn"`
+	}
+	type Book struct {
+		Persons map[string]*Person `sproto:"persons"`
+		Scores  map[int64]string   `sproto:"scores"`
+		Raw     []byte             `sproto:"raw"`
+	}
+	schema, err := payloadcodec.ParseSproto(`
+# examples of sproto README
+.Person {
+	name 0 : string
+	age 1 : integer
+	marital 2 : boolean
+	children 3 : *Person
+}
+.Data {
+	numbers 0 : *integer
+	bools 1 : *boolean
+	number 2 : integer
+	bignumber 3 : integer
+	double 4 : double
+	doubles 5 : *double
+	fpn 6 : integer(2)
+}
+.Book {
+	.Score {
+		id 0 : integer
+		name 1 : string
+	}
+	persons 0 : *Person(name)
+	scores 1 : *Score()
+	raw 2 : binary
+}
+get 1 {
+	request { name 0 : string }
+	response Person
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schema.Protocols) != 1 || schema.Protocols[0].Request != "get.request" || schema.Protocols[0].Response != "Person" {
+		t.Fatalf("sproto protocols: %v", schema.Protocols)
+	}
+	sp := payloadcodec.NewSproto(schema)
+	PutPayloadCode("sproto", sp)
+	defer delete(payloadCodecs, "sproto")
+
+	f := false
+	n32, n64 := int32(100000), int64(-10000000000)
+	d, fpn := 0.01171875, 1.82
+	hex := func(s string) []byte {
+		var b []byte
+		for _, x := range strings.Fields(s) {
+			var c byte
+			fmt.Sscanf(x, "%x", &c)
+			b = append(b, c)
+		}
+		return b
+	}
+	cases := []struct {
+		v    any
+		wire string
+	}{
+		{&Person{Name: "Alice", Age: 13, Marital: &f},
+			"03 00 00 00 1C 00 02 00 05 00 00 00 41 6C 69 63 65"},
+		{&Person{Name: "Bob", Age: 40, Children: []*Person{{Name: "Alice", Age: 13}, {Name: "Carol", Age: 5}}},
+			"04 00 00 00 52 00 01 00 00 00 03 00 00 00 42 6F 62 26 00 00 00 0F 00 00 00 02 00 00 00 1C 00 05 00 00 00 41 6C 69 63 65 0F 00 00 00 02 00 00 00 0C 00 05 00 00 00 43 61 72 6F 6C"},
+		{&Data{Numbers: []int64{1, 2, 3, 4, 5}},
+			"01 00 00 00 15 00 00 00 04 01 00 00 00 02 00 00 00 03 00 00 00 04 00 00 00 05 00 00 00"},
+		{&Data{Bools: []bool{false, true, false}},
+			"02 00 01 00 00 00 03 00 00 00 00 01 00"},
+		{&Data{Number: &n32, BigNumber: &n64},
+			"03 00 03 00 00 00 00 00 04 00 00 00 A0 86 01 00 08 00 00 00 00 1C F4 AB FD FF FF FF"},
+		{&Data{Double: &d, Doubles: []float64{d, 23, 4}},
+			"03 00 07 00 00 00 00 00 08 00 00 00 00 00 00 00 00 00 88 3f 19 00 00 00 08 00 00 00 00 00 00 88 3f 00 00 00 00 00 00 37 40 00 00 00 00 00 00 10 40"},
+		{&Data{Fpn: &fpn},
+			"02 00 0b 00 6e 01"},
+	}
+	for i, c := range cases {
+		out, err := sp.Marshal(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, hex(c.wire)) {
+			t.Fatalf("sproto case %d wire: % x", i, out)
+		}
+		v := reflect.New(reflect.TypeOf(c.v).Elem())
+		if err = sp.Unmarshal(out, v.Interface()); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v.Interface(), c.v) {
+			t.Fatalf("sproto case %d decode: %+v", i, v.Elem())
+		}
+	}
+
+	// main key map, two fields map and binary
+	book := Book{
+		Persons: map[string]*Person{"Alice": {Name: "Alice", Age: 13}, "Bob": {Name: "Bob", Age: 0x7fff}},
+		Scores:  map[int64]string{1: "a", -2: "b"},
+		Raw:     []byte{0, 1, 2},
+	}
+	out, err := sp.Marshal(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var book2 Book
+	if err = sp.Unmarshal(out, &book2); err != nil || !reflect.DeepEqual(book, book2) {
+		t.Fatalf("sproto map: %+v %v", book2, err)
+	}
+	var generic map[string]any
+	if err = sp.UnmarshalType("Book", out, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if generic["persons"].([]any)[1].(map[string]any)["age"] != int64(0x7fff) || generic["scores"].(map[any]any)[int64(-2)] != "b" {
+		t.Fatalf("sproto generic: %v", generic)
+	}
+	if err = sp.Unmarshal(out[:len(out)-1], &book2); err == nil {
+		t.Fatal("sproto truncated data not detected")
+	}
+	if _, err = sp.Marshal(struct{ Foo int }{}); err == nil {
+		t.Fatal("sproto unknown type not detected")
+	}
+
+	// 0-pack examples of sproto README
+	packed := &payloadcodec.Sproto{Schema: schema, Packed: true}
+	if out, err = packed.MarshalType("get.request", map[string]any{"name": strings.Repeat("\x8a", 20)}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, hex("11 01 14 ff 01 "+strings.Repeat("8a ", 16)+"0f 8a 8a 8a 8a")) {
+		t.Fatalf("sproto pack: % x", out)
+	}
+	var req struct{ Name string }
+	if err = packed.UnmarshalType("get.request", out, &req); err != nil || req.Name != strings.Repeat("\x8a", 20) {
+		t.Fatalf("sproto unpack: %q %v", req.Name, err)
+	}
+
+	// compiled bundle, encoded with the meta schema of sprotoparser
+	meta, err := payloadcodec.ParseSproto(`
+.type {
+	.field {
+		name 0 : string
+		buildin 1 : integer
+		type 2 : integer
+		tag 3 : integer
+		array 4 : boolean
+		key 5 : integer
+	}
+	name 0 : string
+	fields 1 : *field
+}
+.protocol {
+	name 0 : string
+	tag 1 : integer
+	request 2 : integer
+	response 3 : integer
+}
+.group {
+	type 0 : *type
+	protocol 1 : *protocol
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := payloadcodec.NewSproto(meta).MarshalType("group", map[string]any{
+		"type": []any{map[string]any{"name": "Person", "fields": []any{
+			map[string]any{"name": "name", "buildin": 2, "tag": 0},
+			map[string]any{"name": "age", "buildin": 0, "tag": 1},
+			map[string]any{"name": "children", "type": 0, "tag": 3, "array": true},
+		}}},
+		"protocol": []any{map[string]any{"name": "get", "tag": 1, "response": 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundleSchema, err := payloadcodec.ParseSprotoBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err = payloadcodec.NewSproto(bundleSchema).Marshal(cases[1].v); err != nil || !bytes.Equal(out, hex(cases[1].wire)) {
+		t.Fatalf("sproto bundle: % x %v", out, err)
+	}
+}
+
+func TestCompressCodec(t *testing.T) {
+	type Page struct {
+		Items []string `msgpack:"items"`
+	}
+	cc := NewCompressCodec(payloadcodec.MsgPack{}, Gzip, 256)
+	PutPayloadCode(cc.Name(), cc)
+	defer delete(payloadCodecs, cc.Name())
+	if pc, ok := GetPayloadCodec("msgpack+gzip"); !ok || pc != cc {
+		t.Fatal("compress codec not registered")
+	}
+
+	small := Page{Items: []string{"a"}}
+	out, err := cc.Marshal(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out[0] != CompressNone {
+		t.Fatalf("small payload compressed: % x", out)
+	}
+	large := Page{Items: make([]string, 1000)}
+	for i := range large.Items {
+		large.Items[i] = fmt.Sprintf("item-%d", i%10)
+	}
+	if out, err = cc.Marshal(large); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := payloadcodec.MsgPack{}.Marshal(large)
+	if out[0] != CompressGzip || len(out) >= len(raw) {
+		t.Fatalf("large payload not compressed: %d >= %d", len(out), len(raw))
+	}
+	// through skynet message args
+	args, err := PackPayload(cc, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err = UnpackPayload(cc, args); err != nil {
+		t.Fatal(err)
+	}
+	var page Page
+	if err = cc.Unmarshal(out, &page); err != nil || !reflect.DeepEqual(page, large) {
+		t.Fatalf("compress decode: %v", err)
+	}
+
+	// any registered compressor is accepted
+	for _, compressor := range []Compressor{Deflate, Snappy, Zstd} {
+		compressed, err := NewCompressCodec(payloadcodec.MsgPack{}, compressor, 1).Marshal(large)
+		if err != nil || compressed[0] != compressor.ID() {
+			t.Fatalf("%s: %v", compressor.Name(), err)
+		}
+		page = Page{}
+		if err = cc.Unmarshal(compressed, &page); err != nil || !reflect.DeepEqual(page, large) {
+			t.Fatalf("%s decode: %v", compressor.Name(), err)
+		}
+	}
+	if err = cc.Unmarshal([]byte{9, 1, 2}, &page); err == nil {
+		t.Fatal("unknown compressor not detected")
+	}
+
+	// threshold 0 compress every payload, negative is the default
+	if out, err = NewCompressCodec(payloadcodec.MsgPack{}, Snappy, 0).Marshal(strings.Repeat("a", 100)); err != nil || out[0] != CompressSnappy {
+		t.Fatalf("threshold 0 not compressed: % x %v", out, err)
+	}
+	if NewCompressCodec(payloadcodec.MsgPack{}, Snappy, 0).Threshold != 0 || NewCompressCodec(payloadcodec.MsgPack{}, Snappy, -1).Threshold != DefaultCompressThreshold {
+		t.Fatal("compress threshold")
+	}
+
+	// decompression bomb
+	zeros := make([]byte, 1<<20)
+	for _, compressor := range []Compressor{Gzip, Snappy, Zstd} {
+		bomb := NewCompressCodec(payloadcodec.Text{}, compressor, 1)
+		if out, err = bomb.Marshal(&zeros); err != nil {
+			t.Fatal(err)
+		}
+		bomb.MaxSize = 1024
+		var text []byte
+		if err = bomb.Unmarshal(out, &text); !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("%s decompression bomb: %v", compressor.Name(), err)
+		}
+	}
+
+	if !cc.IsNull(nil) || !cc.IsNull([]byte{CompressNone}) || cc.IsNull([]byte{CompressNone, 0xc0}) {
+		t.Fatal("compress IsNull")
+	}
+}
+
+func TestSealCodec(t *testing.T) {
+	type Args struct {
+		Key string `msgpack:"key"`
+	}
+	keys, err := NewKeyring(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewKeyring(1, []byte("short")); err == nil {
+		t.Fatal("short key not detected")
+	}
+	for _, mode := range []SealMode{SealAESGCM, SealHMAC} {
+		sc := NewSealCodec(payloadcodec.MsgPack{}, mode, keys)
+		out, err := sc.Marshal(Args{Key: "foo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode == SealAESGCM && bytes.Contains(out, []byte("foo")) {
+			t.Fatal("aesgcm payload not encrypted")
+		}
+		var v Args
+		if err = sc.Unmarshal(out, &v); err != nil || v.Key != "foo" {
+			t.Fatalf("%s: %v %v", mode, v, err)
+		}
+
+		// tampered payload and header
+		for _, i := range []int{0, 4, len(out) - 1} {
+			tampered := bytes.Clone(out)
+			tampered[i] ^= 1
+			if err = sc.Unmarshal(tampered, &v); !errors.Is(err, ErrVerifyFailed) {
+				t.Fatalf("%s: tampered byte %d: %v", mode, i, err)
+			}
+		}
+		if err = sc.Unmarshal(out[:3], &v); !errors.Is(err, ErrVerifyFailed) {
+			t.Fatalf("%s: truncated: %v", mode, err)
+		}
+
+		// empty payload is not null, sealed null is
+		if sc.IsNull(nil) || !errors.Is(sc.Verify(nil), ErrVerifyFailed) || !errors.Is(sc.Unmarshal(nil, &v), ErrVerifyFailed) {
+			t.Fatalf("%s: empty payload accepted", mode)
+		}
+		null, err := sc.SealNull()
+		if err != nil || !sc.IsNull(null) || sc.Verify(null) != nil || sc.IsNull(out) {
+			t.Fatalf("%s: sealed null: %v", mode, err)
+		}
+		null[len(null)-1] ^= 1
+		if sc.IsNull(null) {
+			t.Fatalf("%s: forged null accepted", mode)
+		}
+		cc := NewCompressCodec(sc, Gzip, 0)
+		if cc.IsNull(nil) || !errors.Is(cc.Verify(nil), ErrVerifyFailed) {
+			t.Fatalf("%s: compressed empty payload accepted", mode)
+		}
+		if null, err = cc.SealNull(); err != nil || !cc.IsNull(null) || cc.Verify(null) != nil {
+			t.Fatalf("%s: compressed sealed null: %v", mode, err)
+		}
+	}
+
+	// rotation: old key still opens, unknown key is rejected
+	sc := NewSealCodec(payloadcodec.MsgPack{}, SealAESGCM, keys)
+	old, _ := sc.Marshal(Args{Key: "old"})
+	if err = keys.Add(2, bytes.Repeat([]byte{2}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if err = keys.Use(2); err != nil {
+		t.Fatal(err)
+	}
+	if err = keys.Remove(2); err == nil {
+		t.Fatal("current key removed")
+	}
+	out, _ := sc.Marshal(Args{Key: "new"})
+	if binary.BigEndian.Uint32(out[1:]) != 2 {
+		t.Fatalf("not sealed with key 2: % x", out[:5])
+	}
+	var v Args
+	if err = sc.Unmarshal(old, &v); err != nil || v.Key != "old" {
+		t.Fatalf("old key: %v %v", v, err)
+	}
+	if err = keys.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.Unmarshal(old, &v); !errors.Is(err, ErrVerifyFailed) {
+		t.Fatalf("removed key: %v", err)
+	}
+	if err = NewSealCodec(payloadcodec.MsgPack{}, SealHMAC, keys).Unmarshal(out, &v); !errors.Is(err, ErrVerifyFailed) {
+		t.Fatalf("mode mismatch: %v", err)
+	}
+}
+
+func TestLuaCompat(t *testing.T) {
+	type Pos struct {
+		X int `json:"x" msgpack:"x"`
+	}
+	type Role struct {
+		Items  []int            `json:"items" msgpack:"items"`
+		Counts map[string]int   `json:"counts" msgpack:"counts"`
+		Ids    []int64          `json:"ids" msgpack:"ids"`
+		Level  int              `json:"level" msgpack:"level"`
+		Names  map[int]string   `json:"names" msgpack:"names"`
+		Pos    Pos              `json:"pos" msgpack:"pos"`
+		Attrs  map[string]int64 `json:"attrs" msgpack:"attrs"`
+		Extra  any              `json:"extra" msgpack:"extra"`
+		At     time.Time        `json:"at" msgpack:"at"`
+	}
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expect := Role{
+		Items:  []int{},
+		Counts: map[string]int{},
+		Ids:    []int64{10, 20},
+		Level:  3,
+		Names:  map[int]string{1: "a", 5: "b"},
+		Attrs:  map[string]int64{"1": 7},
+		Extra:  []any{int64(1), "x"},
+		At:     at,
+	}
+
+	// cjson: {} as object, sparse array as object with string keys, 3.0 as real
+	data := []byte(`{"items":{},"counts":[],"ids":{"2":20.0,"1":10},"level":3.0,"names":{"1":"a","5":"b"},
+		"pos":[],"attrs":[7],"extra":{"1":1,"2":"x"},"at":"2024-01-02T03:04:05Z"}`)
+	var role Role
+	if err := (payloadcodec.Json{}).Unmarshal(data, &role); err == nil {
+		t.Fatal("json strict mode accept lua table")
+	}
+	role = Role{}
+	if err := (payloadcodec.Json{LuaCompat: true}).Unmarshal(data, &role); err != nil || !reflect.DeepEqual(role, expect) {
+		t.Fatalf("json lua compat: %+v %v", role, err)
+	}
+
+	// lua cmsgpack: integer keys, {} as empty array
+	data, err := msgpack.Marshal(map[string]any{
+		"items":  map[string]any{},
+		"counts": []any{},
+		"ids":    map[int64]any{2: 20.0, 1: 10},
+		"level":  3.0,
+		"names":  map[int64]string{1: "a", 5: "b"},
+		"pos":    []any{},
+		"attrs":  map[int64]int{1: 7},
+		"extra":  map[int64]any{1: 1, 2: "x"},
+		"at":     at,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	role = Role{}
+	if err = (payloadcodec.MsgPack{}).Unmarshal(data, &role); err == nil {
+		t.Fatal("msgpack strict mode accept lua table")
+	}
+	role = Role{}
+	err = (payloadcodec.MsgPack{LuaCompat: true}).Unmarshal(data, &role)
+	role.At = role.At.UTC() // msgpack decode time as local
+	if err != nil || !reflect.DeepEqual(role, expect) {
+		t.Fatalf("msgpack lua compat: %+v %v", role, err)
+	}
+
+	var n int8
+	if err = (payloadcodec.MsgPack{LuaCompat: true}).Unmarshal([]byte{0xcb, 0x40, 0x09, 0x21, 0xfb, 0x54, 0x44, 0x2d, 0x18}, &n); err == nil {
+		t.Fatal("msgpack lua compat accept non integral real")
+	}
+	var ids []int
+	if err = (payloadcodec.Json{LuaCompat: true}).Unmarshal([]byte(`{"1":1,"3":3}`), &ids); err == nil {
+		t.Fatal("json lua compat accept sparse array")
+	}
+}
+
+func TestPackPayload(t *testing.T) {
+	for _, name := range []string{"msgpack", "luaseri"} {
+		pc, _ := GetPayloadCodec(name)
+		raw, err := pc.Marshal(map[string]string{"key": "foo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := PackPayload(pc, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := UnpackPayload(pc, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, raw) {
+			t.Fatalf("%s pack payload not equal", name)
+		}
+	}
+}
+
+// readPackages split skynet cluster packages. header(2) BigEndian size
+func readPackages(t *testing.T, buf *netpoll.LinkBuffer) []netpoll.Reader {
+	if err := buf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var pkgs []netpoll.Reader
+	for buf.Len() > 0 {
+		header, err := buf.ReadBinary(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkg, err := buf.Slice(int(binary.BigEndian.Uint16(header)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
+
+func TestTraceReq(t *testing.T) {
+	payload, _ := PackPayload(payloadcodec.Text{}, []byte("foobar"))
+	req := &ReqPack{Addr: Addr{Name: "@sdb"}, Session: 1, Method: "GET", Payload: payload, Trace: "(go-db-1):0100000a-1"}
+	buf := netpoll.NewLinkBuffer()
+	if err := EncodeReq(buf, req); err != nil {
+		t.Fatal(err)
+	}
+	pkgs := readPackages(t, buf)
+	if len(pkgs) != 2 {
+		t.Fatalf("expect trace and request package, got %d", len(pkgs))
+	}
+	pending := map[uint32]*ReqPack{}
+	trace, err := DecodeReq(pkgs[0], pending)
+	if err != nil || !trace.IsTrace() || trace.Trace != req.Trace {
+		t.Fatalf("decode trace %v err=%v", trace, err)
+	}
+	req2, err := DecodeReq(pkgs[1], pending)
+	if err != nil || req2.IsTrace() || req2.Method != req.Method || !bytes.Equal(req2.Payload, payload) {
+		t.Fatalf("decode req %v err=%v", req2, err)
+	}
+}
+
+func TestRemoteError(t *testing.T) {
+	luaErr := "./service/guild.lua:12: srpcerr:404:guild not found\nstack traceback:\n\t[C]: in function 'error'\n\t./service/guild.lua:12: in function 'join'"
+	e := ParseError([]byte(luaErr))
+	if e.Code != 404 || e.Message != "guild not found" || !strings.HasPrefix(e.Traceback, "stack traceback:") {
+		t.Fatalf("parse lua error %+v", e)
+	}
+	e = ParseError([]byte("./service/db.lua:3: attempt to index a nil value"))
+	if e.Code != 0 || e.Message != "./service/db.lua:3: attempt to index a nil value" || e.Traceback != "" {
+		t.Fatalf("parse plain error %+v", e)
+	}
+
+	// round trip coded error
+	e = ParseError(EncodeError(fmt.Errorf("join: %w", NewError(403, "forbidden"))))
+	if e.Code != 403 || e.Message != "join: code=403 forbidden" || ErrorCode(e) != 403 {
+		t.Fatalf("coded error %+v", e)
+	}
+
+	// error response truncated to one package with mark
+	writer := netpoll.NewLinkBuffer()
+	long := strings.Repeat("中", PartSize)
+	if err := WriteResp(writer, &RespPack{Session: 1, Payload: EncodeError(errors.New(long))}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ReadResp(readPackages(t, writer)[0], map[uint32]*RespPack{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Ok || len(resp.Payload) > PartSize || !utf8.Valid(resp.Payload) || !strings.HasSuffix(string(resp.Payload), "...(truncated)") {
+		t.Fatalf("truncated error len=%d", len(resp.Payload))
+	}
+}
+
+func TestLimits(t *testing.T) {
+	newPkg := func(data ...byte) netpoll.Reader {
+		buf := netpoll.NewLinkBuffer()
+		buf.WriteBinary(data)
+		buf.Flush()
+		return buf
+	}
+	// type 1 addr(4) session(4) size(4)
+	header := func(session uint32, size uint32) netpoll.Reader {
+		data := []byte{1, 0, 0, 0, 1}
+		data = binary.LittleEndian.AppendUint32(data, session)
+		data = binary.LittleEndian.AppendUint32(data, size)
+		return newPkg(data...)
+	}
+	limits := Limits{MaxMessageSize: 1024, MaxPending: 2, PendingTimeout: time.Minute}
+	pending := map[uint32]*ReqPack{}
+
+	// size controlled by peer
+	if _, err := DecodeReqWithLimits(header(1, 0xffffffff), pending, limits); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expect message size exceeded got %v", err)
+	}
+	for session := uint32(1); session <= 2; session++ {
+		if _, err := DecodeReqWithLimits(header(session, 16), pending, limits); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := DecodeReqWithLimits(header(3, 16), pending, limits); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expect pending exceeded got %v", err)
+	}
+
+	// part greater than declared size
+	part := binary.LittleEndian.AppendUint32([]byte{3}, 1)
+	part = append(part, make([]byte, 17)...)
+	if _, err := DecodeReqWithLimits(newPkg(part...), pending, limits); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expect declared size exceeded got %v", err)
+	}
+	if _, ok := pending[1]; ok {
+		t.Fatal("violated request should be discarded")
+	}
+
+	// partial request timeout
+	if expired := ExpirePendingReq(pending, time.Minute); len(expired) != 0 {
+		t.Fatalf("unexpected expired %d", len(expired))
+	}
+	pending[2].begin = time.Now().Add(-2 * time.Minute)
+	if expired := ExpirePendingReq(pending, time.Minute); len(expired) != 1 || expired[0].Session != 2 || len(pending) != 0 {
+		t.Fatalf("expect session 2 expired got %v", expired)
+	}
+
+	// response multi begin
+	begin := binary.LittleEndian.AppendUint32(nil, 1)
+	begin = append(begin, 2)
+	begin = binary.LittleEndian.AppendUint32(begin, 0xffffffff)
+	if _, err := ReadRespWithLimits(newPkg(begin...), map[uint32]*RespPack{}, limits); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expect response size exceeded got %v", err)
+	}
+
+	// final part of short or overlong message. a middle part is lost or the final part is longer
+	payload := make([]byte, 3*PartSize)
+	parts := func(encode func(buf *netpoll.LinkBuffer) error, overlong bool) []netpoll.Reader {
+		buf := netpoll.NewLinkBuffer()
+		if err := encode(buf); err != nil {
+			t.Fatal(err)
+		}
+		pkgs := readPackages(t, buf)
+		n := len(pkgs)
+		if !overlong {
+			return append(pkgs[:n-2:n-2], pkgs[n-1])
+		}
+		final, _ := pkgs[n-1].ReadBinary(pkgs[n-1].Len())
+		pkgs[n-1] = newPkg(append(final, 0)...)
+		return pkgs
+	}
+	encodeReq := func(buf *netpoll.LinkBuffer) error {
+		return EncodeReq(buf, &ReqPack{Addr: Addr{Id: 10}, Session: 9, Method: "SET", Payload: payload})
+	}
+	for _, overlong := range []bool{false, true} {
+		pending := map[uint32]*ReqPack{}
+		var err error
+		for _, pkg := range parts(encodeReq, overlong) {
+			if _, err = DecodeReq(pkg, pending); err != nil {
+				break
+			}
+		}
+		if err == nil || len(pending) != 0 || overlong != errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("request final part overlong=%v: %v", overlong, err)
+		}
+	}
+	encodeResp := func(buf *netpoll.LinkBuffer) error {
+		return WriteResp(buf, &RespPack{Session: 9, Ok: true, Payload: payload})
+	}
+	for _, overlong := range []bool{false, true} {
+		pending := map[uint32]*RespPack{}
+		var err error
+		for _, pkg := range parts(encodeResp, overlong) {
+			if _, err = ReadResp(pkg, pending); err != nil {
+				break
+			}
+		}
+		if err == nil || len(pending) != 0 || overlong != errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("response final part overlong=%v: %v", overlong, err)
+		}
+	}
+}
+
+func TestLargeMessage(t *testing.T) {
+	payload := make([]byte, 3*1024*1024+123)
+	rand.Read(payload)
+
+	// request: method + payload cross parts
+	for _, addr := range []Addr{{Id: 10}, {Name: "@sdb"}} {
+		req := &ReqPack{Addr: addr, Session: 7, Method: "SET", Payload: payload}
+		buf := netpoll.NewLinkBuffer()
+		if err := EncodeReq(buf, req); err != nil {
+			t.Fatal(err)
+		}
+		pending := map[uint32]*ReqPack{}
+		var got *ReqPack
+		for _, pkg := range readPackages(t, buf) {
+			msg, err := DecodeReq(pkg, pending)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg != nil {
+				got = msg
+			}
+		}
+		if got == nil || got.Method != "SET" || got.Addr != addr || got.Session != 7 || !bytes.Equal(got.Payload, payload) || len(pending) != 0 {
+			t.Fatalf("large request %s round trip failed", addr.String())
+		}
+	}
+
+	// response
+	buf := netpoll.NewLinkBuffer()
+	if err := WriteResp(buf, &RespPack{Session: 7, Ok: true, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	pending := map[uint32]*RespPack{}
+	var got *RespPack
+	for _, pkg := range readPackages(t, buf) {
+		msg, err := ReadResp(pkg, pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != nil {
+			got = msg
+		}
+	}
+	if got == nil || !got.Ok || got.Session != 7 || !bytes.Equal(got.Payload, payload) || len(pending) != 0 {
+		t.Fatal("large response round trip failed")
+	}
 }
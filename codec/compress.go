@@ -0,0 +1,353 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compression algorithm of CompressCodec. ID is the header byte of compressed payload.
+// Implement it and RegisterCompressor to plug other algorithms.
+type Compressor interface {
+	ID() byte
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	// Decompress must fail if the result is larger than maxSize (unlimited if <= 0)
+	Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+// compressor ids. 0 is raw payload
+const (
+	CompressNone    byte = 0
+	CompressGzip    byte = 1
+	CompressDeflate byte = 2
+	CompressSnappy  byte = 3 // snappy block format
+	CompressZstd    byte = 4
+)
+
+// DefaultCompressThreshold payload smaller than it is sent raw
+const DefaultCompressThreshold = 1024
+
+var (
+	Gzip    = NewGzipCompressor(gzip.DefaultCompression)
+	Deflate = NewDeflateCompressor(flate.DefaultCompression)
+	Snappy  = NewSnappyCompressor()
+	Zstd    = NewZstdCompressor(3)
+)
+
+var compressors = map[byte]Compressor{
+	CompressGzip:    Gzip,
+	CompressDeflate: Deflate,
+	CompressSnappy:  Snappy,
+	CompressZstd:    Zstd,
+}
+
+// RegisterCompressor compressors used to decompress payload by header id. Must be called before serving
+func RegisterCompressor(c Compressor) {
+	compressors[c.ID()] = c
+}
+
+/*
+CompressCodec wraps a payload codec and compresses the payload not smaller than Threshold.
+Payload is prefixed with one byte header: 0 raw, otherwise id of the compressor. Payload of any
+registered compressor can be decoded. Empty payload (null) is sent as is.
+
+It's not a MultiPayloadCodec even if the inner codec is, payload is sent as one lua string.
+
+	codec.PutPayloadCode("msgpack+zstd", codec.NewCompressCodec(payloadcodec.MsgPack{}, codec.Zstd, codec.DefaultCompressThreshold))
+*/
+type CompressCodec struct {
+	Codec      PayloadCodec
+	Compressor Compressor
+	Threshold  int
+	MaxSize    int // max decompressed size. default DefaultLimits.MaxMessageSize
+}
+
+// NewCompressCodec threshold 0 compress every payload, negative use DefaultCompressThreshold
+func NewCompressCodec(inner PayloadCodec, compressor Compressor, threshold int) *CompressCodec {
+	if threshold < 0 {
+		threshold = DefaultCompressThreshold
+	}
+	return &CompressCodec{
+		Codec:      inner,
+		Compressor: compressor,
+		Threshold:  threshold,
+		MaxSize:    DefaultLimits.MaxMessageSize,
+	}
+}
+
+func (c *CompressCodec) Marshal(v any) ([]byte, error) {
+	data, err := c.Codec.Marshal(v)
+	if err != nil || len(data) == 0 {
+		return data, err
+	}
+	if len(data) >= c.Threshold {
+		compressed, err := c.Compressor.Compress(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s compress: %w", c.Compressor.Name(), err)
+		}
+		// not worth it
+		if len(compressed) < len(data) {
+			return append([]byte{c.Compressor.ID()}, compressed...), nil
+		}
+	}
+	return append([]byte{CompressNone}, data...), nil
+}
+
+func (c *CompressCodec) Unmarshal(data []byte, v any) error {
+	data, err := c.decompress(data)
+	if err != nil {
+		return err
+	}
+	return c.Codec.Unmarshal(data, v)
+}
+
+func (c *CompressCodec) decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	id := data[0]
+	if id == CompressNone {
+		return data[1:], nil
+	}
+	compressor := c.Compressor
+	if compressor.ID() != id {
+		var ok bool
+		if compressor, ok = compressors[id]; !ok {
+			return nil, fmt.Errorf("unknown compressor id %d", id)
+		}
+	}
+	out, err := compressor.Decompress(data[1:], c.MaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s decompress: %w", compressor.Name(), err)
+	}
+	return out, nil
+}
+
+// IsNull empty payload is not null if the inner codec is sealed
+func (c *CompressCodec) IsNull(data []byte) bool {
+	if len(data) == 0 {
+		_, sealed := c.Codec.(SealedPayloadCodec)
+		return !sealed
+	}
+	return data[0] == CompressNone && c.Codec.IsNull(data[1:])
+}
+
+// SealNull sealed null of the inner SealedPayloadCodec. nil if the inner codec is not sealed
+func (c *CompressCodec) SealNull() ([]byte, error) {
+	sc, ok := c.Codec.(SealedPayloadCodec)
+	if !ok {
+		return nil, nil
+	}
+	data, err := sc.SealNull()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{CompressNone}, data...), nil
+}
+
+// Verify by the inner SealedPayloadCodec. always ok if the inner codec is not sealed
+func (c *CompressCodec) Verify(data []byte) error {
+	sc, ok := c.Codec.(SealedPayloadCodec)
+	if !ok {
+		return nil
+	}
+	data, err := c.decompress(data)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrVerifyFailed, err.Error())
+	}
+	return sc.Verify(data)
+}
+
+func (c *CompressCodec) Name() string {
+	return c.Codec.Name() + "+" + c.Compressor.Name()
+}
+
+// readLimited read all of r, fail if more than maxSize
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(r)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxSize {
+		return nil, fmt.Errorf("%w: decompressed size > %d", ErrLimitExceeded, maxSize)
+	}
+	return out, nil
+}
+
+type gzipCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewGzipCompressor compress/gzip of level
+func NewGzipCompressor(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+func (c *gzipCompressor) ID() byte     { return CompressGzip }
+func (c *gzipCompressor) Name() string { return "gzip" }
+
+func (c *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, _ := c.writers.Get().(*gzip.Writer)
+	if w == nil {
+		var err error
+		if w, err = gzip.NewWriterLevel(buf, c.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+type deflateCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewDeflateCompressor compress/flate (raw deflate) of level
+func NewDeflateCompressor(level int) Compressor {
+	return &deflateCompressor{level: level}
+}
+
+func (c *deflateCompressor) ID() byte     { return CompressDeflate }
+func (c *deflateCompressor) Name() string { return "deflate" }
+
+func (c *deflateCompressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(buf, c.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *deflateCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+type snappyCompressor struct{}
+
+// NewSnappyCompressor snappy block format (github.com/golang/snappy). Fast with lower ratio
+func NewSnappyCompressor() Compressor {
+	return snappyCompressor{}
+}
+
+func (c snappyCompressor) ID() byte     { return CompressSnappy }
+func (c snappyCompressor) Name() string { return "snappy" }
+
+func (c snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (c snappyCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && n > maxSize {
+		return nil, fmt.Errorf("%w: decompressed size > %d", ErrLimitExceeded, maxSize)
+	}
+	return snappy.Decode(nil, data)
+}
+
+type zstdCompressor struct {
+	level    int
+	once     sync.Once
+	encoder  *zstd.Encoder
+	err      error
+	decoders sync.Map // max size -> *zstd.Decoder
+}
+
+// NewZstdCompressor zstd (github.com/klauspost/compress/zstd) of level like zstd command line. eg: 1 fastest, 3 default
+func NewZstdCompressor(level int) Compressor {
+	return &zstdCompressor{level: level}
+}
+
+func (c *zstdCompressor) ID() byte     { return CompressZstd }
+func (c *zstdCompressor) Name() string { return "zstd" }
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)),
+			zstd.WithEncoderConcurrency(1))
+	})
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+// decoder of max decoded size. It's safe for concurrent DecodeAll
+func (c *zstdCompressor) decoder(maxSize int) (*zstd.Decoder, error) {
+	if d, ok := c.decoders.Load(maxSize); ok {
+		return d.(*zstd.Decoder), nil
+	}
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(0)}
+	if maxSize > 0 {
+		opts = append(opts, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	}
+	d, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if actual, loaded := c.decoders.LoadOrStore(maxSize, d); loaded {
+		d.Close()
+		return actual.(*zstd.Decoder), nil
+	}
+	return d, nil
+}
+
+func (c *zstdCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	d, err := c.decoder(maxSize)
+	if err != nil {
+		return nil, err
+	}
+	out, err := d.DecodeAll(data, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, fmt.Errorf("%w: decompressed size > %d", ErrLimitExceeded, maxSize)
+	}
+	return out, err
+}
@@ -0,0 +1,115 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+RemoteError error response of skynet cluster call.
+
+Coded errors are sent as "srpcerr:<code>:<message>". libsrpc.lua srpc.error(code, msg) raises it and
+srpc.parse_error(err) reads it. Other errors are plain message like lua error with stack traceback.
+*/
+type RemoteError struct {
+	Node      string // set by client
+	Service   string // set by client
+	Method    string // set by client
+	Code      int    // 0 if not coded
+	Message   string
+	Traceback string // lua stack traceback
+}
+
+const (
+	errCodePrefix      = "srpcerr:"
+	luaTracebackPrefix = "stack traceback:"
+	truncatedSuffix    = "...(truncated)"
+)
+
+// NewError coded error. Go handlers return it to reply the code
+func NewError(code int, msg string) *RemoteError {
+	return &RemoteError{Code: code, Message: msg}
+}
+
+// Errorf coded error with format message
+func Errorf(code int, format string, args ...any) *RemoteError {
+	return NewError(code, fmt.Sprintf(format, args...))
+}
+
+func (e *RemoteError) Error() string {
+	var builder strings.Builder
+	if e.Node != "" || e.Service != "" {
+		builder.WriteString(fmt.Sprintf("remote %s %s.%s: ", e.Node, e.Service, e.Method))
+	}
+	if e.Code != 0 {
+		builder.WriteString(fmt.Sprintf("code=%d ", e.Code))
+	}
+	builder.WriteString(e.Message)
+	return builder.String()
+}
+
+// ErrorCode code of RemoteError in err chain. 0 if not found
+func ErrorCode(err error) int {
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.Code
+	}
+	return 0
+}
+
+// EncodeError error response payload. It's truncated to PartSize, skynet not support multi part error
+func EncodeError(err error) []byte {
+	var msg string
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) && remoteErr.Code != 0 {
+		msg = remoteErr.Message
+		if remoteErr != err {
+			// wrapped. keep the context
+			msg = err.Error()
+		}
+		msg = errCodePrefix + strconv.Itoa(remoteErr.Code) + ":" + msg
+	} else {
+		msg = err.Error()
+	}
+	return truncateError([]byte(msg))
+}
+
+// truncateError keep the head of msg and mark it truncated
+func truncateError(msg []byte) []byte {
+	if len(msg) <= PartSize {
+		return msg
+	}
+	n := PartSize - len(truncatedSuffix)
+	// not break utf8 rune
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	data := make([]byte, 0, n+len(truncatedSuffix))
+	data = append(data, msg[:n]...)
+	return append(data, truncatedSuffix...)
+}
+
+// ParseError parse error response payload. code and lua stack traceback
+func ParseError(payload []byte) *RemoteError {
+	e := &RemoteError{Message: string(payload)}
+	if before, after, ok := strings.Cut(e.Message, "\n"+luaTracebackPrefix); ok {
+		e.Message = before
+		e.Traceback = luaTracebackPrefix + after
+	}
+	e.Message = strings.TrimSpace(e.Message)
+
+	// lua error maybe prefix with position. eg: ./service/guild.lua:12: srpcerr:404:not found
+	if i := strings.Index(e.Message, errCodePrefix); i >= 0 {
+		codeMsg := e.Message[i+len(errCodePrefix):]
+		if codeStr, msg, ok := strings.Cut(codeMsg, ":"); ok {
+			if code, err := strconv.Atoi(codeStr); err == nil {
+				e.Code = code
+				e.Message = msg
+			}
+		}
+	}
+	return e
+}
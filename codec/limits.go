@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Limits protect memory from malicious or corrupt peers. Zero value field means unlimited
+type Limits struct {
+	MaxMessageSize int           // max body size of multi part request or response
+	MaxPending     int           // max pending multi part sessions per connection
+	PendingTimeout time.Duration // partial request or response is discarded after timeout
+}
+
+// DefaultLimits used by DecodeReq and ReadResp
+var DefaultLimits = Limits{
+	MaxMessageSize: 32 * 1024 * 1024,
+	MaxPending:     1024,
+	PendingTimeout: 30 * time.Second,
+}
+
+// ErrLimitExceeded peer violate the limits. The connection should be closed
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// preallocate at most maxPrealloc bytes, the declared size is controlled by peer
+const maxPrealloc = 64 * 1024
+
+func (l Limits) checkBegin(bodyLen uint32, numPending int) error {
+	if l.MaxMessageSize > 0 && int64(bodyLen) > int64(l.MaxMessageSize) {
+		return fmt.Errorf("%w: message size %d > %d", ErrLimitExceeded, bodyLen, l.MaxMessageSize)
+	}
+	if l.MaxPending > 0 && numPending >= l.MaxPending {
+		return fmt.Errorf("%w: pending multi part sessions %d", ErrLimitExceeded, numPending)
+	}
+	return nil
+}
+
+// checkPart received size must not greater than declared size
+func checkPart(bodyLen int, received int, part int) error {
+	if received+part > bodyLen {
+		return fmt.Errorf("%w: message size %d greater than declared %d", ErrLimitExceeded, received+part, bodyLen)
+	}
+	return nil
+}
+
+// checkComplete the final part must complete the declared size, or the message is truncated
+func checkComplete(bodyLen int, received int) error {
+	if received != bodyLen {
+		return fmt.Errorf("message size %d less than declared %d", received, bodyLen)
+	}
+	return nil
+}
+
+func preallocPayload(bodyLen uint32) []byte {
+	return make([]byte, 0, min(int(bodyLen), maxPrealloc))
+}
+
+// ExpirePendingReq discard partial requests received before timeout. Returns the discarded requests
+func ExpirePendingReq(pending map[uint32]*ReqPack, timeout time.Duration) []*ReqPack {
+	if timeout <= 0 {
+		return nil
+	}
+	var expired []*ReqPack
+	deadline := time.Now().Add(-timeout)
+	for session, req := range pending {
+		if req.begin.Before(deadline) {
+			delete(pending, session)
+			expired = append(expired, req)
+		}
+	}
+	return expired
+}
+
+// ExpirePendingResp discard partial responses received before timeout. Returns the discarded responses
+func ExpirePendingResp(pending map[uint32]*RespPack, timeout time.Duration) []*RespPack {
+	if timeout <= 0 {
+		return nil
+	}
+	var expired []*RespPack
+	deadline := time.Now().Add(-timeout)
+	for session, resp := range pending {
+		if resp.begin.Before(deadline) {
+			delete(pending, session)
+			expired = append(expired, resp)
+		}
+	}
+	return expired
+}
@@ -1,11 +1,18 @@
 package codec
 
-import payloadcodec "github.com/changlongH/srpc/payload_codec"
+import (
+	"bytes"
+	"fmt"
+
+	payloadcodec "github.com/changlongH/srpc/payload_codec"
+)
 
 var payloadCodecs = map[string]PayloadCodec{
-	"json":    payloadcodec.Json{},
-	"msgpack": payloadcodec.MsgPack{},
-	"text":    payloadcodec.Text{},
+	"json":     payloadcodec.Json{},
+	"msgpack":  payloadcodec.MsgPack{},
+	"text":     payloadcodec.Text{},
+	"luaseri":  payloadcodec.LuaSeri{},
+	"protobuf": payloadcodec.Protobuf{},
 }
 
 type PayloadCodec interface {
@@ -15,6 +22,14 @@ type PayloadCodec interface {
 	Name() string
 }
 
+// MultiPayloadCodec payload is skynet lua-serialize values (eg: luaseri), it can carry multi values.
+// The payload is sent as is. Others codec payload will be wrapped as one lua string.
+type MultiPayloadCodec interface {
+	PayloadCodec
+	MarshalMulti(msgs ...any) ([]byte, error)
+	UnmarshalMulti(in []byte, msgs ...any) error
+}
+
 // default registered json/msgpack
 // GetPayloadCodec gets desired payload codec from name.
 func GetPayloadCodec(name string) (PayloadCodec, bool) {
@@ -26,3 +41,27 @@ func GetPayloadCodec(name string) (PayloadCodec, bool) {
 func PutPayloadCode(name string, v PayloadCodec) {
 	payloadCodecs[name] = v
 }
+
+// PackPayload pack codec payload into skynet message args (lua-serialize)
+func PackPayload(pc PayloadCodec, payload []byte) ([]byte, error) {
+	if _, ok := pc.(MultiPayloadCodec); ok {
+		return payload, nil
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteStringToBuf(buf, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnpackPayload unpack skynet message args (lua-serialize) into codec payload
+func UnpackPayload(pc PayloadCodec, data []byte) ([]byte, error) {
+	if _, ok := pc.(MultiPayloadCodec); ok {
+		return data, nil
+	}
+	payload, _, err := decodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w (payload codec %s need one lua string arg)", err, pc.Name())
+	}
+	return payload, nil
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cloudwego/netpoll"
 )
@@ -20,10 +22,18 @@ type (
 		Session uint32 // 8-11
 		Push    bool   // push package don't need to response
 		Method  string
-		Payload []byte
+		Payload []byte // lua-serialize args after method. see PackPayload/UnpackPayload
+		Trace   string // skynet.trace() tag. it's sent as a trace package before the request
+
+		bodyLen  int       // declared size of multi part request
+		received int       // received size of multi part request
+		begin    time.Time // receive time of multi part header
 	}
 )
 
+// MaxTraceSize skynet cluster truncate the trace tag
+const MaxTraceSize = 0x8000
+
 func (addr *Addr) String() string {
 	if addr.Id > 0 {
 		return strconv.FormatUint(uint64(addr.Id), 10)
@@ -35,6 +45,11 @@ func (req *ReqPack) IsPush() bool {
 	return req.Push
 }
 
+// IsTrace trace package only carry the trace tag of next request
+func (req *ReqPack) IsTrace() bool {
+	return len(req.Method) == 0 && len(req.Trace) > 0
+}
+
 func readReqSessionAndArgs(pkg netpoll.Reader, req *ReqPack) (err error) {
 	if req.Session, err = readSession(pkg); err != nil {
 		return
@@ -58,7 +73,7 @@ func readReqSessionAndArgs(pkg netpoll.Reader, req *ReqPack) (err error) {
 	req.Method = string(method)
 
 	if pkg.Len() > 0 {
-		if req.Payload, err = readString(pkg); err != nil {
+		if req.Payload, err = pkg.ReadBinary(pkg.Len()); err != nil {
 			return
 		}
 	}
@@ -98,7 +113,7 @@ func unpackStrAddrReq(pkg netpoll.Reader) (req *ReqPack, err error) {
 	return
 }
 
-func unpackNumberAddrPendingHeader(pkg netpoll.Reader, pending map[uint32]*ReqPack, push bool) (_req *ReqPack, err error) {
+func unpackNumberAddrPendingHeader(pkg netpoll.Reader, pending map[uint32]*ReqPack, push bool, limits Limits) (_req *ReqPack, err error) {
 	if pkg.Len() != 12 {
 		return nil, fmt.Errorf("invalid cluster message size %d (multi req must be 12)", pkg.Len())
 	}
@@ -114,13 +129,18 @@ func unpackNumberAddrPendingHeader(pkg netpoll.Reader, pending map[uint32]*ReqPa
 	if bodyLen, err = readUint32(pkg); err != nil {
 		return
 	}
+	if err = limits.checkBegin(bodyLen, len(pending)); err != nil {
+		return req, err
+	}
 	// NOTE: payload contain method
-	req.Payload = make([]byte, 0, bodyLen)
+	req.Payload = preallocPayload(bodyLen)
+	req.bodyLen = int(bodyLen)
+	req.begin = time.Now()
 	pending[req.Session] = req
 	return
 }
 
-func unpackStrAddrPendingHeader(pkg netpoll.Reader, pending map[uint32]*ReqPack, push bool) (_req *ReqPack, err error) {
+func unpackStrAddrPendingHeader(pkg netpoll.Reader, pending map[uint32]*ReqPack, push bool, limits Limits) (_req *ReqPack, err error) {
 	if pkg.Len() < 10 {
 		err = fmt.Errorf("invalid request message (size=%d)", pkg.Len())
 		return
@@ -142,12 +162,28 @@ func unpackStrAddrPendingHeader(pkg netpoll.Reader, pending map[uint32]*ReqPack,
 	if bodyLen, err = readUint32(pkg); err != nil {
 		return
 	}
+	if err = limits.checkBegin(bodyLen, len(pending)); err != nil {
+		return req, err
+	}
 	// NOTE: payload contain method
-	req.Payload = make([]byte, 0, bodyLen)
+	req.Payload = preallocPayload(bodyLen)
+	req.bodyLen = int(bodyLen)
+	req.begin = time.Now()
 	pending[req.Session] = req
 	return
 }
 
+func unpackTrace(pkg netpoll.Reader) (*ReqPack, error) {
+	if pkg.Len() <= 0 {
+		return nil, errors.New("invalid trace package size=0")
+	}
+	tag, err := pkg.ReadString(pkg.Len())
+	if err != nil {
+		return nil, err
+	}
+	return &ReqPack{Trace: tag}, nil
+}
+
 func unpackPendingPart(pkg netpoll.Reader, pending map[uint32]*ReqPack, final bool) (*ReqPack, error) {
 	if pkg.Len() < 4 {
 		return nil, fmt.Errorf("invalid request part headersz=(%d)", pkg.Len())
@@ -166,6 +202,13 @@ func unpackPendingPart(pkg netpoll.Reader, pending map[uint32]*ReqPack, final bo
 		return &ReqPack{Session: session}, err
 	}
 
+	// method is included in declared size
+	if err = checkPart(req.bodyLen, req.received, pkg.Len()); err != nil {
+		delete(pending, session)
+		return req, err
+	}
+	req.received += pkg.Len()
+
 	// read method if it's first part
 	if len(req.Payload) == 0 && len(req.Method) == 0 {
 		// rpc req must have method
@@ -184,8 +227,9 @@ func unpackPendingPart(pkg netpoll.Reader, pending map[uint32]*ReqPack, final bo
 	}
 
 	if pkg.Len() > 0 {
+		// copy once. pkg will be released
 		var payload []byte
-		if payload, err = pkg.ReadBinary(pkg.Len()); err != nil {
+		if payload, err = pkg.Next(pkg.Len()); err != nil {
 			delete(pending, session)
 			return req, err
 		}
@@ -197,11 +241,19 @@ func unpackPendingPart(pkg netpoll.Reader, pending map[uint32]*ReqPack, final bo
 	}
 
 	delete(pending, session)
-	req.Payload, _, err = decodeString(req.Payload)
-	return req, err
+	if err = checkComplete(req.bodyLen, req.received); err != nil {
+		return req, err
+	}
+	return req, nil
 }
 
+// DecodeReq decode request package with DefaultLimits. pendingPack keeps multi part requests of the connection
 func DecodeReq(pkg netpoll.Reader, pendingPack map[uint32]*ReqPack) (*ReqPack, error) {
+	return DecodeReqWithLimits(pkg, pendingPack, DefaultLimits)
+}
+
+// DecodeReqWithLimits returns error wrapped ErrLimitExceeded if peer violate the limits
+func DecodeReqWithLimits(pkg netpoll.Reader, pendingPack map[uint32]*ReqPack, limits Limits) (*ReqPack, error) {
 	defer pkg.Release()
 
 	len := pkg.Len()
@@ -219,31 +271,73 @@ func DecodeReq(pkg netpoll.Reader, pendingPack map[uint32]*ReqPack) (*ReqPack, e
 		return unpackNumberAddrReq(pkg)
 	case 1:
 		// request
-		return unpackNumberAddrPendingHeader(pkg, pendingPack, false)
+		return unpackNumberAddrPendingHeader(pkg, pendingPack, false, limits)
 	case '\x41':
 		// push
-		return unpackNumberAddrPendingHeader(pkg, pendingPack, true)
+		return unpackNumberAddrPendingHeader(pkg, pendingPack, true, limits)
 	case 2:
 		return unpackPendingPart(pkg, pendingPack, false)
 	case 3:
 		return unpackPendingPart(pkg, pendingPack, true)
 	case 4:
-		return nil, errors.New("nonsupport skynet trace")
+		// trace tag for next request
+		return unpackTrace(pkg)
 	case '\x80':
 		return unpackStrAddrReq(pkg)
 	case '\x81':
 		// request
-		return unpackStrAddrPendingHeader(pkg, pendingPack, false)
+		return unpackStrAddrPendingHeader(pkg, pendingPack, false, limits)
 	case '\xc1':
 		// push
-		return unpackStrAddrPendingHeader(pkg, pendingPack, true)
+		return unpackStrAddrPendingHeader(pkg, pendingPack, true, limits)
 	default:
 		return nil, fmt.Errorf("invalid req package type=(%d)", msgType)
 	}
 }
 
-func writeReqPack(writer netpoll.Writer, req *ReqPack, buf *bytes.Buffer) (err error) {
-	bodyLen := buf.Len()
+func writeTracePack(writer netpoll.Writer, tag string) (err error) {
+	if len(tag) > MaxTraceSize {
+		tag = tag[:MaxTraceSize]
+	}
+	// header type(1)+tag
+	if err = writeHeader(writer, uint16(len(tag)+1)); err != nil {
+		return
+	}
+	// type = 4
+	if err = writer.WriteByte(4); err != nil {
+		return
+	}
+	_, err = writer.WriteString(tag)
+	return
+}
+
+// reqBody method(lua string) + payload. It's written without concatenation
+type reqBody struct {
+	method  []byte // encoded method
+	payload []byte
+}
+
+func (body *reqBody) Len() int {
+	return len(body.method) + len(body.payload)
+}
+
+// writeRange write body[index:index+sz] into writer
+func (body *reqBody) writeRange(writer netpoll.Writer, index int, sz int) (err error) {
+	end := index + sz
+	if index < len(body.method) {
+		if _, err = writer.WriteBinary(body.method[index:min(end, len(body.method))]); err != nil {
+			return
+		}
+		index = len(body.method)
+	}
+	if index < end {
+		_, err = writer.WriteBinary(body.payload[index-len(body.method) : end-len(body.method)])
+	}
+	return
+}
+
+func writeReqPack(writer netpoll.Writer, req *ReqPack, body *reqBody) (err error) {
+	bodyLen := body.Len()
 	if req.Addr.Id > 0 {
 		// header type(1)+addr(4)+session(4)+bodyLen=9+bodyLen
 		if err = writeHeader(writer, uint16(9+bodyLen)); err != nil {
@@ -273,12 +367,14 @@ func writeReqPack(writer netpoll.Writer, req *ReqPack, buf *bytes.Buffer) (err e
 	if err = writeSession(writer, session); err != nil {
 		return
 	}
-	_, err = writer.WriteBinary(buf.Bytes())
-	return
+	return body.writeRange(writer, 0, bodyLen)
 }
 
-func writeLargeReqPack(writer netpoll.Writer, req *ReqPack, buf *bytes.Buffer) (err error) {
-	bodyLen := buf.Len()
+func writeLargeReqPack(writer netpoll.Writer, req *ReqPack, body *reqBody) (err error) {
+	bodyLen := body.Len()
+	if int64(bodyLen) > math.MaxUint32 {
+		return fmt.Errorf("request too large size=%d", bodyLen)
+	}
 	if req.Addr.Id > 0 {
 		// multi part header byte(1)+addr(4)+session(4)+msgsize(4)=13
 		if err = writeHeader(writer, uint16(13)); err != nil {
@@ -322,14 +418,10 @@ func writeLargeReqPack(writer netpoll.Writer, req *ReqPack, buf *bytes.Buffer) (
 	}
 
 	// body part
-	payload := buf.Bytes()
-	remainLen := bodyLen
-	part := (remainLen-1)/PartSize + 1
-	index := 0
-	for i := 0; i < part; i++ {
+	for index := 0; index < bodyLen; {
 		var sz int
 		var bType byte
-		if remainLen > PartSize {
+		if remainLen := bodyLen - index; remainLen > PartSize {
 			sz = PartSize
 			bType = 2 // multi part
 		} else {
@@ -348,11 +440,10 @@ func writeLargeReqPack(writer netpoll.Writer, req *ReqPack, buf *bytes.Buffer) (
 		if err = writeSession(writer, req.Session); err != nil {
 			return
 		}
-		if _, err = writer.WriteBinary(payload[index : index+sz]); err != nil {
+		if err = body.writeRange(writer, index, sz); err != nil {
 			return
 		}
-		index = sz
-		remainLen = remainLen - sz
+		index += sz
 	}
 	return
 }
@@ -363,14 +454,21 @@ func EncodeReq(writer netpoll.Writer, req *ReqPack) (err error) {
 		return
 	}
 
+	if len(req.Trace) > 0 {
+		if err = writeTracePack(writer, req.Trace); err != nil {
+			return
+		}
+	}
+
 	buf := &bytes.Buffer{}
-	if err = writeStringsToBuf(buf, []byte(req.Method), req.Payload); err != nil {
+	if err = WriteStringToBuf(buf, []byte(req.Method)); err != nil {
 		return
 	}
-	if buf.Len() < PartSize {
-		return writeReqPack(writer, req, buf)
+	body := &reqBody{method: buf.Bytes(), payload: req.Payload}
+	if body.Len() < PartSize {
+		return writeReqPack(writer, req, body)
 	} else {
-		return writeLargeReqPack(writer, req, buf)
+		return writeLargeReqPack(writer, req, body)
 	}
 }
 
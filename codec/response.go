@@ -3,6 +3,8 @@ package codec
 import (
 	"errors"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/cloudwego/netpoll"
 )
@@ -21,7 +23,10 @@ type (
 	RespPack struct {
 		Ok      bool   // msg pack/unpack
 		Session uint32 // DWORD
-		Payload []byte // 0: errmsg  1: msg  2: DWORD size   3/4: msg
+		Payload []byte // 0: errmsg  1: msg(lua-serialize)  2: DWORD size   3/4: msg
+
+		bodyLen int       // declared size of multi part response
+		begin   time.Time // receive time of multi part begin
 	}
 )
 
@@ -34,11 +39,9 @@ func WriteResp(writer netpoll.Writer, msg *RespPack) (err error) {
 	sz := len(data)
 	bType := RespTypeOk
 	if !msg.Ok {
-		// truncate the error msg if too long
-		if sz > PartSize {
-			sz = PartSize
-			data = data[:sz]
-		}
+		// skynet not support multi part error. truncate the error msg if too long
+		data = truncateError(data)
+		sz = len(data)
 		bType = RespTypeErr
 	}
 
@@ -57,6 +60,9 @@ func WriteResp(writer netpoll.Writer, msg *RespPack) (err error) {
 			return
 		}
 	} else {
+		if int64(sz) > math.MaxUint32 {
+			return fmt.Errorf("response too large size=%d", sz)
+		}
 		// multi part header session(4)+byte(1)+msgsize(4)=9
 		if err = writeHeader(writer, 9); err != nil {
 			return
@@ -98,7 +104,7 @@ func WriteResp(writer netpoll.Writer, msg *RespPack) (err error) {
 			if _, err = writer.WriteBinary(data[index : index+s]); err != nil {
 				return
 			}
-			index = s
+			index += s
 			sz = sz - s
 		}
 	}
@@ -106,7 +112,13 @@ func WriteResp(writer netpoll.Writer, msg *RespPack) (err error) {
 	return
 }
 
+// ReadResp read response package with DefaultLimits. pendingResp keeps multi part responses of the connection
 func ReadResp(pkg netpoll.Reader, pendingResp map[uint32]*RespPack) (resp *RespPack, err error) {
+	return ReadRespWithLimits(pkg, pendingResp, DefaultLimits)
+}
+
+// ReadRespWithLimits returns error wrapped ErrLimitExceeded if peer violate the limits
+func ReadRespWithLimits(pkg netpoll.Reader, pendingResp map[uint32]*RespPack, limits Limits) (resp *RespPack, err error) {
 	defer pkg.Release()
 	headersz := 5
 	sz := pkg.Len()
@@ -137,7 +149,7 @@ func ReadResp(pkg netpoll.Reader, pendingResp map[uint32]*RespPack) (resp *RespP
 		}
 		return
 	case 1: // ok
-		if payload, err = readString(pkg); err != nil {
+		if payload, err = pkg.ReadBinary(pkg.Len()); err != nil {
 			return
 		}
 		resp = &RespPack{
@@ -147,7 +159,8 @@ func ReadResp(pkg netpoll.Reader, pendingResp map[uint32]*RespPack) (resp *RespP
 		}
 		return
 	case 4: // multi end
-		if payload, err = pkg.ReadBinary(sz - headersz); err != nil {
+		// copy once when append. pkg will be released
+		if payload, err = pkg.Next(sz - headersz); err != nil {
 			return
 		}
 		var ok bool
@@ -156,28 +169,43 @@ func ReadResp(pkg netpoll.Reader, pendingResp map[uint32]*RespPack) (resp *RespP
 			return
 		}
 		delete(pendingResp, session)
-		payload = append(resp.Payload, payload...)
-		resp.Payload, _, err = decodeString(payload)
+		if err = checkPart(resp.bodyLen, len(resp.Payload), len(payload)); err != nil {
+			return nil, err
+		}
+		if err = checkComplete(resp.bodyLen, len(resp.Payload)+len(payload)); err != nil {
+			return nil, err
+		}
+		resp.Payload = append(resp.Payload, payload...)
 		return
 	case 2: // multi begin
 		if sz != 9 {
 			err = fmt.Errorf("invalid pack multi begin headersz=(%d)", sz)
 			return
 		}
-		if payload, err = pkg.ReadBinary(sz - headersz); err != nil {
+		var bodyLen uint32
+		if bodyLen, err = readUint32(pkg); err != nil {
+			return
+		}
+		if err = limits.checkBegin(bodyLen, len(pendingResp)); err != nil {
 			return
 		}
 		pendingResp[session] = &RespPack{
 			Session: session,
 			Ok:      true,
-			Payload: payload,
+			Payload: preallocPayload(bodyLen),
+			bodyLen: int(bodyLen),
+			begin:   time.Now(),
 		}
 		return
 	case 3: // multi part
-		if payload, err = pkg.ReadBinary(sz - headersz); err != nil {
+		if payload, err = pkg.Next(sz - headersz); err != nil {
 			return
 		}
 		if pack, ok := pendingResp[session]; ok {
+			if err = checkPart(pack.bodyLen, len(pack.Payload), len(payload)); err != nil {
+				delete(pendingResp, session)
+				return
+			}
 			pack.Payload = append(pack.Payload, payload...)
 		} else {
 			err = fmt.Errorf("invalid large response part session=(%d)", session)
@@ -0,0 +1,264 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// SealMode how SealCodec protects the payload
+type SealMode byte
+
+const (
+	SealAESGCM SealMode = 1 // encrypt and authenticate. key size 16, 24 or 32
+	SealHMAC   SealMode = 2 // authenticate only with HMAC-SHA256, payload is readable. key size >= 16
+)
+
+func (m SealMode) String() string {
+	switch m {
+	case SealAESGCM:
+		return "aesgcm"
+	case SealHMAC:
+		return "hmac"
+	}
+	return fmt.Sprintf("SealMode(%d)", byte(m))
+}
+
+// ErrVerifyFailed sealed payload is forged, corrupted or sealed with unknown key
+var ErrVerifyFailed = errors.New("payload verification failed")
+
+// CodeVerifyFailed error code replied when request args verification failed
+const CodeVerifyFailed = 401
+
+const sealHeaderSize = 5 // mode + key id
+
+// SealedPayloadCodec payload codec authenticates every payload. Empty payload is never valid, null is sealed too
+type SealedPayloadCodec interface {
+	PayloadCodec
+	// SealNull sealed payload of null. eg: args of nil or no args
+	SealNull() ([]byte, error)
+	// Verify the payload is sealed by a known key
+	Verify(data []byte) error
+}
+
+type sealKey struct {
+	key  []byte
+	aead cipher.AEAD // nil if not aes key size
+}
+
+/*
+Keyring shared keys of SealCodec by id. Payload is sealed with the current key and opened with the key of its id.
+Rotate keys: Add the new key on every node, then Use it, Remove the old key after all nodes use the new key.
+It's safe for concurrent use.
+*/
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[uint32]*sealKey
+	current uint32
+}
+
+// NewKeyring keyring with the current key
+func NewKeyring(id uint32, key []byte) (*Keyring, error) {
+	k := &Keyring{keys: map[uint32]*sealKey{}}
+	if err := k.Add(id, key); err != nil {
+		return nil, err
+	}
+	k.current = id
+	return k, nil
+}
+
+// Add key of id. Replace the key if id exists
+func (k *Keyring) Add(id uint32, key []byte) error {
+	if len(key) < 16 {
+		return fmt.Errorf("seal key %d too short: %d bytes", id, len(key))
+	}
+	sk := &sealKey{key: append([]byte(nil), key...)}
+	if block, err := aes.NewCipher(sk.key); err == nil {
+		if sk.aead, err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+	k.mu.Lock()
+	k.keys[id] = sk
+	k.mu.Unlock()
+	return nil
+}
+
+// Use seal with key of id
+func (k *Keyring) Use(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("seal key %d not found", id)
+	}
+	k.current = id
+	return nil
+}
+
+// Remove key of id. The current key can't be removed
+func (k *Keyring) Remove(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.current {
+		return fmt.Errorf("seal key %d is in use", id)
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+func (k *Keyring) currentKey() (uint32, *sealKey) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+func (k *Keyring) get(id uint32) (*sealKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	sk, ok := k.keys[id]
+	return sk, ok
+}
+
+/*
+SealCodec wraps a payload codec and seals the payload with shared keys.
+Payload is prefixed with mode and key id (big endian uint32) which are authenticated too.
+
+	aesgcm: header | nonce(12) | ciphertext | tag(16)
+	hmac:   header | payload | HMAC-SHA256(header | payload)
+
+Request args failed to verify are replied with code CodeVerifyFailed, reply failed to verify is error wraps ErrVerifyFailed.
+Null args are sealed too, request of methods without args is verified as well.
+Replay is not prevented. It's not a MultiPayloadCodec even if the inner codec is.
+
+	keys, _ := codec.NewKeyring(1, key)
+	codec.PutPayloadCode("msgpack+aesgcm", codec.NewSealCodec(payloadcodec.MsgPack{}, codec.SealAESGCM, keys))
+*/
+type SealCodec struct {
+	Codec PayloadCodec
+	Mode  SealMode
+	Keys  *Keyring
+}
+
+func NewSealCodec(inner PayloadCodec, mode SealMode, keys *Keyring) *SealCodec {
+	return &SealCodec{Codec: inner, Mode: mode, Keys: keys}
+}
+
+func (c *SealCodec) Marshal(v any) ([]byte, error) {
+	data, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.seal(data)
+}
+
+func (c *SealCodec) seal(data []byte) ([]byte, error) {
+	id, sk := c.Keys.currentKey()
+	if sk == nil {
+		return nil, fmt.Errorf("seal key %d not found", id)
+	}
+	header := make([]byte, sealHeaderSize)
+	header[0] = byte(c.Mode)
+	binary.BigEndian.PutUint32(header[1:], id)
+
+	switch c.Mode {
+	case SealAESGCM:
+		if sk.aead == nil {
+			return nil, fmt.Errorf("seal key %d is not aes key: %d bytes", id, len(sk.key))
+		}
+		out := make([]byte, sealHeaderSize+sk.aead.NonceSize(), sealHeaderSize+sk.aead.NonceSize()+len(data)+sk.aead.Overhead())
+		copy(out, header)
+		nonce := out[sealHeaderSize:]
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return sk.aead.Seal(out, nonce, data, header), nil
+	case SealHMAC:
+		mac := hmac.New(sha256.New, sk.key)
+		mac.Write(header)
+		mac.Write(data)
+		out := make([]byte, 0, sealHeaderSize+len(data)+mac.Size())
+		out = append(append(out, header...), data...)
+		return mac.Sum(out), nil
+	}
+	return nil, fmt.Errorf("invalid seal mode %d", c.Mode)
+}
+
+func (c *SealCodec) Unmarshal(data []byte, v any) error {
+	data, err := c.open(data)
+	if err != nil {
+		return err
+	}
+	return c.Codec.Unmarshal(data, v)
+}
+
+func (c *SealCodec) open(data []byte) ([]byte, error) {
+	if len(data) < sealHeaderSize {
+		return nil, fmt.Errorf("%w: payload too short", ErrVerifyFailed)
+	}
+	header := data[:sealHeaderSize]
+	if mode := SealMode(header[0]); mode != c.Mode {
+		return nil, fmt.Errorf("%w: mode %s, expect %s", ErrVerifyFailed, mode, c.Mode)
+	}
+	id := binary.BigEndian.Uint32(header[1:])
+	sk, ok := c.Keys.get(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %d", ErrVerifyFailed, id)
+	}
+
+	data = data[sealHeaderSize:]
+	switch c.Mode {
+	case SealAESGCM:
+		if sk.aead == nil || len(data) < sk.aead.NonceSize() {
+			return nil, fmt.Errorf("%w: invalid key %d or payload", ErrVerifyFailed, id)
+		}
+		nonce, ciphertext := data[:sk.aead.NonceSize()], data[sk.aead.NonceSize():]
+		plain, err := sk.aead.Open(nil, nonce, ciphertext, header)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %d: %s", ErrVerifyFailed, id, err.Error())
+		}
+		return plain, nil
+	case SealHMAC:
+		if len(data) < sha256.Size {
+			return nil, fmt.Errorf("%w: payload too short", ErrVerifyFailed)
+		}
+		payload, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+		mac := hmac.New(sha256.New, sk.key)
+		mac.Write(header)
+		mac.Write(payload)
+		if !hmac.Equal(mac.Sum(nil), sum) {
+			return nil, fmt.Errorf("%w: key %d: hmac mismatch", ErrVerifyFailed, id)
+		}
+		return payload, nil
+	}
+	return nil, fmt.Errorf("invalid seal mode %d", c.Mode)
+}
+
+// SealNull seal empty payload
+func (c *SealCodec) SealNull() ([]byte, error) {
+	return c.seal(nil)
+}
+
+func (c *SealCodec) Verify(data []byte) error {
+	_, err := c.open(data)
+	return err
+}
+
+// IsNull sealed empty payload. empty payload is not null, it fails to verify
+func (c *SealCodec) IsNull(data []byte) bool {
+	// larger than sealed empty payload of any mode
+	if len(data) == 0 || len(data) > sealHeaderSize+sha256.Size {
+		return false
+	}
+	plain, err := c.open(data)
+	return err == nil && len(plain) == 0
+}
+
+func (c *SealCodec) Name() string {
+	return c.Codec.Name() + "+" + c.Mode.String()
+}
@@ -3,15 +3,52 @@ package payloadcodec
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"reflect"
 )
 
-type Json struct{}
+type Json struct {
+	// LuaCompat tolerant of lua encoders when decoding. eg: {} as empty array, integral real number as integer.
+	// json: Json{LuaCompat: true}
+	LuaCompat bool
+}
 
 func (c Json) Marshal(v any) ([]byte, error) {
 	return json.Marshal(v)
 }
 func (c Json) Unmarshal(data []byte, v any) error {
-	return json.Unmarshal(data, v)
+	if !c.LuaCompat {
+		return json.Unmarshal(data, v)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("json: unmarshal need non-nil pointer, got %T", v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var val any
+	if err := dec.Decode(&val); err != nil {
+		return err
+	}
+	return jsonLuaDecoder.assign(rv.Elem(), val)
+}
+
+var jsonLuaDecoder = &luaDecoder{
+	tagName: "json",
+	custom: func(dst reflect.Value, val any) (bool, error) {
+		if !dst.CanAddr() {
+			return false, nil
+		}
+		u, ok := dst.Addr().Interface().(json.Unmarshaler)
+		if !ok {
+			return false, nil
+		}
+		data, err := json.Marshal(val)
+		if err != nil {
+			return true, err
+		}
+		return true, u.UnmarshalJSON(data)
+	},
 }
 
 var nullBytes = []byte("null")
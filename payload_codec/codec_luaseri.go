@@ -0,0 +1,731 @@
+package payloadcodec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/*
+LuaSeri implements skynet lua-serialize (lualib-src/lua-seri.c), the format skynet.pack uses for lua messages.
+
+Unlike other codecs it can carry several values in one payload. It's what unmodified lua code sends
+with cluster.call(node, addr, "cmd", a, b, c), so payloads are exchanged as is without a string wrapper.
+
+lua -> go: nil=nil boolean=bool integer=int64 real=float64 string=string lightuserdata=LightUserdata
+table=[]any (array only) or map[string]any (string keys only) or map[any]any
+
+go -> lua: struct fields use tag `lua:"name,omitempty"` or the field name. map/struct as hash, slice/array as array.
+*/
+type LuaSeri struct{}
+
+// LightUserdata lua light userdata. It's a raw pointer, only meaningful inside the sender process.
+type LightUserdata uint64
+
+// lua-seri type
+const (
+	seriTypeNil         = 0
+	seriTypeBoolean     = 1 // hibits 0 false 1 true
+	seriTypeNumber      = 2 // hibits 0: 0, 1: byte, 2: word, 4: dword, 6: qword, 8: double
+	seriTypeUserdata    = 3
+	seriTypeShortString = 4 // hibits 0-31 : len
+	seriTypeLongString  = 5
+	seriTypeTable       = 6
+
+	seriNumberZero  = 0
+	seriNumberByte  = 1
+	seriNumberWord  = 2
+	seriNumberDword = 4
+	seriNumberQword = 6
+	seriNumberReal  = 8
+
+	seriMaxCookie = 32
+	seriMaxDepth  = 32
+)
+
+var typeOfLightUserdata = reflect.TypeFor[LightUserdata]()
+
+func (c LuaSeri) Marshal(v any) ([]byte, error) {
+	return c.MarshalMulti(v)
+}
+
+// MarshalMulti pack every value one by one. like skynet.pack(...)
+func (c LuaSeri) MarshalMulti(vs ...any) ([]byte, error) {
+	w := &seriWriter{}
+	for _, v := range vs {
+		if err := w.pack(reflect.ValueOf(v), 0); err != nil {
+			return nil, err
+		}
+	}
+	return w.buf, nil
+}
+
+func (c LuaSeri) Unmarshal(data []byte, v any) error {
+	return c.UnmarshalMulti(data, v)
+}
+
+// UnmarshalMulti unpack values into pointers in order. like skynet.unpack(msg)
+// Missing values are nil and extra values are ignored.
+func (c LuaSeri) UnmarshalMulti(data []byte, vs ...any) error {
+	r := &seriReader{data: data}
+	for i, v := range vs {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Pointer || rv.IsNil() {
+			return fmt.Errorf("luaseri: unmarshal value %d need non-nil pointer, got %T", i, v)
+		}
+		var val any
+		if r.Len() > 0 {
+			var err error
+			if val, err = r.unpack(0); err != nil {
+				return err
+			}
+		}
+		if err := seriAssign(rv.Elem(), val); err != nil {
+			return fmt.Errorf("luaseri: unmarshal value %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (c LuaSeri) IsNull(data []byte) bool {
+	return len(data) == 0 || data[0] == seriTypeNil
+}
+
+func (c LuaSeri) Name() string {
+	return "luaseri"
+}
+
+func seriCombineType(t, v uint8) uint8 {
+	return t | v<<3
+}
+
+type seriWriter struct {
+	buf []byte
+}
+
+func (w *seriWriter) writeNil() {
+	w.buf = append(w.buf, seriTypeNil)
+}
+
+func (w *seriWriter) writeBoolean(b bool) {
+	var v uint8
+	if b {
+		v = 1
+	}
+	w.buf = append(w.buf, seriCombineType(seriTypeBoolean, v))
+}
+
+// same as wb_integer in lua-seri.c
+func (w *seriWriter) writeInteger(v int64) {
+	switch {
+	case v == 0:
+		w.buf = append(w.buf, seriCombineType(seriTypeNumber, seriNumberZero))
+	case v != int64(int32(v)):
+		w.buf = append(w.buf, seriCombineType(seriTypeNumber, seriNumberQword))
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(v))
+	case v < 0:
+		w.buf = append(w.buf, seriCombineType(seriTypeNumber, seriNumberDword))
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(int32(v)))
+	case v < 0x100:
+		w.buf = append(w.buf, seriCombineType(seriTypeNumber, seriNumberByte), uint8(v))
+	case v < 0x10000:
+		w.buf = append(w.buf, seriCombineType(seriTypeNumber, seriNumberWord))
+		w.buf = binary.LittleEndian.AppendUint16(w.buf, uint16(v))
+	default:
+		w.buf = append(w.buf, seriCombineType(seriTypeNumber, seriNumberDword))
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(v))
+	}
+}
+
+func (w *seriWriter) writeReal(v float64) {
+	w.buf = append(w.buf, seriCombineType(seriTypeNumber, seriNumberReal))
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v))
+}
+
+func (w *seriWriter) writeUserdata(v LightUserdata) {
+	w.buf = append(w.buf, seriCombineType(seriTypeUserdata, 0))
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(v))
+}
+
+func (w *seriWriter) writeString(s []byte) {
+	sz := len(s)
+	if sz < seriMaxCookie {
+		w.buf = append(w.buf, seriCombineType(seriTypeShortString, uint8(sz)))
+	} else if sz < 0x10000 {
+		w.buf = append(w.buf, seriCombineType(seriTypeLongString, 2))
+		w.buf = binary.LittleEndian.AppendUint16(w.buf, uint16(sz))
+	} else {
+		w.buf = append(w.buf, seriCombineType(seriTypeLongString, 4))
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(sz))
+	}
+	w.buf = append(w.buf, s...)
+}
+
+func (w *seriWriter) writeTableHeader(arraySize int) {
+	if arraySize >= seriMaxCookie-1 {
+		w.buf = append(w.buf, seriCombineType(seriTypeTable, seriMaxCookie-1))
+		w.writeInteger(int64(arraySize))
+	} else {
+		w.buf = append(w.buf, seriCombineType(seriTypeTable, uint8(arraySize)))
+	}
+}
+
+func (w *seriWriter) pack(v reflect.Value, depth int) error {
+	if depth > seriMaxDepth {
+		return errors.New("luaseri: serialize can't pack too depth table")
+	}
+	if !v.IsValid() {
+		w.writeNil()
+		return nil
+	}
+	if v.Type() == typeOfLightUserdata {
+		w.writeUserdata(LightUserdata(v.Uint()))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		return w.pack(v.Elem(), depth)
+	case reflect.Bool:
+		w.writeBoolean(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.writeInteger(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			return fmt.Errorf("luaseri: integer %d overflows lua integer", u)
+		}
+		w.writeInteger(int64(u))
+	case reflect.Float32, reflect.Float64:
+		w.writeReal(v.Float())
+	case reflect.String:
+		w.writeString([]byte(v.String()))
+	case reflect.Slice:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			w.writeString(v.Bytes())
+			return nil
+		}
+		return w.packArray(v, depth)
+	case reflect.Array:
+		return w.packArray(v, depth)
+	case reflect.Map:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		w.writeTableHeader(0)
+		iter := v.MapRange()
+		for iter.Next() {
+			key := iter.Key()
+			if isNilValue(key) {
+				return errors.New("luaseri: table index is nil")
+			}
+			if err := w.pack(key, depth+1); err != nil {
+				return err
+			}
+			if err := w.pack(iter.Value(), depth+1); err != nil {
+				return err
+			}
+		}
+		w.writeNil()
+	case reflect.Struct:
+		w.writeTableHeader(0)
+		for _, f := range structFields(v.Type(), "lua") {
+			fv := v.FieldByIndex(f.index)
+			if isNilValue(fv) || (f.omitEmpty && fv.IsZero()) {
+				continue
+			}
+			w.writeString([]byte(f.name))
+			if err := w.pack(fv, depth+1); err != nil {
+				return err
+			}
+		}
+		w.writeNil()
+	default:
+		return fmt.Errorf("luaseri: unsupport type %s to serialize", v.Type())
+	}
+	return nil
+}
+
+func (w *seriWriter) packArray(v reflect.Value, depth int) error {
+	n := v.Len()
+	w.writeTableHeader(n)
+	for i := 0; i < n; i++ {
+		if err := w.pack(v.Index(i), depth+1); err != nil {
+			return err
+		}
+	}
+	// empty hash part
+	w.writeNil()
+	return nil
+}
+
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	}
+	return !v.IsValid()
+}
+
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type structFieldsKey struct {
+	t       reflect.Type
+	tagName string
+}
+
+var structFieldsCache sync.Map // map[structFieldsKey][]structField
+
+// structFields exported fields of struct named by tag. embedded structs without tag name are flattened
+func structFields(t reflect.Type, tagName string) []structField {
+	key := structFieldsKey{t, tagName}
+	if fields, ok := structFieldsCache.Load(key); ok {
+		return fields.([]structField)
+	}
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get(tagName)
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range structFields(sf.Type, tagName) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, structField{name: name, index: []int{i}, omitEmpty: opts == "omitempty"})
+	}
+	structFieldsCache.Store(key, fields)
+	return fields
+}
+
+// findField field of name, or the first one equal fold
+func findField(fields []structField, name string) *structField {
+	var field *structField
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+		if field == nil && strings.EqualFold(fields[i].name, name) {
+			field = &fields[i]
+		}
+	}
+	return field
+}
+
+// seriTable decoded lua table. keep the array part and hash part as they are on the wire
+type seriTable struct {
+	array []any
+	hash  [][2]any
+}
+
+type seriReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *seriReader) Len() int {
+	return len(r.data) - r.pos
+}
+
+func (r *seriReader) read(n int) ([]byte, error) {
+	if n < 0 || r.Len() < n {
+		return nil, fmt.Errorf("luaseri: invalid serialize stream %d (at byte %d)", n, r.pos)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *seriReader) readInteger(cookie uint8) (int64, error) {
+	switch cookie {
+	case seriNumberZero:
+		return 0, nil
+	case seriNumberByte:
+		b, err := r.read(1)
+		if err != nil {
+			return 0, err
+		}
+		return int64(b[0]), nil
+	case seriNumberWord:
+		b, err := r.read(2)
+		if err != nil {
+			return 0, err
+		}
+		return int64(binary.LittleEndian.Uint16(b)), nil
+	case seriNumberDword:
+		b, err := r.read(4)
+		if err != nil {
+			return 0, err
+		}
+		return int64(int32(binary.LittleEndian.Uint32(b))), nil
+	case seriNumberQword:
+		b, err := r.read(8)
+		if err != nil {
+			return 0, err
+		}
+		return int64(binary.LittleEndian.Uint64(b)), nil
+	default:
+		return 0, fmt.Errorf("luaseri: invalid serialize stream (integer cookie %d)", cookie)
+	}
+}
+
+func (r *seriReader) unpack(depth int) (any, error) {
+	if depth > seriMaxDepth {
+		return nil, errors.New("luaseri: unpack too depth table")
+	}
+	header, err := r.read(1)
+	if err != nil {
+		return nil, err
+	}
+	luaType, cookie := header[0]&0x7, header[0]>>3
+	switch luaType {
+	case seriTypeNil:
+		return nil, nil
+	case seriTypeBoolean:
+		return cookie != 0, nil
+	case seriTypeNumber:
+		if cookie == seriNumberReal {
+			b, err := r.read(8)
+			if err != nil {
+				return nil, err
+			}
+			return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+		}
+		return r.readInteger(cookie)
+	case seriTypeUserdata:
+		b, err := r.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return LightUserdata(binary.LittleEndian.Uint64(b)), nil
+	case seriTypeShortString:
+		b, err := r.read(int(cookie))
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case seriTypeLongString:
+		var sz int
+		switch cookie {
+		case 2:
+			b, err := r.read(2)
+			if err != nil {
+				return nil, err
+			}
+			sz = int(binary.LittleEndian.Uint16(b))
+		case 4:
+			b, err := r.read(4)
+			if err != nil {
+				return nil, err
+			}
+			sz = int(binary.LittleEndian.Uint32(b))
+		default:
+			return nil, fmt.Errorf("luaseri: invalid long string size=%d,expect=2 or 4", cookie)
+		}
+		b, err := r.read(sz)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case seriTypeTable:
+		return r.unpackTable(int(cookie), depth)
+	default:
+		return nil, fmt.Errorf("luaseri: invalid serialize type %d", luaType)
+	}
+}
+
+func (r *seriReader) unpackTable(arraySize int, depth int) (*seriTable, error) {
+	if arraySize == seriMaxCookie-1 {
+		header, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		luaType, cookie := header[0]&0x7, header[0]>>3
+		if luaType != seriTypeNumber || cookie == seriNumberReal {
+			return nil, errors.New("luaseri: invalid serialize stream (table array size)")
+		}
+		n, err := r.readInteger(cookie)
+		if err != nil {
+			return nil, err
+		}
+		// every value takes one byte at least
+		if n < 0 || n > int64(r.Len()) {
+			return nil, fmt.Errorf("luaseri: invalid table array size %d", n)
+		}
+		arraySize = int(n)
+	}
+
+	t := &seriTable{array: make([]any, 0, arraySize)}
+	for i := 0; i < arraySize; i++ {
+		v, err := r.unpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		t.array = append(t.array, v)
+	}
+	for {
+		k, err := r.unpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if k == nil {
+			return t, nil
+		}
+		v, err := r.unpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		t.hash = append(t.hash, [2]any{k, v})
+	}
+}
+
+// seriGeneric convert decoded value into the default go type for any
+func seriGeneric(val any) any {
+	t, ok := val.(*seriTable)
+	if !ok {
+		return val
+	}
+	if len(t.hash) == 0 && len(t.array) > 0 {
+		array := make([]any, len(t.array))
+		for i, v := range t.array {
+			array[i] = seriGeneric(v)
+		}
+		return array
+	}
+	if len(t.array) == 0 {
+		strKeys := true
+		for _, kv := range t.hash {
+			if _, ok := kv[0].(string); !ok {
+				strKeys = false
+				break
+			}
+		}
+		if strKeys {
+			m := make(map[string]any, len(t.hash))
+			for _, kv := range t.hash {
+				m[kv[0].(string)] = seriGeneric(kv[1])
+			}
+			return m
+		}
+	}
+	m := make(map[any]any, len(t.array)+len(t.hash))
+	for i, v := range t.array {
+		m[int64(i+1)] = seriGeneric(v)
+	}
+	for _, kv := range t.hash {
+		m[seriGeneric(kv[0])] = seriGeneric(kv[1])
+	}
+	return m
+}
+
+// seriToInteger lua number to integer. real number must has an exact integer representation
+func seriToInteger(val any) (int64, error) {
+	switch n := val.(type) {
+	case int64:
+		return n, nil
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), nil
+		}
+		return 0, fmt.Errorf("number %v has no integer representation", n)
+	default:
+		return 0, fmt.Errorf("can't convert lua %s to integer", seriTypeName(val))
+	}
+}
+
+func seriTypeName(val any) string {
+	switch val.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case int64, float64:
+		return "number"
+	case string:
+		return "string"
+	case LightUserdata:
+		return "userdata"
+	case *seriTable:
+		return "table"
+	default:
+		return fmt.Sprintf("%T", val)
+	}
+}
+
+func seriAssign(dst reflect.Value, val any) error {
+	if val == nil {
+		dst.SetZero()
+		return nil
+	}
+	if dst.Type() == typeOfLightUserdata {
+		if p, ok := val.(LightUserdata); ok {
+			dst.SetUint(uint64(p))
+			return nil
+		}
+		return fmt.Errorf("can't convert lua %s to %s", seriTypeName(val), dst.Type())
+	}
+
+	switch dst.Kind() {
+	case reflect.Pointer:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return seriAssign(dst.Elem(), val)
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return fmt.Errorf("can't convert lua %s to %s", seriTypeName(val), dst.Type())
+		}
+		dst.Set(reflect.ValueOf(seriGeneric(val)))
+		return nil
+	case reflect.Bool:
+		if b, ok := val.(bool); ok {
+			dst.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := seriToInteger(val)
+		if err != nil {
+			return err
+		}
+		if dst.OverflowInt(n) {
+			return fmt.Errorf("integer %d overflows %s", n, dst.Type())
+		}
+		dst.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := seriToInteger(val)
+		if err != nil {
+			return err
+		}
+		if n < 0 || dst.OverflowUint(uint64(n)) {
+			return fmt.Errorf("integer %d overflows %s", n, dst.Type())
+		}
+		dst.SetUint(uint64(n))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		switch n := val.(type) {
+		case int64:
+			dst.SetFloat(float64(n))
+			return nil
+		case float64:
+			dst.SetFloat(n)
+			return nil
+		}
+	case reflect.String:
+		if s, ok := val.(string); ok {
+			dst.SetString(s)
+			return nil
+		}
+	case reflect.Slice:
+		if s, ok := val.(string); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes([]byte(s))
+			return nil
+		}
+		if t, ok := val.(*seriTable); ok {
+			if len(t.hash) > 0 {
+				return fmt.Errorf("lua table has hash part, can't convert to %s", dst.Type())
+			}
+			slice := reflect.MakeSlice(dst.Type(), len(t.array), len(t.array))
+			for i, v := range t.array {
+				if err := seriAssign(slice.Index(i), v); err != nil {
+					return err
+				}
+			}
+			dst.Set(slice)
+			return nil
+		}
+	case reflect.Array:
+		if t, ok := val.(*seriTable); ok {
+			if len(t.hash) > 0 || len(t.array) > dst.Len() {
+				return fmt.Errorf("lua table can't convert to %s", dst.Type())
+			}
+			dst.SetZero()
+			for i, v := range t.array {
+				if err := seriAssign(dst.Index(i), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.Map:
+		if t, ok := val.(*seriTable); ok {
+			mt := dst.Type()
+			m := reflect.MakeMapWithSize(mt, len(t.array)+len(t.hash))
+			set := func(k, v any) error {
+				kv := reflect.New(mt.Key()).Elem()
+				if err := seriAssign(kv, k); err != nil {
+					return err
+				}
+				vv := reflect.New(mt.Elem()).Elem()
+				if err := seriAssign(vv, v); err != nil {
+					return err
+				}
+				m.SetMapIndex(kv, vv)
+				return nil
+			}
+			for i, v := range t.array {
+				if err := set(int64(i+1), v); err != nil {
+					return err
+				}
+			}
+			for _, kv := range t.hash {
+				if err := set(kv[0], kv[1]); err != nil {
+					return err
+				}
+			}
+			dst.Set(m)
+			return nil
+		}
+	case reflect.Struct:
+		if t, ok := val.(*seriTable); ok {
+			fields := structFields(dst.Type(), "lua")
+			for _, kv := range t.hash {
+				key, ok := kv[0].(string)
+				if !ok {
+					continue
+				}
+				field := findField(fields, key)
+				if field == nil {
+					continue
+				}
+				fv, err := dst.FieldByIndexErr(field.index)
+				if err != nil {
+					return err
+				}
+				if err := seriAssign(fv, kv[1]); err != nil {
+					return fmt.Errorf("field %s: %w", field.name, err)
+				}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("can't convert lua %s to %s", seriTypeName(val), dst.Type())
+}
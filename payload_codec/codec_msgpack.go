@@ -1,15 +1,85 @@
 package payloadcodec
 
-import "github.com/vmihailenco/msgpack"
+import (
+	"bytes"
+	"fmt"
+	"reflect"
 
-type MsgPack struct{}
+	"github.com/vmihailenco/msgpack"
+)
+
+type MsgPack struct {
+	// LuaCompat tolerant of lua encoders when decoding. eg: {} as empty map, integral real number as integer.
+	// msgpack: MsgPack{LuaCompat: true}
+	LuaCompat bool
+}
 
 func (c MsgPack) Marshal(v any) ([]byte, error) {
 	return msgpack.Marshal(v)
 }
 
 func (c MsgPack) Unmarshal(data []byte, v any) error {
-	return msgpack.Unmarshal(data, v)
+	if !c.LuaCompat {
+		return msgpack.Unmarshal(data, v)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("msgpack: unmarshal need non-nil pointer, got %T", v)
+	}
+	dec := msgpack.NewDecoder(bytes.NewReader(data)).UseDecodeInterfaceLoose(true)
+	dec.SetDecodeMapFunc(decodeMsgpackMap)
+	val, err := dec.DecodeInterfaceLoose()
+	if err != nil {
+		return err
+	}
+	return msgpackLuaDecoder.assign(rv.Elem(), val)
+}
+
+// decodeMsgpackMap map[any]any whatever the key types are. binary keys are strings
+func decodeMsgpackMap(d *msgpack.Decoder) (any, error) {
+	n, err := d.DecodeMapLen()
+	if err != nil || n == -1 {
+		return nil, err
+	}
+	m := make(map[any]any, n)
+	for i := 0; i < n; i++ {
+		k, err := d.DecodeInterfaceLoose()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.DecodeInterfaceLoose()
+		if err != nil {
+			return nil, err
+		}
+		switch key := k.(type) {
+		case []byte:
+			k = string(key)
+		case map[any]any, []any:
+			return nil, fmt.Errorf("msgpack: unsupported map key %T", k)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+var msgpackLuaDecoder = &luaDecoder{
+	tagName: "msgpack",
+	custom: func(dst reflect.Value, val any) (bool, error) {
+		if !dst.CanAddr() {
+			return false, nil
+		}
+		ptr := dst.Addr().Interface()
+		switch ptr.(type) {
+		case msgpack.Unmarshaler, msgpack.CustomDecoder:
+		default:
+			return false, nil
+		}
+		data, err := msgpack.Marshal(val)
+		if err != nil {
+			return true, err
+		}
+		return true, msgpack.Unmarshal(data, ptr)
+	},
 }
 
 func (c MsgPack) IsNull(data []byte) bool {
@@ -0,0 +1,42 @@
+package payloadcodec
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Protobuf args and replies must be proto.Message (pointer of generated message).
+
+Empty message and nil are both encoded as empty payload, so an empty message arg is received as nil pointer.
+Use the generated getters which are nil safe. lua: lua-protobuf pb.encode/pb.decode
+*/
+type Protobuf struct {
+	MarshalOptions   proto.MarshalOptions
+	UnmarshalOptions proto.UnmarshalOptions
+}
+
+func (c Protobuf) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf marshal need proto.Message got %T", v)
+	}
+	return c.MarshalOptions.Marshal(msg)
+}
+
+func (c Protobuf) Unmarshal(data []byte, v any) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf unmarshal need proto.Message got %T", v)
+	}
+	return c.UnmarshalOptions.Unmarshal(data, msg)
+}
+
+func (c Protobuf) IsNull(data []byte) bool {
+	return len(data) == 0
+}
+
+func (c Protobuf) Name() string {
+	return "protobuf"
+}
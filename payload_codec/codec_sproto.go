@@ -0,0 +1,934 @@
+package payloadcodec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/*
+Sproto implements cloudwu/sproto, skynet native schema format. Lua calls with sproto:encode(typename, t)
+output (sproto:pencode if Packed) and go handlers receive structs, no json/msgpack conversion needed.
+
+The sproto type of a value is SprotoTyper.SprotoType() or the go type name (nested type Parent.Child can be
+matched by Child if unique). Use MarshalType/UnmarshalType to name the type explicitly.
+
+go <-> sproto: struct fields use tag `sproto:"name"` or the field name (case insensitive).
+nil pointer/slice/map fields are absent, other fields are always encoded.
+integer=int/uint kinds, decimal integer(n)=float kinds (scaled by 10^n) or int kinds (raw fixed point value)
+boolean=bool string/binary=string or []byte double=float kinds struct=struct or map[string]any
+*Type(key)=slice or map keyed by the main key *Type()=map of the two fields. any receives generic values.
+*/
+type Sproto struct {
+	Schema *SprotoSchema
+	// Packed 0-pack the message like sproto:pencode/pdecode
+	Packed bool
+
+	types sync.Map // map[reflect.Type]*sprotoType
+}
+
+// SprotoTyper names the sproto type of go value
+type SprotoTyper interface {
+	SprotoType() string
+}
+
+const sprotoMaxDepth = 64
+
+// NewSproto sproto codec of schema
+func NewSproto(schema *SprotoSchema) *Sproto {
+	return &Sproto{Schema: schema}
+}
+
+// LoadSproto load .sproto text file, or compiled bundle (sprotoparser.dump output) of other extensions
+func LoadSproto(path string) (*Sproto, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schema *SprotoSchema
+	if strings.HasSuffix(path, ".sproto") {
+		schema, err = ParseSproto(string(data))
+	} else {
+		schema, err = ParseSprotoBundle(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w (file %s)", err, path)
+	}
+	return NewSproto(schema), nil
+}
+
+func (c *Sproto) typeOf(v reflect.Value) (*sprotoType, error) {
+	if typer, ok := v.Interface().(SprotoTyper); ok {
+		return c.lookup(typer.SprotoType())
+	}
+	t := v.Type()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if st, ok := c.types.Load(t); ok {
+		return st.(*sprotoType), nil
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("sproto: need struct or SprotoTyper got %s", v.Type())
+	}
+	st, err := c.lookup(t.Name())
+	if err != nil {
+		return nil, err
+	}
+	c.types.Store(t, st)
+	return st, nil
+}
+
+func (c *Sproto) lookup(name string) (*sprotoType, error) {
+	if c.Schema == nil {
+		return nil, fmt.Errorf("sproto: no schema")
+	}
+	st, ok := c.Schema.lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("sproto: type %s not found", name)
+	}
+	return st, nil
+}
+
+func (c *Sproto) Marshal(v any) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if isNilValue(rv) {
+		return nil, nil
+	}
+	st, err := c.typeOf(rv)
+	if err != nil {
+		return nil, err
+	}
+	return c.marshal(st, rv)
+}
+
+// MarshalType encode v as sproto type name
+func (c *Sproto) MarshalType(name string, v any) ([]byte, error) {
+	st, err := c.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.marshal(st, reflect.ValueOf(v))
+}
+
+func (c *Sproto) marshal(st *sprotoType, v reflect.Value) ([]byte, error) {
+	data, err := encodeSproto(st, v)
+	if err != nil {
+		return nil, err
+	}
+	if c.Packed {
+		data = sprotoPack(data)
+	}
+	return data, nil
+}
+
+func (c *Sproto) Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("sproto: unmarshal need non-nil pointer, got %T", v)
+	}
+	st, err := c.typeOf(rv)
+	if err != nil {
+		return err
+	}
+	return c.unmarshal(st, data, rv)
+}
+
+// UnmarshalType decode data of sproto type name into pointer v
+func (c *Sproto) UnmarshalType(name string, data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("sproto: unmarshal need non-nil pointer, got %T", v)
+	}
+	st, err := c.lookup(name)
+	if err != nil {
+		return err
+	}
+	return c.unmarshal(st, data, rv)
+}
+
+func (c *Sproto) unmarshal(st *sprotoType, data []byte, v reflect.Value) error {
+	if c.Packed {
+		var err error
+		if data, err = sprotoUnpack(data); err != nil {
+			return err
+		}
+	}
+	return decodeSprotoStruct(st, data, v.Elem(), 0)
+}
+
+func (c *Sproto) IsNull(data []byte) bool {
+	return len(data) == 0
+}
+
+func (c *Sproto) Name() string {
+	return "sproto"
+}
+
+/* ---------------- go struct fields ---------------- */
+
+var sprotoFieldsCache sync.Map // map[sprotoFieldsKey][][]int
+
+type sprotoFieldsKey struct {
+	t  reflect.Type
+	st *sprotoType
+}
+
+// sprotoStructFields go field index of every sproto field, nil if not mapped
+func sprotoStructFields(t reflect.Type, st *sprotoType) [][]int {
+	key := sprotoFieldsKey{t, st}
+	if fields, ok := sprotoFieldsCache.Load(key); ok {
+		return fields.([][]int)
+	}
+	goFields := structFields(t, "sproto")
+	fields := make([][]int, len(st.fields))
+	for i, f := range st.fields {
+		if gf := findField(goFields, f.name); gf != nil {
+			fields[i] = gf.index
+		}
+	}
+	sprotoFieldsCache.Store(key, fields)
+	return fields
+}
+
+/* ---------------- encode ---------------- */
+
+func indirectValue(v reflect.Value) reflect.Value {
+	for (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+func encodeSproto(st *sprotoType, v reflect.Value) ([]byte, error) {
+	return encodeSprotoStruct(st, indirectValue(v), 0)
+}
+
+// encodeSprotoStruct v is struct or map[string]any
+func encodeSprotoStruct(st *sprotoType, v reflect.Value, depth int) ([]byte, error) {
+	if depth > sprotoMaxDepth {
+		return nil, fmt.Errorf("sproto: encode %s too depth", st.name)
+	}
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields := sprotoStructFields(v.Type(), st)
+		return encodeSprotoMessage(st, func(i int) reflect.Value {
+			if fields[i] == nil {
+				return reflect.Value{}
+			}
+			return v.FieldByIndex(fields[i])
+		}, depth)
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		return encodeSprotoMessage(st, func(i int) reflect.Value {
+			return v.MapIndex(reflect.ValueOf(st.fields[i].name).Convert(v.Type().Key()))
+		}, depth)
+	}
+	return nil, fmt.Errorf("sproto: encode %s need struct or map[string]any got %s", st.name, v.Type())
+}
+
+// encodeSprotoMessage field(i) value of st.fields[i], invalid or nil if absent
+func encodeSprotoMessage(st *sprotoType, field func(i int) reflect.Value, depth int) ([]byte, error) {
+	header := make([]byte, 2, 2+2*len(st.fields))
+	var data []byte
+	fn, last := 0, -1
+	for i, f := range st.fields {
+		v := field(i)
+		if isNilValue(v) {
+			continue
+		}
+		v = indirectValue(v)
+		if isNilValue(v) {
+			continue
+		}
+		if skip := f.tag - last - 1; skip > 0 {
+			header = binary.LittleEndian.AppendUint16(header, uint16(2*skip-1))
+			fn++
+		}
+		last = f.tag
+		fn++
+
+		var chunk []byte
+		var err error
+		if f.array {
+			chunk, err = encodeSprotoArray(f, v, depth)
+		} else {
+			switch f.typ {
+			case sprotoInteger:
+				var n int64
+				if n, err = sprotoIntOf(f, v); err == nil {
+					if n >= 0 && n < 0x7fff {
+						header = binary.LittleEndian.AppendUint16(header, uint16((n+1)*2))
+						continue
+					}
+					chunk = appendSprotoInt(nil, n, n == int64(int32(n)))
+				}
+			case sprotoBoolean:
+				if v.Kind() != reflect.Bool {
+					err = fmt.Errorf("need bool got %s", v.Type())
+					break
+				}
+				b := 0
+				if v.Bool() {
+					b = 1
+				}
+				header = binary.LittleEndian.AppendUint16(header, uint16((b+1)*2))
+				continue
+			case sprotoDouble:
+				var d float64
+				if d, err = sprotoFloatOf(v); err == nil {
+					chunk = binary.LittleEndian.AppendUint64(nil, math.Float64bits(d))
+				}
+			case sprotoString:
+				chunk, err = sprotoBytesOf(v)
+			case sprotoStruct:
+				chunk, err = encodeSprotoStruct(f.st, v, depth+1)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sproto: encode %s.%s: %w", st.name, f.name, err)
+		}
+		header = binary.LittleEndian.AppendUint16(header, 0)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(chunk)))
+		data = append(data, chunk...)
+	}
+	binary.LittleEndian.PutUint16(header, uint16(fn))
+	return append(header, data...), nil
+}
+
+func appendSprotoInt(buf []byte, n int64, is32 bool) []byte {
+	if is32 {
+		return binary.LittleEndian.AppendUint32(buf, uint32(n))
+	}
+	return binary.LittleEndian.AppendUint64(buf, uint64(n))
+}
+
+func sprotoIntOf(f *sprotoField, v reflect.Value) (int64, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		d := v.Float()
+		if f.extra > 0 {
+			d = math.Round(d * float64(f.extra))
+		}
+		if d != math.Trunc(d) || d < math.MinInt64 || d >= math.MaxInt64 {
+			return 0, fmt.Errorf("float %v is not integer", v.Float())
+		}
+		return int64(d), nil
+	}
+	return 0, fmt.Errorf("need integer got %s", v.Type())
+}
+
+func sprotoFloatOf(v reflect.Value) (float64, error) {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+	}
+	return 0, fmt.Errorf("need double got %s", v.Type())
+}
+
+func sprotoBytesOf(v reflect.Value) ([]byte, error) {
+	switch {
+	case v.Kind() == reflect.String:
+		return []byte(v.String()), nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		return v.Bytes(), nil
+	}
+	return nil, fmt.Errorf("need string got %s", v.Type())
+}
+
+func encodeSprotoArray(f *sprotoField, v reflect.Value, depth int) ([]byte, error) {
+	if f.typ == sprotoStruct && v.Kind() == reflect.Map {
+		return encodeSprotoMap(f, v, depth)
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("need slice got %s", v.Type())
+	}
+	n := v.Len()
+	var buf []byte
+	switch f.typ {
+	case sprotoInteger:
+		if n == 0 {
+			return buf, nil
+		}
+		ints := make([]int64, n)
+		is32 := true
+		for i := range ints {
+			var err error
+			if ints[i], err = sprotoIntOf(f, indirectValue(v.Index(i))); err != nil {
+				return nil, err
+			}
+			is32 = is32 && ints[i] == int64(int32(ints[i]))
+		}
+		if is32 {
+			buf = append(make([]byte, 0, 1+4*n), 4)
+		} else {
+			buf = append(make([]byte, 0, 1+8*n), 8)
+		}
+		for _, x := range ints {
+			buf = appendSprotoInt(buf, x, is32)
+		}
+	case sprotoBoolean:
+		buf = make([]byte, n)
+		for i := range buf {
+			e := indirectValue(v.Index(i))
+			if e.Kind() != reflect.Bool {
+				return nil, fmt.Errorf("need bool got %s", e.Type())
+			}
+			if e.Bool() {
+				buf[i] = 1
+			}
+		}
+	case sprotoDouble:
+		if n == 0 {
+			return buf, nil
+		}
+		buf = append(make([]byte, 0, 1+8*n), 8)
+		for i := 0; i < n; i++ {
+			d, err := sprotoFloatOf(indirectValue(v.Index(i)))
+			if err != nil {
+				return nil, err
+			}
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(d))
+		}
+	case sprotoString:
+		for i := 0; i < n; i++ {
+			b, err := sprotoBytesOf(indirectValue(v.Index(i)))
+			if err != nil {
+				return nil, err
+			}
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b)))
+			buf = append(buf, b...)
+		}
+	case sprotoStruct:
+		for i := 0; i < n; i++ {
+			b, err := encodeSprotoStruct(f.st, indirectValue(v.Index(i)), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b)))
+			buf = append(buf, b...)
+		}
+	}
+	return buf, nil
+}
+
+// encodeSprotoMap *Type(key) values of map, *Type() key and value of map. encoded in key order
+func encodeSprotoMap(f *sprotoField, v reflect.Value, depth int) ([]byte, error) {
+	keys := v.MapKeys()
+	slices.SortFunc(keys, compareMapKey)
+	var buf []byte
+	for _, k := range keys {
+		var b []byte
+		var err error
+		if f.isMap {
+			val := v.MapIndex(k)
+			b, err = encodeSprotoMessage(f.st, func(i int) reflect.Value {
+				if i == 0 {
+					return k
+				}
+				return val
+			}, depth+1)
+		} else {
+			b, err = encodeSprotoStruct(f.st, indirectValue(v.MapIndex(k)), depth+1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b)))
+		buf = append(buf, b...)
+	}
+	return buf, nil
+}
+
+func compareMapKey(a, b reflect.Value) int {
+	a, b = indirectValue(a), indirectValue(b)
+	if a.Kind() != b.Kind() {
+		return int(a.Kind()) - int(b.Kind())
+	}
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmpOrdered(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return cmpOrdered(a.Uint(), b.Uint())
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Float32, reflect.Float64:
+		return cmpOrdered(a.Float(), b.Float())
+	case reflect.Bool:
+		return cmpOrdered(boolInt(a.Bool()), boolInt(b.Bool()))
+	}
+	return 0
+}
+
+func cmpOrdered[T int64 | uint64 | float64 | int](a, b T) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+/* ---------------- decode ---------------- */
+
+// allocValue follow pointers and allocate nil pointers
+func allocValue(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func decodeSproto(st *sprotoType, data []byte, v any) error {
+	return decodeSprotoStruct(st, data, reflect.ValueOf(v).Elem(), 0)
+}
+
+// decodeSprotoStruct into struct, map[string]any or any
+func decodeSprotoStruct(st *sprotoType, data []byte, v reflect.Value, depth int) error {
+	if depth > sprotoMaxDepth {
+		return fmt.Errorf("sproto: decode %s too depth", st.name)
+	}
+	v = allocValue(v)
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields := sprotoStructFields(v.Type(), st)
+		return decodeSprotoMessage(st, data, func(i int) reflect.Value {
+			if fields[i] == nil {
+				return reflect.Value{}
+			}
+			return v.FieldByIndex(fields[i])
+		}, depth)
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String,
+		v.Kind() == reflect.Interface && v.NumMethod() == 0:
+		var m reflect.Value
+		if v.Kind() == reflect.Map {
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			m = v
+		} else {
+			m = reflect.ValueOf(map[string]any{})
+		}
+		values := make([]reflect.Value, len(st.fields))
+		err := decodeSprotoMessage(st, data, func(i int) reflect.Value {
+			values[i] = reflect.New(m.Type().Elem()).Elem()
+			return values[i]
+		}, depth)
+		if err != nil {
+			return err
+		}
+		for i, val := range values {
+			if val.IsValid() {
+				m.SetMapIndex(reflect.ValueOf(st.fields[i].name).Convert(m.Type().Key()), val)
+			}
+		}
+		if v.Kind() == reflect.Interface {
+			v.Set(m)
+		}
+		return nil
+	}
+	return fmt.Errorf("sproto: decode %s need struct or map[string]any got %s", st.name, v.Type())
+}
+
+// decodeSprotoMessage field(i) settable value of st.fields[i], invalid to skip
+func decodeSprotoMessage(st *sprotoType, data []byte, field func(i int) reflect.Value, depth int) error {
+	if len(data) < 2 {
+		return errSprotoTruncated
+	}
+	fn := int(binary.LittleEndian.Uint16(data))
+	if len(data) < 2+2*fn {
+		return errSprotoTruncated
+	}
+	header, body := data[2:2+2*fn], data[2+2*fn:]
+	tag := -1
+	for i := 0; i < fn; i++ {
+		value := int64(binary.LittleEndian.Uint16(header[2*i:]))
+		if value&1 == 1 {
+			tag += int(value+1) / 2
+			continue
+		}
+		tag++
+		var chunk []byte
+		if value == 0 {
+			if len(body) < 4 {
+				return errSprotoTruncated
+			}
+			sz := binary.LittleEndian.Uint32(body)
+			if uint64(len(body)-4) < uint64(sz) {
+				return errSprotoTruncated
+			}
+			chunk, body = body[4:4+sz], body[4+sz:]
+		}
+		fi := slices.IndexFunc(st.fields, func(f *sprotoField) bool { return f.tag == tag })
+		if fi < 0 {
+			continue
+		}
+		v := field(fi)
+		if !v.IsValid() {
+			continue
+		}
+		f := st.fields[fi]
+		if err := decodeSprotoValue(f, value != 0, value/2-1, chunk, v, depth); err != nil {
+			return fmt.Errorf("sproto: decode %s.%s: %w", st.name, f.name, err)
+		}
+	}
+	return nil
+}
+
+func decodeSprotoValue(f *sprotoField, inline bool, n int64, chunk []byte, v reflect.Value, depth int) error {
+	if f.array {
+		if inline {
+			return fmt.Errorf("invalid array")
+		}
+		return decodeSprotoArray(f, chunk, v, depth)
+	}
+	switch f.typ {
+	case sprotoInteger:
+		if !inline {
+			switch len(chunk) {
+			case 4:
+				n = int64(int32(binary.LittleEndian.Uint32(chunk)))
+			case 8:
+				n = int64(binary.LittleEndian.Uint64(chunk))
+			default:
+				return fmt.Errorf("invalid integer size %d", len(chunk))
+			}
+		}
+		return setSprotoInt(f, v, n)
+	case sprotoBoolean:
+		if !inline {
+			return fmt.Errorf("invalid boolean")
+		}
+		return setSprotoBool(v, n != 0)
+	case sprotoDouble:
+		if len(chunk) != 8 {
+			return fmt.Errorf("invalid double size %d", len(chunk))
+		}
+		return setSprotoDouble(v, math.Float64frombits(binary.LittleEndian.Uint64(chunk)))
+	case sprotoString:
+		if inline {
+			return fmt.Errorf("invalid string")
+		}
+		return setSprotoBytes(f, v, chunk)
+	case sprotoStruct:
+		if inline {
+			return fmt.Errorf("invalid struct")
+		}
+		return decodeSprotoStruct(f.st, chunk, v, depth+1)
+	}
+	return nil
+}
+
+func setSprotoInt(f *sprotoField, v reflect.Value, n int64) error {
+	v = allocValue(v)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(n) {
+			return fmt.Errorf("integer %d overflow %s", n, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if (n < 0 && v.Kind() != reflect.Uint64) || v.OverflowUint(uint64(n)) {
+			return fmt.Errorf("integer %d overflow %s", n, v.Type())
+		}
+		v.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		if f.extra > 0 {
+			v.SetFloat(float64(n) / float64(f.extra))
+		} else {
+			v.SetFloat(float64(n))
+		}
+	case reflect.Interface:
+		if f.extra > 0 {
+			return setAny(v, float64(n)/float64(f.extra))
+		}
+		return setAny(v, n)
+	default:
+		return fmt.Errorf("cannot decode integer into %s", v.Type())
+	}
+	return nil
+}
+
+func setSprotoBool(v reflect.Value, b bool) error {
+	v = allocValue(v)
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(b)
+	case reflect.Interface:
+		return setAny(v, b)
+	default:
+		return fmt.Errorf("cannot decode boolean into %s", v.Type())
+	}
+	return nil
+}
+
+func setSprotoDouble(v reflect.Value, d float64) error {
+	v = allocValue(v)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(d)
+	case reflect.Interface:
+		return setAny(v, d)
+	default:
+		return fmt.Errorf("cannot decode double into %s", v.Type())
+	}
+	return nil
+}
+
+func setSprotoBytes(f *sprotoField, v reflect.Value, b []byte) error {
+	v = allocValue(v)
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(b))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(bytes.Clone(b))
+	case v.Kind() == reflect.Interface:
+		if f.extra == 1 {
+			return setAny(v, bytes.Clone(b))
+		}
+		return setAny(v, string(b))
+	default:
+		return fmt.Errorf("cannot decode string into %s", v.Type())
+	}
+	return nil
+}
+
+func setAny(v reflect.Value, x any) error {
+	if v.NumMethod() != 0 {
+		return fmt.Errorf("cannot decode %T into %s", x, v.Type())
+	}
+	v.Set(reflect.ValueOf(x))
+	return nil
+}
+
+func decodeSprotoArray(f *sprotoField, data []byte, v reflect.Value, depth int) error {
+	v = allocValue(v)
+	if f.typ == sprotoStruct && (v.Kind() == reflect.Map || (f.isMap && v.Kind() == reflect.Interface)) {
+		return decodeSprotoMap(f, data, v, depth)
+	}
+	var slice reflect.Value
+	switch {
+	case v.Kind() == reflect.Slice:
+		slice = reflect.MakeSlice(v.Type(), 0, 0)
+	case v.Kind() == reflect.Interface && v.NumMethod() == 0:
+		slice = reflect.ValueOf([]any{})
+	default:
+		return fmt.Errorf("cannot decode array into %s", v.Type())
+	}
+	appendElem := func(decode func(e reflect.Value) error) error {
+		e := reflect.New(slice.Type().Elem()).Elem()
+		if err := decode(e); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, e)
+		return nil
+	}
+	switch f.typ {
+	case sprotoInteger, sprotoDouble:
+		if len(data) == 0 {
+			break
+		}
+		sz := int(data[0])
+		if (sz != 4 && sz != 8) || (f.typ == sprotoDouble && sz != 8) || (len(data)-1)%sz != 0 {
+			return fmt.Errorf("invalid array size %d", sz)
+		}
+		for data = data[1:]; len(data) > 0; data = data[sz:] {
+			err := appendElem(func(e reflect.Value) error {
+				if f.typ == sprotoDouble {
+					return setSprotoDouble(e, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+				}
+				if sz == 4 {
+					return setSprotoInt(f, e, int64(int32(binary.LittleEndian.Uint32(data))))
+				}
+				return setSprotoInt(f, e, int64(binary.LittleEndian.Uint64(data)))
+			})
+			if err != nil {
+				return err
+			}
+		}
+	case sprotoBoolean:
+		for _, b := range data {
+			if err := appendElem(func(e reflect.Value) error { return setSprotoBool(e, b != 0) }); err != nil {
+				return err
+			}
+		}
+	case sprotoString, sprotoStruct:
+		for len(data) > 0 {
+			if len(data) < 4 {
+				return errSprotoTruncated
+			}
+			sz := binary.LittleEndian.Uint32(data)
+			if uint64(len(data)-4) < uint64(sz) {
+				return errSprotoTruncated
+			}
+			chunk := data[4 : 4+sz]
+			data = data[4+sz:]
+			err := appendElem(func(e reflect.Value) error {
+				if f.typ == sprotoString {
+					return setSprotoBytes(f, e, chunk)
+				}
+				return decodeSprotoStruct(f.st, chunk, e, depth+1)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	v.Set(slice)
+	return nil
+}
+
+// decodeSprotoMap *Type(key) into map of main key, *Type() into map of the two fields
+func decodeSprotoMap(f *sprotoField, data []byte, v reflect.Value, depth int) error {
+	m := v
+	if v.Kind() == reflect.Interface {
+		m = reflect.ValueOf(map[any]any{})
+	} else if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return errSprotoTruncated
+		}
+		sz := binary.LittleEndian.Uint32(data)
+		if uint64(len(data)-4) < uint64(sz) {
+			return errSprotoTruncated
+		}
+		chunk := data[4 : 4+sz]
+		data = data[4+sz:]
+
+		key := reflect.New(m.Type().Key()).Elem()
+		val := reflect.New(m.Type().Elem()).Elem()
+		var err error
+		if f.isMap {
+			err = decodeSprotoMessage(f.st, chunk, func(i int) reflect.Value {
+				if i == 0 {
+					return key
+				}
+				return val
+			}, depth+1)
+		} else if f.key >= 0 {
+			err = decodeSprotoStruct(f.st, chunk, val, depth+1)
+			if err == nil {
+				err = sprotoMainKey(f, chunk, key)
+			}
+		} else {
+			return fmt.Errorf("cannot decode array without main key into %s", m.Type())
+		}
+		if err != nil {
+			return err
+		}
+		m.SetMapIndex(key, val)
+	}
+	if v.Kind() == reflect.Interface {
+		v.Set(m)
+	}
+	return nil
+}
+
+// sprotoMainKey decode main key field of the element into key
+func sprotoMainKey(f *sprotoField, data []byte, key reflect.Value) error {
+	ki := slices.IndexFunc(f.st.fields, func(kf *sprotoField) bool { return kf.tag == f.key })
+	return decodeSprotoMessage(f.st, data, func(i int) reflect.Value {
+		if i == ki {
+			return key
+		}
+		return reflect.Value{}
+	}, 0)
+}
+
+/* ---------------- 0-pack ---------------- */
+
+// sprotoPack sproto_pack. every 8 bytes as a bitmap of nonzero bytes and nonzero bytes,
+// runs of (almost) nonzero groups as 0xff, groups-1, raw bytes
+func sprotoPack(src []byte) []byte {
+	buf := make([]byte, 0, len(src)+len(src)/8+2)
+	ffIndex, ffGroups := -1, 0
+	for i := 0; i < len(src); i += 8 {
+		var group [8]byte
+		copy(group[:], src[i:])
+		var header byte
+		nonzero := 0
+		for j, b := range group {
+			if b != 0 {
+				header |= 1 << j
+				nonzero++
+			}
+		}
+		if nonzero == 8 || (nonzero >= 6 && ffIndex >= 0) {
+			if ffIndex < 0 || ffGroups == 256 {
+				ffIndex, ffGroups = len(buf), 0
+				buf = append(buf, 0xff, 0)
+			}
+			ffGroups++
+			buf[ffIndex+1] = byte(ffGroups - 1)
+			buf = append(buf, group[:]...)
+			continue
+		}
+		ffIndex = -1
+		buf = append(buf, header)
+		for _, b := range group {
+			if b != 0 {
+				buf = append(buf, b)
+			}
+		}
+	}
+	return buf
+}
+
+// sprotoUnpack sproto_unpack. the result is padded to 8 bytes
+func sprotoUnpack(src []byte) ([]byte, error) {
+	buf := make([]byte, 0, len(src)*2)
+	for i := 0; i < len(src); {
+		header := src[i]
+		i++
+		if header == 0xff {
+			if i >= len(src) {
+				return nil, errSprotoTruncated
+			}
+			n := (int(src[i]) + 1) * 8
+			i++
+			if len(src)-i < n {
+				return nil, errSprotoTruncated
+			}
+			buf = append(buf, src[i:i+n]...)
+			i += n
+			continue
+		}
+		for j := 0; j < 8; j++ {
+			if header&(1<<j) == 0 {
+				buf = append(buf, 0)
+				continue
+			}
+			if i >= len(src) {
+				return nil, errSprotoTruncated
+			}
+			buf = append(buf, src[i])
+			i++
+		}
+	}
+	return buf, nil
+}
@@ -0,0 +1,334 @@
+package payloadcodec
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+/*
+luaDecoder assigns generic decoded json/msgpack value into go value, tolerant of lua encoders:
+
+  - lua {} is encoded as empty map or empty array, both are acceptable for slice, map and struct
+  - table with keys 1..n encoded as map (eg: sparse array of cjson, integer keys are strings) is acceptable for slice
+  - lua 5.3 integral real number is acceptable for integer. 1.0 is encoded as real by some encoders
+  - map key of integer and string are converted to each other
+*/
+type luaDecoder struct {
+	tagName string
+	// custom types decode themselves. eg: json.Unmarshaler
+	custom func(dst reflect.Value, val any) (bool, error)
+}
+
+func (d *luaDecoder) assign(dst reflect.Value, val any) error {
+	if val == nil {
+		dst.SetZero()
+		return nil
+	}
+	if dst.Kind() == reflect.Pointer {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return d.assign(dst.Elem(), val)
+	}
+	if ok, err := d.custom(dst, val); ok {
+		return err
+	}
+
+	switch dst.Kind() {
+	case reflect.Interface:
+		if dst.NumMethod() == 0 {
+			dst.Set(reflect.ValueOf(luaGeneric(val)))
+			return nil
+		}
+	case reflect.Bool:
+		if b, ok := val.(bool); ok {
+			dst.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := luaInteger(val)
+		if err != nil {
+			return err
+		}
+		if dst.OverflowInt(n) {
+			return fmt.Errorf("integer %d overflows %s", n, dst.Type())
+		}
+		dst.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u, ok := val.(uint64); ok {
+			if dst.OverflowUint(u) {
+				return fmt.Errorf("integer %d overflows %s", u, dst.Type())
+			}
+			dst.SetUint(u)
+			return nil
+		}
+		n, err := luaInteger(val)
+		if err != nil {
+			return err
+		}
+		if n < 0 || dst.OverflowUint(uint64(n)) {
+			return fmt.Errorf("integer %d overflows %s", n, dst.Type())
+		}
+		dst.SetUint(uint64(n))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		if f, ok := luaFloat(val); ok {
+			dst.SetFloat(f)
+			return nil
+		}
+	case reflect.String:
+		switch s := val.(type) {
+		case string:
+			dst.SetString(s)
+			return nil
+		case []byte:
+			dst.SetString(string(s))
+			return nil
+		}
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			switch s := val.(type) {
+			case string:
+				dst.SetBytes([]byte(s))
+				return nil
+			case []byte:
+				dst.SetBytes(s)
+				return nil
+			}
+		}
+		if array, ok := luaArray(val); ok {
+			slice := reflect.MakeSlice(dst.Type(), len(array), len(array))
+			for i, v := range array {
+				if err := d.assign(slice.Index(i), v); err != nil {
+					return err
+				}
+			}
+			dst.Set(slice)
+			return nil
+		}
+	case reflect.Array:
+		if array, ok := luaArray(val); ok && len(array) <= dst.Len() {
+			dst.SetZero()
+			for i, v := range array {
+				if err := d.assign(dst.Index(i), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case reflect.Map:
+		if entries, ok := luaEntries(val); ok {
+			mt := dst.Type()
+			m := reflect.MakeMapWithSize(mt, len(entries))
+			for _, kv := range entries {
+				k := reflect.New(mt.Key()).Elem()
+				if err := d.assignKey(k, kv[0]); err != nil {
+					return err
+				}
+				v := reflect.New(mt.Elem()).Elem()
+				if err := d.assign(v, kv[1]); err != nil {
+					return err
+				}
+				m.SetMapIndex(k, v)
+			}
+			dst.Set(m)
+			return nil
+		}
+	case reflect.Struct:
+		if entries, ok := luaEntries(val); ok {
+			fields := structFields(dst.Type(), d.tagName)
+			for _, kv := range entries {
+				key, ok := kv[0].(string)
+				if !ok {
+					continue
+				}
+				field := findField(fields, key)
+				if field == nil {
+					continue
+				}
+				fv, err := dst.FieldByIndexErr(field.index)
+				if err != nil {
+					return err
+				}
+				if err := d.assign(fv, kv[1]); err != nil {
+					return fmt.Errorf("field %s: %w", field.name, err)
+				}
+			}
+			return nil
+		}
+	}
+	// eg: *time.Time decoded by msgpack
+	rv := reflect.ValueOf(val)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Type().AssignableTo(dst.Type()) {
+		dst.Set(rv)
+		return nil
+	}
+	return fmt.Errorf("can't convert %T to %s", val, dst.Type())
+}
+
+// assignKey map key. integer and string are converted to each other
+func (d *luaDecoder) assignKey(dst reflect.Value, key any) error {
+	switch dst.Kind() {
+	case reflect.String:
+		if n, err := luaInteger(key); err == nil {
+			dst.SetString(strconv.FormatInt(n, 10))
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if s, ok := key.(string); ok {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("map key %q is not integer", s)
+			}
+			key = n
+		}
+	}
+	return d.assign(dst, key)
+}
+
+// luaInteger number to integer. real number must has an exact integer representation
+func luaInteger(val any) (int64, error) {
+	switch n := val.(type) {
+	case int64:
+		return n, nil
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, fmt.Errorf("integer %d overflows int64", n)
+		}
+		return int64(n), nil
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return 0, err
+		}
+		return luaInteger(f)
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), nil
+		}
+		return 0, fmt.Errorf("number %v has no integer representation", n)
+	}
+	return 0, fmt.Errorf("can't convert %T to integer", val)
+}
+
+func luaFloat(val any) (float64, bool) {
+	switch n := val.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// luaArray array, empty map or map with keys 1..n
+func luaArray(val any) ([]any, bool) {
+	if array, ok := val.([]any); ok {
+		return array, true
+	}
+	entries, ok := luaEntries(val)
+	if !ok {
+		return nil, false
+	}
+	array := make([]any, len(entries))
+	filled := make([]bool, len(entries))
+	for _, kv := range entries {
+		var i int64
+		var err error
+		if s, ok := kv[0].(string); ok {
+			i, err = strconv.ParseInt(s, 10, 64)
+		} else {
+			i, err = luaInteger(kv[0])
+		}
+		if err != nil || i < 1 || i > int64(len(entries)) || filled[i-1] {
+			return nil, false
+		}
+		array[i-1], filled[i-1] = kv[1], true
+	}
+	return array, true
+}
+
+// luaEntries key values of map. array is map with keys 1..n
+func luaEntries(val any) ([][2]any, bool) {
+	switch m := val.(type) {
+	case map[string]any:
+		entries := make([][2]any, 0, len(m))
+		for k, v := range m {
+			entries = append(entries, [2]any{k, v})
+		}
+		return entries, true
+	case map[any]any:
+		entries := make([][2]any, 0, len(m))
+		for k, v := range m {
+			entries = append(entries, [2]any{k, v})
+		}
+		return entries, true
+	case []any:
+		entries := make([][2]any, len(m))
+		for i, v := range m {
+			entries[i] = [2]any{int64(i + 1), v}
+		}
+		return entries, true
+	}
+	return nil, false
+}
+
+// luaGeneric default go type for any. integer=int64 real=float64 table with keys 1..n=[]any
+// table with string keys=map[string]any, other tables=map[any]any
+func luaGeneric(val any) any {
+	switch v := val.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		array := make([]any, len(v))
+		for i, e := range v {
+			array[i] = luaGeneric(e)
+		}
+		return array
+	case map[string]any, map[any]any:
+		entries, _ := luaEntries(v)
+		if array, ok := luaArray(v); ok && len(array) > 0 {
+			return luaGeneric(array)
+		}
+		strKeys := true
+		for _, kv := range entries {
+			if _, ok := kv[0].(string); !ok {
+				strKeys = false
+				break
+			}
+		}
+		if strKeys {
+			m := make(map[string]any, len(entries))
+			for _, kv := range entries {
+				m[kv[0].(string)] = luaGeneric(kv[1])
+			}
+			return m
+		}
+		m := make(map[any]any, len(entries))
+		for _, kv := range entries {
+			m[luaGeneric(kv[0])] = luaGeneric(kv[1])
+		}
+		return m
+	}
+	return val
+}
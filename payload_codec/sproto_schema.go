@@ -0,0 +1,556 @@
+package payloadcodec
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sproto builtin types. same as sprotoparser buildin_types
+const (
+	sprotoInteger = 0
+	sprotoBoolean = 1
+	sprotoString  = 2
+	sprotoDouble  = 3
+	sprotoStruct  = 4
+)
+
+var sprotoBuiltins = map[string]int{
+	"integer": sprotoInteger,
+	"boolean": sprotoBoolean,
+	"string":  sprotoString,
+	"binary":  sprotoString,
+	"double":  sprotoDouble,
+}
+
+type sprotoField struct {
+	name  string
+	tag   int
+	typ   int         // sproto builtin type or sprotoStruct
+	st    *sprotoType // struct type
+	array bool
+	key   int  // main key tag of struct array, -1 if none
+	isMap bool // *Type() two fields struct array decoded as map
+	extra int  // integer: decimal precision 10^n, string: 1 binary
+}
+
+type sprotoType struct {
+	name   string
+	fields []*sprotoField // sorted by tag
+}
+
+func (st *sprotoType) field(tag int) *sprotoField {
+	i := sort.Search(len(st.fields), func(i int) bool { return st.fields[i].tag >= tag })
+	if i < len(st.fields) && st.fields[i].tag == tag {
+		return st.fields[i]
+	}
+	return nil
+}
+
+// SprotoProtocol rpc protocol declared in schema. Request and Response are type names, empty if nil.
+type SprotoProtocol struct {
+	Name     string
+	Tag      int
+	Request  string
+	Response string
+}
+
+// SprotoSchema types and protocols of a sproto schema. nested type name is Parent.Child
+type SprotoSchema struct {
+	types     map[string]*sprotoType
+	Protocols []SprotoProtocol
+}
+
+// Types names of all types
+func (s *SprotoSchema) Types() []string {
+	names := make([]string, 0, len(s.types))
+	for name := range s.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup type by full name, or by the last part of nested name if unique
+func (s *SprotoSchema) lookup(name string) (*sprotoType, bool) {
+	if st, ok := s.types[name]; ok {
+		return st, true
+	}
+	var found *sprotoType
+	for full, st := range s.types {
+		if strings.HasSuffix(full, "."+name) {
+			if found != nil {
+				return nil, false
+			}
+			found = st
+		}
+	}
+	return found, found != nil
+}
+
+/* ---------------- .sproto text ---------------- */
+
+type sprotoLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *sprotoLexer) errorf(format string, args ...any) error {
+	return fmt.Errorf("sproto: line %d: %s", l.line, fmt.Sprintf(format, args...))
+}
+
+func isSprotoIdent(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && (c == '.' || (c >= '0' && c <= '9')))
+}
+
+// next token. "" at EOF
+func (l *sprotoLexer) next() string {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == '\n' {
+			l.line++
+			l.pos++
+		} else if c == ' ' || c == '\t' || c == '\r' {
+			l.pos++
+		} else if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		} else {
+			break
+		}
+	}
+	if l.pos >= len(l.src) {
+		return ""
+	}
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case isSprotoIdent(c, true):
+		for l.pos < len(l.src) && isSprotoIdent(l.src[l.pos], false) {
+			l.pos++
+		}
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.pos++
+		}
+	default:
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+func (l *sprotoLexer) peek() string {
+	pos, line := l.pos, l.line
+	tok := l.next()
+	l.pos, l.line = pos, line
+	return tok
+}
+
+func (l *sprotoLexer) expect(want string) error {
+	if tok := l.next(); tok != want {
+		return l.errorf("expect %q got %q", want, tok)
+	}
+	return nil
+}
+
+func (l *sprotoLexer) tag() (int, error) {
+	tok := l.next()
+	n, err := strconv.Atoi(tok)
+	if err != nil || n < 0 || n > math.MaxUint16/2 {
+		return 0, l.errorf("invalid tag %q", tok)
+	}
+	return n, nil
+}
+
+// unresolved field while parsing text
+type sprotoTextField struct {
+	field    *sprotoField
+	typeName string
+	scope    string
+	keyName  string
+	line     int
+}
+
+type sprotoParser struct {
+	lex    *sprotoLexer
+	schema *SprotoSchema
+	fields []*sprotoTextField
+}
+
+// ParseSproto parse .sproto text schema
+func ParseSproto(text string) (*SprotoSchema, error) {
+	p := &sprotoParser{
+		lex:    &sprotoLexer{src: text, line: 1},
+		schema: &SprotoSchema{types: map[string]*sprotoType{}},
+	}
+	for {
+		tok := p.lex.next()
+		if tok == "" {
+			break
+		}
+		var err error
+		if tok == "." {
+			err = p.parseType("")
+		} else {
+			err = p.parseProtocol(tok)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := p.resolve(); err != nil {
+		return nil, err
+	}
+	return p.schema, nil
+}
+
+func (p *sprotoParser) newType(name string) (*sprotoType, error) {
+	if _, ok := p.schema.types[name]; ok {
+		return nil, p.lex.errorf("redefined type %s", name)
+	}
+	st := &sprotoType{name: name}
+	p.schema.types[name] = st
+	return st, nil
+}
+
+// parseType after "."
+func (p *sprotoParser) parseType(scope string) error {
+	name := p.lex.next()
+	if name == "" || !isSprotoIdent(name[0], true) || strings.Contains(name, ".") {
+		return p.lex.errorf("invalid type name %q", name)
+	}
+	if scope != "" {
+		name = scope + "." + name
+	}
+	st, err := p.newType(name)
+	if err != nil {
+		return err
+	}
+	if err := p.lex.expect("{"); err != nil {
+		return err
+	}
+	return p.parseFields(st, name)
+}
+
+// parseFields until "}"
+func (p *sprotoParser) parseFields(st *sprotoType, scope string) error {
+	for {
+		tok := p.lex.next()
+		switch tok {
+		case "}":
+			return nil
+		case "":
+			return p.lex.errorf("unexpected EOF in type %s", st.name)
+		case ".":
+			if err := p.parseType(scope); err != nil {
+				return err
+			}
+			continue
+		}
+		f := &sprotoField{name: tok, key: -1}
+		var err error
+		if f.tag, err = p.lex.tag(); err != nil {
+			return err
+		}
+		if err = p.lex.expect(":"); err != nil {
+			return err
+		}
+		tf := &sprotoTextField{field: f, scope: scope, line: p.lex.line}
+		tok = p.lex.next()
+		if tok == "*" {
+			f.array = true
+			tok = p.lex.next()
+		}
+		tf.typeName = tok
+		if p.lex.peek() == "(" {
+			p.lex.next()
+			arg := p.lex.next()
+			if arg != ")" {
+				if err = p.lex.expect(")"); err != nil {
+					return err
+				}
+			}
+			if tok == "integer" {
+				n, err := strconv.Atoi(arg)
+				if err != nil || n <= 0 || n > 18 {
+					return p.lex.errorf("invalid decimal integer(%s)", arg)
+				}
+				f.extra = int(math.Pow10(n))
+			} else if !f.array {
+				return p.lex.errorf("main key of non array field %s", f.name)
+			} else if arg == ")" {
+				f.isMap = true
+			} else {
+				tf.keyName = arg
+			}
+		}
+		if tok == "binary" {
+			f.extra = 1
+		}
+		for _, exist := range st.fields {
+			if exist.tag == f.tag || exist.name == f.name {
+				return p.lex.errorf("redefined field %s tag %d in %s", f.name, f.tag, st.name)
+			}
+		}
+		st.fields = append(st.fields, f)
+		p.fields = append(p.fields, tf)
+	}
+}
+
+// parseProtocol name tag { request Type response Type }
+func (p *sprotoParser) parseProtocol(name string) error {
+	proto := SprotoProtocol{Name: name}
+	var err error
+	if proto.Tag, err = p.lex.tag(); err != nil {
+		return err
+	}
+	if err = p.lex.expect("{"); err != nil {
+		return err
+	}
+	for {
+		tok := p.lex.next()
+		if tok == "}" {
+			break
+		}
+		if tok != "request" && tok != "response" {
+			return p.lex.errorf("invalid protocol %s field %q", name, tok)
+		}
+		var typeName string
+		if p.lex.peek() == "{" {
+			p.lex.next()
+			typeName = name + "." + tok
+			st, err := p.newType(typeName)
+			if err != nil {
+				return err
+			}
+			if err = p.parseFields(st, typeName); err != nil {
+				return err
+			}
+		} else if typeName = p.lex.next(); typeName == "nil" {
+			typeName = ""
+		} else {
+			p.fields = append(p.fields, &sprotoTextField{typeName: typeName, line: p.lex.line})
+		}
+		if tok == "request" {
+			proto.Request = typeName
+		} else {
+			proto.Response = typeName
+		}
+	}
+	p.schema.Protocols = append(p.schema.Protocols, proto)
+	return nil
+}
+
+// resolveName search type from inner scope to outer
+func (p *sprotoParser) resolveName(scope, name string) (*sprotoType, bool) {
+	for {
+		full := name
+		if scope != "" {
+			full = scope + "." + name
+		}
+		if st, ok := p.schema.types[full]; ok {
+			return st, true
+		}
+		if scope == "" {
+			return nil, false
+		}
+		if i := strings.LastIndexByte(scope, '.'); i >= 0 {
+			scope = scope[:i]
+		} else {
+			scope = ""
+		}
+	}
+}
+
+func (p *sprotoParser) resolve() error {
+	for _, tf := range p.fields {
+		f := tf.field
+		if typ, ok := sprotoBuiltins[tf.typeName]; ok {
+			if f == nil {
+				return fmt.Errorf("sproto: line %d: protocol type must be struct, got %s", tf.line, tf.typeName)
+			}
+			f.typ = typ
+			if f.key >= 0 || f.isMap || tf.keyName != "" {
+				return fmt.Errorf("sproto: line %d: main key of builtin type array %s", tf.line, f.name)
+			}
+			continue
+		}
+		st, ok := p.resolveName(tf.scope, tf.typeName)
+		if !ok {
+			return fmt.Errorf("sproto: line %d: undefined type %s", tf.line, tf.typeName)
+		}
+		if f == nil {
+			continue
+		}
+		f.typ, f.st = sprotoStruct, st
+		if tf.keyName != "" {
+			for _, kf := range st.fields {
+				if kf.name == tf.keyName {
+					f.key = kf.tag
+				}
+			}
+			if f.key < 0 {
+				return fmt.Errorf("sproto: line %d: main key %s not found in %s", tf.line, tf.keyName, st.name)
+			}
+		}
+	}
+	// field types of array keys are resolved after all fields
+	for _, tf := range p.fields {
+		f := tf.field
+		if f == nil {
+			continue
+		}
+		if f.key >= 0 {
+			if kf := f.st.field(f.key); kf.array || kf.typ > sprotoString {
+				return fmt.Errorf("sproto: line %d: main key %s must be integer, boolean or string", tf.line, kf.name)
+			}
+		}
+		if f.isMap && len(f.st.fields) != 2 {
+			return fmt.Errorf("sproto: line %d: map %s need two fields struct", tf.line, f.name)
+		}
+	}
+	for _, st := range p.schema.types {
+		sort.Slice(st.fields, func(i, j int) bool { return st.fields[i].tag < st.fields[j].tag })
+	}
+	return nil
+}
+
+/* ---------------- compiled bundle ---------------- */
+
+// meta schema of sprotoparser.dump output
+type sprotoMetaField struct {
+	Name    string `sproto:"name"`
+	Buildin *int   `sproto:"buildin"`
+	Type    *int   `sproto:"type"`
+	Tag     int    `sproto:"tag"`
+	Array   bool   `sproto:"array"`
+	Key     *int   `sproto:"key"`
+	Map     bool   `sproto:"map"`
+}
+
+type sprotoMetaType struct {
+	Name   string            `sproto:"name"`
+	Fields []sprotoMetaField `sproto:"fields"`
+}
+
+type sprotoMetaProtocol struct {
+	Name     string `sproto:"name"`
+	Tag      int    `sproto:"tag"`
+	Request  *int   `sproto:"request"`
+	Response *int   `sproto:"response"`
+}
+
+type sprotoMetaGroup struct {
+	Type     []sprotoMetaType     `sproto:"type"`
+	Protocol []sprotoMetaProtocol `sproto:"protocol"`
+}
+
+var sprotoMetaSchema = func() *SprotoSchema {
+	s, err := ParseSproto(`
+.type {
+	.field {
+		name 0 : string
+		buildin 1 : integer
+		type 2 : integer
+		tag 3 : integer
+		array 4 : boolean
+		key 5 : integer
+		map 6 : boolean
+	}
+	name 0 : string
+	fields 1 : *field
+}
+.protocol {
+	name 0 : string
+	tag 1 : integer
+	request 2 : integer
+	response 3 : integer
+	confirm 4 : boolean
+}
+.group {
+	type 0 : *type
+	protocol 1 : *protocol
+}`)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}()
+
+// ParseSprotoBundle parse compiled sproto schema (sprotoparser.dump / sprotodump -spb output)
+func ParseSprotoBundle(data []byte) (*SprotoSchema, error) {
+	var group sprotoMetaGroup
+	if err := decodeSproto(sprotoMetaSchema.types["group"], data, &group); err != nil {
+		return nil, fmt.Errorf("sproto: invalid bundle: %w", err)
+	}
+	schema := &SprotoSchema{types: map[string]*sprotoType{}}
+	types := make([]*sprotoType, len(group.Type))
+	for i, mt := range group.Type {
+		types[i] = &sprotoType{name: mt.Name}
+		schema.types[mt.Name] = types[i]
+	}
+	typeAt := func(i *int) (*sprotoType, error) {
+		if i == nil {
+			return nil, nil
+		}
+		if *i < 0 || *i >= len(types) {
+			return nil, fmt.Errorf("sproto: invalid bundle: type index %d out of range", *i)
+		}
+		return types[*i], nil
+	}
+	for i, mt := range group.Type {
+		st := types[i]
+		for _, mf := range mt.Fields {
+			f := &sprotoField{name: mf.Name, tag: mf.Tag, array: mf.Array, key: -1, isMap: mf.Map}
+			if mf.Buildin != nil {
+				f.typ = *mf.Buildin
+				if f.typ < sprotoInteger || f.typ > sprotoDouble {
+					return nil, fmt.Errorf("sproto: invalid bundle: field %s.%s buildin %d", st.name, f.name, f.typ)
+				}
+				if mf.Type != nil {
+					f.extra = *mf.Type
+				}
+			} else {
+				var err error
+				f.typ = sprotoStruct
+				if f.st, err = typeAt(mf.Type); err != nil {
+					return nil, err
+				}
+				if f.st == nil {
+					return nil, fmt.Errorf("sproto: invalid bundle: field %s.%s without type", st.name, f.name)
+				}
+				if mf.Key != nil {
+					f.key = *mf.Key
+				}
+			}
+			st.fields = append(st.fields, f)
+		}
+		sort.Slice(st.fields, func(i, j int) bool { return st.fields[i].tag < st.fields[j].tag })
+	}
+	for _, mp := range group.Protocol {
+		proto := SprotoProtocol{Name: mp.Name, Tag: mp.Tag}
+		req, err := typeAt(mp.Request)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := typeAt(mp.Response)
+		if err != nil {
+			return nil, err
+		}
+		if req != nil {
+			proto.Request = req.name
+		}
+		if resp != nil {
+			proto.Response = resp.name
+		}
+		schema.Protocols = append(schema.Protocols, proto)
+	}
+	return schema, nil
+}
+
+var errSprotoTruncated = errors.New("sproto: truncated data")
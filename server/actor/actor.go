@@ -0,0 +1,278 @@
+/*
+Package actor stateful services like skynet per-entity services. eg: one actor per guild or match.
+
+Actors are spawned on demand by id and passivated after idle. Messages of an actor run in order in its own goroutine.
+Skynet calls them as a normal service with the id in the payload, routed by server.Dispatcher:
+
+	type Guild struct {
+		id      string
+		members []string
+	}
+
+	func (g *Guild) Load(id string) error { ... }
+	func (g *Guild) Save(id string) error { ... }
+	func (g *Guild) Join(ctx *server.SkynetContext, req *JoinReq) (*JoinRsp, error) { ... }
+
+	actor.Register("guild", func(id string) any { return &Guild{id: id} }, actor.WithIdleTimeout(10*time.Minute))
+
+	-- lua
+	cluster.call("golang", "guild", "Join", {id = 1001, uid = 1})
+*/
+package actor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/changlongH/srpc/server"
+)
+
+type (
+	// Loader load state of actor when spawned. Messages fail if load failed
+	Loader interface {
+		Load(id string) error
+	}
+
+	// Saver save state of actor before passivation
+	Saver interface {
+		Save(id string) error
+	}
+
+	// System actors of a registered service
+	System struct {
+		name     string
+		newActor func(id string) any
+		Options  Options
+
+		mu      sync.Mutex // protects actors and actorRef pending
+		actors  map[string]*actorRef
+		stopped bool
+		stopCh  chan struct{}
+		wg      sync.WaitGroup
+	}
+
+	actorRef struct {
+		sys     *System
+		id      string
+		rcvr    any
+		mailbox chan func()
+		pending int  // messages posted but not done
+		removed bool // passivated or stopped. never receive new message
+		loadErr error
+	}
+)
+
+var (
+	ErrStopped     = errors.New("actor system stopped")
+	ErrNoID        = errors.New("actor id not found in request")
+	ErrMailboxFull = errors.New("actor mailbox full")
+)
+
+/*
+Register service name with actors created by newActor. Actor methods follow server.Register rules.
+The service use keyed dispatch by actor id, so requests of an actor are ordered.
+Dispatch queues hand requests to actor mailboxes without waiting, so a slow actor never blocks others.
+Requests to an actor with full mailbox fail with ErrMailboxFull.
+*/
+func Register(name string, newActor func(id string) any, opts ...Option) (*System, error) {
+	options := Options{
+		IdleTimeout: 5 * time.Minute,
+		MailboxSize: 64,
+		Shards:      64,
+		IDFunc:      DefaultIDFunc,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.MailboxSize <= 0 {
+		options.MailboxSize = 1
+	}
+	sys := &System{
+		name:     name,
+		newActor: newActor,
+		Options:  options,
+		actors:   make(map[string]*actorRef),
+		stopCh:   make(chan struct{}),
+	}
+
+	svcOpts := append([]server.Option{}, options.SvcOpts...)
+	svcOpts = append(svcOpts,
+		server.WithKeyedDispatch(options.Shards, server.KeyFunc(options.IDFunc)),
+		server.WithInterceptor(sys.intercept),
+	)
+	// prototype for methods reflection. it's never called
+	if err := server.Register(newActor(""), name, svcOpts...); err != nil {
+		return nil, err
+	}
+	return sys, nil
+}
+
+// Count living actors
+func (sys *System) Count() int {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	return len(sys.actors)
+}
+
+// Tell run fn in the actor goroutine. It spawns actor if not exist. ErrMailboxFull if the mailbox is full
+func (sys *System) Tell(id string, fn func(rcvr any)) error {
+	return sys.post(id, func(ref *actorRef) {
+		if ref.loadErr == nil {
+			fn(ref.rcvr)
+		}
+	})
+}
+
+// Stop passivate all actors and waits for them saved. Requests after stop fail with ErrStopped
+func (sys *System) Stop() {
+	sys.mu.Lock()
+	if !sys.stopped {
+		sys.stopped = true
+		close(sys.stopCh)
+	}
+	sys.mu.Unlock()
+	sys.wg.Wait()
+}
+
+func (sys *System) intercept(ctx *server.SkynetContext, info *server.MethodInfo, req any, next server.Handler) (any, error) {
+	id := sys.Options.IDFunc(ctx, req)
+	if id == "" {
+		return nil, fmt.Errorf("%w: %s.%s", ErrNoID, info.Service, info.Method)
+	}
+
+	// the shard goroutine never waits for the actor. reply from the actor goroutine, push has no reply
+	respond := ctx.Defer()
+	err := sys.post(id, func(ref *actorRef) {
+		var reply any
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("[panic] actor %s[%s].%s err=%v", sys.name, id, info.Method, r)
+				err = fmt.Errorf("[panic] actor=%s[%s].%s err=%v", sys.name, id, info.Method, r)
+			}
+			respond(reply, err)
+		}()
+		if ref.loadErr != nil {
+			err = ref.loadErr
+			return
+		}
+		reply, err = info.Invoke(ref.rcvr, ctx, req)
+	})
+	if err != nil {
+		respond(nil, err)
+	}
+	return nil, nil
+}
+
+// post message to actor mailbox without waiting. spawn actor if not exist
+func (sys *System) post(id string, job func(ref *actorRef)) error {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	if sys.stopped {
+		return ErrStopped
+	}
+	ref := sys.actors[id]
+	if ref == nil {
+		ref = &actorRef{
+			sys:     sys,
+			id:      id,
+			rcvr:    sys.newActor(id),
+			mailbox: make(chan func(), sys.Options.MailboxSize),
+		}
+		sys.actors[id] = ref
+		sys.wg.Add(1)
+		go ref.loop()
+	}
+	// never blocks. the actor counts the message done with sys.mu held, so pending is increased in time
+	select {
+	case ref.mailbox <- func() { job(ref) }:
+		ref.pending++
+		return nil
+	default:
+		return fmt.Errorf("%w: %s[%s]", ErrMailboxFull, sys.name, id)
+	}
+}
+
+func (ref *actorRef) loop() {
+	sys := ref.sys
+	defer sys.wg.Done()
+
+	if loader, ok := ref.rcvr.(Loader); ok {
+		if err := loader.Load(ref.id); err != nil {
+			ref.loadErr = fmt.Errorf("actor %s[%s] load failed. %w", sys.name, ref.id, err)
+			// next message spawn a new one
+			if ref.passivate() {
+				return
+			}
+		}
+	}
+
+	// timer is only reset after fired. it fires again if the actor isn't idle long enough
+	timer := time.NewTimer(sys.Options.IdleTimeout)
+	defer timer.Stop()
+	lastActive := time.Now()
+	stopCh := sys.stopCh
+	for {
+		select {
+		case job := <-ref.mailbox:
+			job()
+			if ref.done() {
+				ref.save()
+				return
+			}
+			lastActive = time.Now()
+		case <-timer.C:
+			if idle := time.Since(lastActive); idle < sys.Options.IdleTimeout {
+				timer.Reset(sys.Options.IdleTimeout - idle)
+				continue
+			}
+			if ref.passivate() {
+				ref.save()
+				return
+			}
+		case <-stopCh:
+			stopCh = nil
+			if ref.passivate() {
+				ref.save()
+				return
+			}
+		}
+	}
+}
+
+// passivate remove from system. returns true if no pending message
+func (ref *actorRef) passivate() bool {
+	sys := ref.sys
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	if !ref.removed {
+		ref.removed = true
+		if sys.actors[ref.id] == ref {
+			delete(sys.actors, ref.id)
+		}
+	}
+	return ref.pending == 0
+}
+
+// done one message. returns true if removed and no pending message
+func (ref *actorRef) done() bool {
+	sys := ref.sys
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	ref.pending--
+	return ref.removed && ref.pending == 0
+}
+
+func (ref *actorRef) save() {
+	if ref.loadErr != nil {
+		return
+	}
+	if saver, ok := ref.rcvr.(Saver); ok {
+		if err := saver.Save(ref.id); err != nil {
+			log.Printf("actor %s[%s] save failed. %s", ref.sys.name, ref.id, err.Error())
+		}
+	}
+}
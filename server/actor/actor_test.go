@@ -0,0 +1,212 @@
+package actor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	payloadcodec "github.com/changlongH/srpc/payload_codec"
+	"github.com/changlongH/srpc/server"
+)
+
+type Req struct {
+	Id string
+	N  int
+}
+
+type hooks struct {
+	mu       sync.Mutex
+	failLoad map[string]bool // fail the first load of id
+	loads    atomic.Int32
+	saved    chan string // id:nums
+}
+
+// Counter records nums in order
+type Counter struct {
+	hooks *hooks
+	nums  []int
+}
+
+func (c *Counter) Load(id string) error {
+	c.hooks.loads.Add(1)
+	c.hooks.mu.Lock()
+	defer c.hooks.mu.Unlock()
+	if c.hooks.failLoad[id] {
+		delete(c.hooks.failLoad, id)
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (c *Counter) Save(id string) error {
+	c.hooks.saved <- fmt.Sprintf("%s:%v", id, c.nums)
+	return nil
+}
+
+func (c *Counter) Add(ctx *server.SkynetContext, req *Req) (*[]int, error) {
+	c.nums = append(c.nums, req.N)
+	return &c.nums, nil
+}
+
+var services atomic.Int32
+
+// register counter actors with a unique service name
+func register(t *testing.T, opts ...Option) (*System, string, *hooks) {
+	t.Helper()
+	h := &hooks{failLoad: map[string]bool{}, saved: make(chan string, 16)}
+	name := fmt.Sprintf("counter%d", services.Add(1))
+	sys, err := Register(name, func(id string) any {
+		return &Counter{hooks: h}
+	}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sys.Stop)
+	return sys, name, h
+}
+
+func add(name string, id string, n int) ([]int, error) {
+	data, err := payloadcodec.MsgPack{}.Marshal(&Req{Id: id, N: n})
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := server.GetDispatcher().DispatchReq(name, "Add", data, false)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	err = payloadcodec.MsgPack{}.Unmarshal(rsp, &nums)
+	return nums, err
+}
+
+func waitSaved(t *testing.T, h *hooks) string {
+	t.Helper()
+	select {
+	case s := <-h.saved:
+		return s
+	case <-time.After(3 * time.Second):
+		t.Fatal("save timeout")
+	}
+	return ""
+}
+
+func TestSpawnOnDemand(t *testing.T) {
+	sys, name, _ := register(t)
+	if sys.Count() != 0 {
+		t.Fatalf("actors spawned before request %d", sys.Count())
+	}
+	for _, id := range []string{"1", "2", "1"} {
+		if _, err := add(name, id, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sys.Count() != 2 {
+		t.Fatalf("expect 2 actors got %d", sys.Count())
+	}
+	if _, err := server.GetDispatcher().DispatchReq(name, "Add", nil, false); !errors.Is(err, ErrNoID) {
+		t.Fatalf("expect no id got %v", err)
+	}
+}
+
+func TestOrdering(t *testing.T) {
+	sys, name, _ := register(t)
+	for n := range 50 {
+		if err := sys.Tell("1", func(rcvr any) {
+			c := rcvr.(*Counter)
+			c.nums = append(c.nums, n)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nums, err := add(name, "1", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range nums {
+		if i != n {
+			t.Fatalf("out of order %v", nums)
+		}
+	}
+	if len(nums) != 51 {
+		t.Fatalf("lost messages %v", nums)
+	}
+}
+
+func TestIdlePassivation(t *testing.T) {
+	sys, name, h := register(t, WithIdleTimeout(20*time.Millisecond))
+	if _, err := add(name, "1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if s := waitSaved(t, h); s != "1:[1]" || sys.Count() != 0 {
+		t.Fatalf("passivation saved %s count %d", s, sys.Count())
+	}
+	// spawned again with new state
+	if nums, err := add(name, "1", 2); err != nil || fmt.Sprint(nums) != "[2]" {
+		t.Fatalf("respawn %v %v", nums, err)
+	}
+}
+
+func TestLoadFailedRespawn(t *testing.T) {
+	sys, name, h := register(t)
+	h.failLoad["1"] = true
+	if _, err := add(name, "1", 1); err == nil {
+		t.Fatal("expect load failed")
+	}
+	if sys.Count() != 0 {
+		t.Fatalf("failed actor kept %d", sys.Count())
+	}
+	if nums, err := add(name, "1", 2); err != nil || fmt.Sprint(nums) != "[2]" || h.loads.Load() != 2 {
+		t.Fatalf("respawn after load failed %v %v loads %d", nums, err, h.loads.Load())
+	}
+}
+
+func TestSaveOnStop(t *testing.T) {
+	sys, name, h := register(t)
+	for _, id := range []string{"1", "2"} {
+		if _, err := add(name, id, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sys.Stop()
+	saved := map[string]bool{}
+	for range 2 {
+		saved[waitSaved(t, h)] = true
+	}
+	if !saved["1:[1]"] || !saved["2:[1]"] || sys.Count() != 0 {
+		t.Fatalf("stop saved %v count %d", saved, sys.Count())
+	}
+	if _, err := add(name, "1", 1); !errors.Is(err, ErrStopped) {
+		t.Fatalf("expect stopped got %v", err)
+	}
+}
+
+func TestMailboxFull(t *testing.T) {
+	sys, name, _ := register(t, WithMailboxSize(1))
+	hold, started := make(chan struct{}), make(chan struct{})
+	if err := sys.Tell("1", func(any) {
+		close(started)
+		<-hold
+	}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	drained := make(chan struct{})
+	if err := sys.Tell("1", func(any) { close(drained) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := add(name, "1", 1); !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("expect mailbox full got %v", err)
+	}
+	// other actors are not affected
+	if _, err := add(name, "2", 1); err != nil {
+		t.Fatal(err)
+	}
+	close(hold)
+	<-drained
+	if nums, err := add(name, "1", 2); err != nil || fmt.Sprint(nums) != "[2]" {
+		t.Fatalf("after mailbox drained %v %v", nums, err)
+	}
+}
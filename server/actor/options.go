@@ -0,0 +1,111 @@
+package actor
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/changlongH/srpc/server"
+)
+
+// IDFunc extract actor id from decoded req. Empty if not found
+type IDFunc func(ctx *server.SkynetContext, req any) string
+
+type Options struct {
+	IdleTimeout time.Duration // passivate actor after idle
+	MailboxSize int
+	Shards      int // keyed dispatch shards
+	IDFunc      IDFunc
+	SvcOpts     []server.Option
+}
+
+type Option func(*Options)
+
+// WithIdleTimeout passivate actor after idle timeout. Saver.Save is called before passivation. Default 5 minutes
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.IdleTimeout = timeout
+	}
+}
+
+// WithMailboxSize buffered messages of each actor, at least 1. Messages to the full mailbox fail with ErrMailboxFull. Default 64
+func WithMailboxSize(size int) Option {
+	return func(o *Options) {
+		o.MailboxSize = size
+	}
+}
+
+// WithShards ordered dispatch queues of the service. Default 64
+func WithShards(shards int) Option {
+	return func(o *Options) {
+		o.Shards = shards
+	}
+}
+
+// WithIDFunc custom actor id extractor. Default is DefaultIDFunc
+func WithIDFunc(fn IDFunc) Option {
+	return func(o *Options) {
+		o.IDFunc = fn
+	}
+}
+
+// WithServiceOptions options of the registered service. eg: server.WithPayloadCodec
+func WithServiceOptions(opts ...server.Option) Option {
+	return func(o *Options) {
+		o.SvcOpts = append(o.SvcOpts, opts...)
+	}
+}
+
+/*
+DefaultIDFunc id field of the first arg.
+
+  - struct field with tag `actor:"id"`, otherwise field named Id or ID
+  - string or integer arg itself. eg: cluster.call(node, "guild", "Join", guildId, ...) with luaseri
+*/
+func DefaultIDFunc(ctx *server.SkynetContext, req any) string {
+	if args, ok := req.([]any); ok {
+		if len(args) == 0 {
+			return ""
+		}
+		req = args[0]
+	}
+	val := reflect.ValueOf(req)
+	for val.Kind() == reflect.Pointer {
+		if val.IsNil() {
+			return ""
+		}
+		val = val.Elem()
+	}
+
+	switch val.Kind() {
+	case reflect.String:
+		return val.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprint(val.Interface())
+	case reflect.Struct:
+	default:
+		return ""
+	}
+
+	typ := val.Type()
+	index := -1
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if tag, _, _ := strings.Cut(field.Tag.Get("actor"), ","); tag == "id" {
+			index = i
+			break
+		}
+		if index < 0 && (field.Name == "Id" || field.Name == "ID") {
+			index = i
+		}
+	}
+	if index < 0 {
+		return ""
+	}
+	return fmt.Sprint(val.Field(index).Interface())
+}
@@ -3,18 +3,23 @@ package server
 import (
 	"context"
 	"errors"
-	"fmt"
 	"go/token"
 	"log"
 	"reflect"
 	"sync"
-	"time"
+	"sync/atomic"
+
+	"github.com/changlongH/srpc/codec"
 )
 
 type (
 	// dispatcher represents an RPC disoatcher.
 	Dispatcher struct {
 		serviceMap sync.Map // map[string]*service
+
+		sync.Mutex                               // protects interceptors
+		interceptors []Interceptor               // global interceptors
+		interceptor  atomic.Pointer[Interceptor] // chained interceptors
 	}
 )
 
@@ -47,31 +52,32 @@ func (disp *Dispatcher) DispatchReq(sname string, methodName string, data []byte
 	}
 
 	svc := svci.(*service)
-	mtype := svc.method[methodName]
-	if mtype == nil {
-		return nil, fmt.Errorf("not find method (%s.%s)", sname, methodName)
+	type result struct {
+		data []byte
+		err  error
 	}
-
-	startTime := time.Now()
-	ctx := NewSkynetContext(context.Background())
-	replyData, err := svc.call(mtype, ctx, data, isPush)
-	if svc.Options.AccessHdle != nil {
-		svc.Options.AccessHdle(ctx, sname, methodName, time.Since(startTime), err)
-	}
-	return replyData, err
+	done := make(chan result, 1)
+	svc.dispatch(NewSkynetContext(context.Background()), methodName, data, isPush, func(data []byte, err error) {
+		done <- result{data, err}
+	})
+	res := <-done
+	return res.data, res.err
 }
 
 // Register publishes uses the provided name in the dispatcher the set of methods of the
 // receiver value that satisfy the following conditions:
 //   - exported method of exported type
-//   - two arguments, both of exported type
-//   - the second argument is a pointer
-//   - one return value, of type error
+//   - the first argument is *SkynetContext
+//   - any number of other arguments of exported or builtin type, need not be pointers
+//   - returns (*reply, error), (*reply), (error), nothing or (reply1, reply2, ..., error), error is optional
+//   - a single reply is a pointer unless the payload codec is a codec.MultiPayloadCodec
 //
+// More than one argument or reply needs a codec.MultiPayloadCodec like luaseri, such methods are
+// skipped and logged with other payload codecs.
 // It returns an error if the receiver is not an exported type or has
 // no suitable methods. It also logs the error using package log.
-// The client accesses each method using a string of the form "Type.Method",
-// where Type is the receiver's concrete type.
+// Skynet calls each method by the service name and the method name. The name is the
+// receiver's concrete type name if empty.
 func Register(rcvr any, name string, opts ...Option) error {
 	s := NewService(opts...)
 	s.typ = reflect.TypeOf(rcvr)
@@ -88,12 +94,31 @@ func Register(rcvr any, name string, opts ...Option) error {
 
 	logErr := false
 	// Install the methods
-	s.method = suitableMethods(s.typ, logErr)
+	_, multi := s.Options.PayloadCodec.(codec.MultiPayloadCodec)
+	s.method = suitableMethods(s.typ, multi, logErr)
+	for mname, mtype := range s.method {
+		mtype.info = &MethodInfo{
+			Service:    name,
+			Method:     mname,
+			ArgTypes:   mtype.ArgTypes,
+			ReplyTypes: mtype.ReplyTypes,
+			rcvrType:   s.typ,
+			mtype:      mtype,
+		}
+	}
+	if !multi {
+		for mname, mtype := range s.method {
+			if mtype.isMulti() {
+				log.Printf("rpc.Register: method %q has multi args or replies, needs a multi payload codec like luaseri\n", mname)
+				delete(s.method, mname)
+			}
+		}
+	}
 
 	if len(s.method) == 0 {
 		str := ""
 		// To help the user, see if a pointer receiver would work.
-		method := suitableMethods(reflect.PointerTo(s.typ), false)
+		method := suitableMethods(reflect.PointerTo(s.typ), multi, false)
 		if len(method) != 0 {
 			str = "rpc.Register: type " + name + " has no exported methods of suitable type (hint: pass a pointer to value of that type)"
 		} else {
@@ -107,9 +132,7 @@ func Register(rcvr any, name string, opts ...Option) error {
 	if _, dup := disp.serviceMap.LoadOrStore(name, s); dup {
 		return errors.New("rpc: service already defined: " + name)
 	}
-	if s.Options.SyncDisptch {
-		go s.processMsgQueue()
-	}
+	s.startDispatchQueues()
 	return nil
 }
 
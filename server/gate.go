@@ -6,12 +6,15 @@ import (
 	"log"
 	"time"
 
+	"github.com/changlongH/srpc/codec"
 	"github.com/cloudwego/netpoll"
 )
 
 type Gate struct {
 	listener  netpoll.Listener
 	eventLoop netpoll.EventLoop
+	pool      *WorkerPool
+	limits    *codec.Limits
 }
 type connkey struct{}
 
@@ -21,12 +24,15 @@ const (
 
 var ctxkey connkey
 
-var _ netpoll.OnPrepare = prepare
 var _ netpoll.OnConnect = connect
 var _ netpoll.OnRequest = handle
 
-func prepare(conn netpoll.Connection) context.Context {
+func (gate *Gate) prepare(conn netpoll.Connection) context.Context {
 	agent := NewGateAgent(conn)
+	agent.pool = gate.pool
+	if gate.limits != nil {
+		agent.limits = *gate.limits
+	}
 	ctx := context.WithValue(context.Background(), ctxkey, agent)
 	return ctx
 }
@@ -64,8 +70,11 @@ func NewGate(address string, ops ...netpoll.Option) (*Gate, error) {
 		return nil, err
 	}
 
+	gate := &Gate{
+		listener: listener,
+	}
 	ops = append(ops,
-		netpoll.WithOnPrepare(prepare),
+		netpoll.WithOnPrepare(gate.prepare),
 		netpoll.WithOnConnect(connect),
 		//netpoll.WithReadTimeout(time.Second),
 	)
@@ -74,13 +83,22 @@ func NewGate(address string, ops ...netpoll.Option) (*Gate, error) {
 	if err != nil {
 		return nil, err
 	}
-	gate := &Gate{
-		listener:  listener,
-		eventLoop: eventLoop,
-	}
+	gate.eventLoop = eventLoop
 	return gate, nil
 }
 
+// SetWorkerPool async dispatch of gate connections run in pool unless the service has its own pool.
+// Must be called before Start
+func (gate *Gate) SetWorkerPool(pool *WorkerPool) {
+	gate.pool = pool
+}
+
+// SetLimits limits of gate connections. Default codec.DefaultLimits.
+// The connection violate the limits will be closed. Must be called before Start
+func (gate *Gate) SetLimits(limits codec.Limits) {
+	gate.limits = &limits
+}
+
 /*
 Serve registers a listener and runs blockingly to provide services,
 including listening to ports, accepting connections and processing trans data.
@@ -1,10 +1,12 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"runtime"
+	"time"
 
 	"github.com/changlongH/srpc/codec"
 	"github.com/cloudwego/netpoll"
@@ -13,6 +15,10 @@ import (
 
 type (
 	GateAgent struct {
+		ctx    context.Context // canceled when connection closed
+		cancel context.CancelFunc
+		pool   *WorkerPool // gate worker pool. nil if unbounded
+		limits codec.Limits
 		conn   netpoll.Connection
 		wqueue *mux.ShardQueue     // use for write
 		Reader chan netpoll.Reader // use for reader socket data
@@ -33,8 +39,12 @@ func SetRecoveryHandler(handle func(string, any)) {
 }
 
 func NewGateAgent(conn netpoll.Connection) *GateAgent {
+	ctx, cancel := context.WithCancel(context.Background())
 	agent := &GateAgent{
+		ctx:    ctx,
+		cancel: cancel,
 		conn:   conn,
+		limits: codec.DefaultLimits,
 		wqueue: mux.NewShardQueue(mux.ShardSize, conn),
 		Reader: make(chan netpoll.Reader, 1000),
 	}
@@ -55,6 +65,7 @@ func (agent *GateAgent) Start() {
 	agent.conn.AddCloseCallback(func(conn netpoll.Connection) error {
 		log.Printf("close connect %s\n", conn.RemoteAddr().String())
 		close(closeCh)
+		agent.cancel()
 		agent.wqueue = nil
 		return nil
 	})
@@ -62,18 +73,57 @@ func (agent *GateAgent) Start() {
 	var pendingReqPack = make(map[uint32]*codec.ReqPack)
 	var err error
 	var req *codec.ReqPack
+	var traceTag string // skynet trace tag for next request
+	var violated bool   // peer violate the limits, connection is closing
+
+	// discard partial requests
+	var expireCh <-chan time.Time
+	if timeout := agent.limits.PendingTimeout; timeout > 0 {
+		ticker := time.NewTicker(max(timeout/2, time.Second))
+		defer ticker.Stop()
+		expireCh = ticker.C
+	}
 	for {
 		select {
 		case r := <-agent.Reader:
-			if req, err = codec.DecodeReq(r, pendingReqPack); err != nil {
+			if violated {
+				// drop until closed
+				r.Release()
+				continue
+			}
+			if req, err = codec.DecodeReqWithLimits(r, pendingReqPack, agent.limits); err != nil {
 				if req != nil && !req.IsPush() {
 					agent.ResponseErr(req.Session, err)
 				}
+				if errors.Is(err, codec.ErrLimitExceeded) {
+					log.Printf("close connect %s. %s", agent.conn.RemoteAddr().String(), err.Error())
+					// close after response sent
+					time.AfterFunc(time.Second, func() {
+						agent.conn.Close()
+					})
+					violated = true
+				}
 				continue
 			}
 
-			if req != nil {
-				agent.Dispatch(req)
+			if req == nil {
+				continue
+			}
+			if req.IsTrace() {
+				traceTag = req.Trace
+				continue
+			}
+			if len(traceTag) > 0 {
+				req.Trace = traceTag
+				traceTag = ""
+			}
+			agent.Dispatch(req)
+		case <-expireCh:
+			for _, req := range codec.ExpirePendingReq(pendingReqPack, agent.limits.PendingTimeout) {
+				log.Printf("discard partial request %s session=%d from %s", req.Addr.String(), req.Session, agent.conn.RemoteAddr().String())
+				if !req.IsPush() {
+					agent.ResponseErr(req.Session, fmt.Errorf("partial request timeout %s", agent.limits.PendingTimeout))
+				}
 			}
 		case <-closeCh:
 			// conn close can't respone
@@ -104,7 +154,7 @@ func (agent *GateAgent) response(session uint32, ok bool, payload []byte) {
 }
 
 func (agent *GateAgent) ResponseErr(session uint32, err error) {
-	agent.response(session, false, []byte(err.Error()))
+	agent.response(session, false, codec.EncodeError(err))
 }
 
 func (agent *GateAgent) ResponseOk(session uint32, payload []byte) {
@@ -121,42 +171,111 @@ func (agent *GateAgent) Dispatch(req *codec.ReqPack) {
 		return
 	}
 
+	if svc.Options.KeyFunc != nil {
+		agent.dispatchKeyed(svc, req)
+		return
+	}
 	if svc.Options.SyncDisptch {
 		svc.pushMsgToDispatchQueue(agent, req)
-	} else {
-		go agent.callServiceMethod(svc, req.Method, req.Session, req.Payload, req.Push)
+		return
+	}
+
+	// service pool first
+	pool := svc.Options.WorkerPool
+	if pool == nil {
+		pool = agent.pool
+	}
+	if pool == nil {
+		go agent.callServiceMethod(svc, req)
+		return
+	}
+	err := pool.Submit(func() {
+		agent.callServiceMethod(svc, req)
+	}, req.IsPush())
+	if err != nil && !req.IsPush() {
+		agent.ResponseErr(req.Session, fmt.Errorf("%w: call=%s.%s", err, sname, req.Method))
 	}
 }
 
-func (agent *GateAgent) callServiceMethod(svc *service, method string, session uint32, payload []byte, isPush bool) {
-	var sname = svc.name
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("[panic] call %s %s.%s err=%v", agent.conn.RemoteAddr().String(), sname, method, err)
-			if !isPush {
-				agent.ResponseErr(session, fmt.Errorf("[panic] call=%s.%s err=%v", sname, method, err))
-			}
-			recoveryHandle(agent.conn.RemoteAddr().String(), fmt.Errorf("[dipacth panic] [%s.%s] %v", sname, method, err))
-			return
+// recoverCall recover panic of dispatching req. reply error if not push
+func (agent *GateAgent) recoverCall(sname string, req *codec.ReqPack) {
+	if err := recover(); err != nil {
+		var method, session = req.Method, req.Session
+		log.Printf("[panic] call %s %s.%s err=%v", agent.conn.RemoteAddr().String(), sname, method, err)
+		if !req.Push {
+			agent.ResponseErr(session, fmt.Errorf("[panic] call=%s.%s err=%v", sname, method, err))
 		}
-	}()
+		recoveryHandle(agent.conn.RemoteAddr().String(), fmt.Errorf("[dipacth panic] [%s.%s] %v", sname, method, err))
+	}
+}
 
-	//log.Printf("dispatch session=%d push=%v call=%s.%s  args=%v", req.Session, req.IsPush(), sname, method, string(req.Payload))
-	replyBytes, err := svc.dispatch(method, payload, isPush)
-	if isPush {
-		return
+// newRequest unpack payload and create context of req
+func (agent *GateAgent) newRequest(svc *service, req *codec.ReqPack) (*SkynetContext, []byte, error) {
+	payload, err := codec.UnpackPayload(svc.Options.PayloadCodec, req.Payload)
+	if err != nil {
+		return nil, nil, err
 	}
+	ctx := NewSkynetContext(agent.ctx)
+	ctx.trace = req.Trace
+	ctx.remoteAddr = agent.conn.RemoteAddr().String()
+	ctx.session = req.Session
+	return ctx, payload, nil
+}
 
+func (agent *GateAgent) reply(svc *service, req *codec.ReqPack, replyBytes []byte, err error) {
+	if req.Push {
+		return
+	}
+	session := req.Session
 	if err != nil {
 		agent.ResponseErr(session, err)
 		return
 	}
 
 	//log.Printf("reply session=%d msg=%s", req.Session, string(replyBytes))
-	buf := &bytes.Buffer{}
-	if err := codec.WriteStringToBuf(buf, replyBytes); err != nil {
+	if replyBytes, err = codec.PackPayload(svc.Options.PayloadCodec, replyBytes); err != nil {
 		agent.ResponseErr(session, err)
 	} else {
-		agent.ResponseOk(session, buf.Bytes())
+		agent.ResponseOk(session, replyBytes)
+	}
+}
+
+func (agent *GateAgent) callServiceMethod(svc *service, req *codec.ReqPack) {
+	defer agent.recoverCall(svc.name, req)
+
+	ctx, payload, err := agent.newRequest(svc, req)
+	if err != nil {
+		agent.reply(svc, req, nil, err)
+		return
+	}
+
+	//log.Printf("dispatch session=%d push=%v call=%s.%s  args=%v", req.Session, req.IsPush(), sname, method, string(req.Payload))
+	svc.dispatch(ctx, req.Method, payload, req.Push, func(replyBytes []byte, err error) {
+		agent.reply(svc, req, replyBytes, err)
+	})
+}
+
+// dispatchKeyed decode args in agent goroutine to keep order, then push to the shard queue of the key
+func (agent *GateAgent) dispatchKeyed(svc *service, req *codec.ReqPack) {
+	defer agent.recoverCall(svc.name, req)
+
+	ctx, payload, err := agent.newRequest(svc, req)
+	var call *serviceCall
+	if err == nil {
+		call, err = svc.prepareCall(ctx, req.Method, payload, req.Push)
 	}
+	if err != nil {
+		agent.reply(svc, req, nil, err)
+		return
+	}
+	key := svc.Options.KeyFunc(ctx, packValues(call.argv))
+	svc.shard(key).push(&msg{req: req, agent: agent, call: call})
+}
+
+func (agent *GateAgent) runServiceCall(svc *service, req *codec.ReqPack, call *serviceCall) {
+	defer agent.recoverCall(svc.name, req)
+
+	svc.runCall(call, func(replyBytes []byte, err error) {
+		agent.reply(svc, req, replyBytes, err)
+	})
 }
@@ -4,22 +4,35 @@ import (
 	"context"
 	"reflect"
 	"sync"
+	"time"
 )
 
 type (
 	methodType struct {
 		sync.Mutex // protects counters
 		method     reflect.Method
-		ArgType    reflect.Type
-		ReplyType  reflect.Type
+		ArgTypes   []reflect.Type
+		ReplyTypes []reflect.Type
 		errIndex   int
-		hasReply   bool
 		numCalls   uint
+		info       *MethodInfo
 	}
 
 	SkynetContext struct {
 		context.Context
-		numCall uint
+		numCall    uint
+		trace      string // skynet trace tag
+		remoteAddr string // address of the skynet node connection
+		session    uint32 // skynet session. 0 if push
+		isPush     bool
+		service    string
+		method     string
+
+		mu       sync.Mutex // protects metadata, deadlines and deferred reply
+		metadata map[string]any
+		cancels  []context.CancelFunc       // deadlines of the request
+		finish   func(reply any, err error) // complete the call. set by service
+		deferred bool
 	}
 )
 
@@ -29,11 +42,149 @@ func (m *methodType) GetCallsNum() uint {
 	return m.numCalls
 }
 
+// multi args or replies need a codec.MultiPayloadCodec
+func (m *methodType) isMulti() bool {
+	return len(m.ArgTypes) > 1 || len(m.ReplyTypes) > 1
+}
+
 func NewSkynetContext(ctx context.Context) *SkynetContext {
 	skynetCtx := &SkynetContext{Context: ctx}
 	return skynetCtx
 }
 
+// Trace skynet.trace() tag of the request. Empty if the caller not enable trace.
+// Pass it to client.Caller.WithTrace to follow the request across nodes
+func (ctx *SkynetContext) Trace() string {
+	return ctx.trace
+}
+
+// RemoteAddr address of the skynet node connection. Empty if not dispatched by gate
+func (ctx *SkynetContext) RemoteAddr() string {
+	return ctx.remoteAddr
+}
+
+// Session skynet session of the request. 0 if push
+func (ctx *SkynetContext) Session() uint32 {
+	return ctx.session
+}
+
+// IsPush the request is cluster.send, no reply
+func (ctx *SkynetContext) IsPush() bool {
+	return ctx.isPush
+}
+
+// Service name of the registered service
+func (ctx *SkynetContext) Service() string {
+	return ctx.service
+}
+
+// Method name of the called method
+func (ctx *SkynetContext) Method() string {
+	return ctx.method
+}
+
+// NumCall calls count of the method include this one
+func (ctx *SkynetContext) NumCall() uint {
+	return ctx.numCall
+}
+
+// Set metadata of the request. Interceptors can use it pass values to handlers and access log
+func (ctx *SkynetContext) Set(key string, value any) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.metadata == nil {
+		ctx.metadata = make(map[string]any)
+	}
+	ctx.metadata[key] = value
+}
+
+// Get metadata of the request
+func (ctx *SkynetContext) Get(key string) (any, bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	value, ok := ctx.metadata[key]
+	return value, ok
+}
+
+// Metadata returns a copy of all metadata
+func (ctx *SkynetContext) Metadata() map[string]any {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	metadata := make(map[string]any, len(ctx.metadata))
+	for k, v := range ctx.metadata {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+/*
+WithDeadline deadline of this request. The earlier one of it and the service timeout works, handlers get it by ctx.Deadline() and ctx.Done().
+Skynet cluster protocol doesn't carry the deadline of the caller, interceptors set it from args or metadata before calling next:
+
+	func deadline(ctx *server.SkynetContext, info *server.MethodInfo, req any, next server.Handler) (any, error) {
+		if r, ok := req.(*Req); ok && r.Deadline > 0 {
+			ctx.WithDeadline(time.UnixMilli(r.Deadline))
+		}
+		return next(ctx, req)
+	}
+*/
+func (ctx *SkynetContext) WithDeadline(d time.Time) {
+	c, cancel := context.WithDeadline(ctx.Context, d)
+	ctx.Context = c
+	ctx.mu.Lock()
+	ctx.cancels = append(ctx.cancels, cancel)
+	ctx.mu.Unlock()
+}
+
+// WithTimeout deadline of this request after timeout, see WithDeadline
+func (ctx *SkynetContext) WithTimeout(timeout time.Duration) {
+	ctx.WithDeadline(time.Now().Add(timeout))
+}
+
+// cancelDeadlines release deadlines of the request when the call ends
+func (ctx *SkynetContext) cancelDeadlines() {
+	ctx.mu.Lock()
+	cancels := ctx.cancels
+	ctx.cancels = nil
+	ctx.mu.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+/*
+Defer the reply. Results of the method and interceptors are ignored, respond must be called once later from any goroutine.
+The call ends when respond is called: access log, service timeout and reply. Respond of push request sends nothing.
+eg: server/actor runs methods in actor goroutine without blocking the dispatch queue
+
+	respond := ctx.Defer()
+	go func() {
+		respond(&Reply{}, nil)
+	}()
+	return nil, nil
+*/
+func (ctx *SkynetContext) Defer() (respond func(reply any, err error)) {
+	ctx.mu.Lock()
+	ctx.deferred = true
+	finish := ctx.finish
+	ctx.mu.Unlock()
+
+	var once sync.Once
+	return func(reply any, err error) {
+		once.Do(func() {
+			if finish != nil {
+				finish(reply, err)
+			}
+		})
+	}
+}
+
+func (ctx *SkynetContext) isDeferred() bool {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.deferred
+}
+
 /*
 func (ctx *SkynetContext) GetStages() *TraceStage {
 	v := ctx.Value(ctxStages{})
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+)
+
+type (
+	// MethodInfo the registered method being called
+	MethodInfo struct {
+		Service    string
+		Method     string
+		ArgTypes   []reflect.Type // args after *SkynetContext
+		ReplyTypes []reflect.Type // returns without error
+
+		rcvrType reflect.Type
+		mtype    *methodType
+	}
+
+	/*
+		Handler calls the method with decoded req.
+		req is nil if the method has no arg, []any if has multi args, otherwise the arg value.
+		reply in the same way as req. eg: (*Reply) or []any{a, b} for (int, string, error)
+	*/
+	Handler func(ctx *SkynetContext, req any) (any, error)
+
+	/*
+		Interceptor runs around the method. It can modify req, short-circuit with an error or wrap the call.
+
+			func timing(ctx *server.SkynetContext, info *server.MethodInfo, req any, next server.Handler) (any, error) {
+				start := time.Now()
+				reply, err := next(ctx, req)
+				log.Printf("%s.%s cost %s", info.Service, info.Method, time.Since(start))
+				return reply, err
+			}
+	*/
+	Interceptor func(ctx *SkynetContext, info *MethodInfo, req any, next Handler) (any, error)
+)
+
+// Invoke call the method on rcvr instead of the registered receiver. rcvr must be the same type.
+// It's used by stateful services like server/actor which has a receiver per entity
+func (info *MethodInfo) Invoke(rcvr any, ctx *SkynetContext, req any) (any, error) {
+	val := reflect.ValueOf(rcvr)
+	if val.Type() != info.rcvrType {
+		return nil, fmt.Errorf("invoke %s.%s receiver type %s, need %s", info.Service, info.Method, val.Type(), info.rcvrType)
+	}
+	return info.mtype.invoke(val, ctx, req)
+}
+
+// Use add global interceptors of the Dispatcher. They run before service interceptors
+func (disp *Dispatcher) Use(interceptors ...Interceptor) {
+	disp.Lock()
+	defer disp.Unlock()
+	disp.interceptors = append(disp.interceptors, interceptors...)
+	chained := chainInterceptors(disp.interceptors)
+	disp.interceptor.Store(&chained)
+}
+
+// ResetInterceptors remove all global interceptors of the Dispatcher
+func (disp *Dispatcher) ResetInterceptors() {
+	disp.Lock()
+	defer disp.Unlock()
+	disp.interceptors = nil
+	disp.interceptor.Store(nil)
+}
+
+func (disp *Dispatcher) getInterceptor() Interceptor {
+	if p := disp.interceptor.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Use add global interceptors of all services
+func Use(interceptors ...Interceptor) {
+	GetDispatcher().Use(interceptors...)
+}
+
+// ResetInterceptors remove all global interceptors
+func ResetInterceptors() {
+	GetDispatcher().ResetInterceptors()
+}
+
+// chainInterceptors first interceptor is the outer most
+func chainInterceptors(interceptors []Interceptor) Interceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(ctx *SkynetContext, info *MethodInfo, req any, next Handler) (any, error) {
+		return interceptors[0](ctx, info, req, getChainHandler(interceptors, 0, info, next))
+	}
+}
+
+func getChainHandler(interceptors []Interceptor, curr int, info *MethodInfo, final Handler) Handler {
+	if curr == len(interceptors)-1 {
+		return final
+	}
+	return func(ctx *SkynetContext, req any) (any, error) {
+		return interceptors[curr+1](ctx, info, req, getChainHandler(interceptors, curr+1, info, final))
+	}
+}
+
+// withInterceptor wrap handler with interceptor if not nil
+func withInterceptor(interceptor Interceptor, info *MethodInfo, handler Handler) Handler {
+	if interceptor == nil {
+		return handler
+	}
+	return func(ctx *SkynetContext, req any) (any, error) {
+		return interceptor(ctx, info, req, handler)
+	}
+}
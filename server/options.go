@@ -16,8 +16,16 @@ type Options struct {
 	AccessHdle      AccessHandle
 	SyncDisptch     bool
 	MonitorInterval time.Duration
+	Interceptors    []Interceptor
+	Timeout         time.Duration
+	WorkerPool      *WorkerPool
+	KeyFunc         KeyFunc
+	Shards          int
 }
 
+// KeyFunc extract the order key of request. req is decoded args like Handler
+type KeyFunc func(ctx *SkynetContext, req any) string
+
 type Option func(*Options)
 
 func WithPayloadCodec(c codec.PayloadCodec) Option {
@@ -28,7 +36,10 @@ func WithPayloadCodec(c codec.PayloadCodec) Option {
 
 func defaultAccessHandle(ctx *SkynetContext, sname string, cmd string, cost time.Duration, err error) {
 	var builder strings.Builder
-	builder.WriteString(fmt.Sprintf("access %s.%s %dms count:%d", sname, cmd, cost.Milliseconds(), ctx.numCall))
+	builder.WriteString(fmt.Sprintf("access %s %s.%s %dms count:%d", ctx.remoteAddr, sname, cmd, cost.Milliseconds(), ctx.numCall))
+	if ctx.trace != "" {
+		builder.WriteString(fmt.Sprintf(" trace=%s", ctx.trace))
+	}
 	if err != nil {
 		builder.WriteString(fmt.Sprintf(" err=%s", err.Error()))
 	}
@@ -62,3 +73,48 @@ func WithMonitorInterval(interval time.Duration) Option {
 		o.MonitorInterval = interval
 	}
 }
+
+// WithInterceptor add interceptors of the service. The first one is the outer most.
+// Global interceptors of Dispatcher.Use run before them
+func WithInterceptor(interceptors ...Interceptor) Option {
+	return func(o *Options) {
+		o.Interceptors = append(o.Interceptors, interceptors...)
+	}
+}
+
+// WithTimeout deadline of every request. Handlers get it by ctx.Deadline() and ctx.Done().
+// The method will not be interrupted, reply is sent as usual.
+// Skynet cluster protocol doesn't carry the deadline of the caller, interceptors set it per request by SkynetContext.WithDeadline
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = timeout
+	}
+}
+
+// WithWorkerPool async dispatch run in pool instead of a goroutine per request. pool can be shared by services
+func WithWorkerPool(pool *WorkerPool) Option {
+	return func(o *Options) {
+		o.WorkerPool = pool
+	}
+}
+
+/*
+WithKeyedDispatch messages of the same key run in order, different keys run in parallel.
+Requests are sharded by key onto shards ordered queues. Each shard is monitored for endless loop like WithSyncDispatch.
+
+	server.WithKeyedDispatch(64, func(ctx *server.SkynetContext, req any) string {
+		return strconv.Itoa(req.(*RoomReq).RoomId)
+	})
+*/
+func WithKeyedDispatch(shards int, keyFn KeyFunc) Option {
+	return func(o *Options) {
+		if shards <= 0 {
+			shards = 1
+		}
+		o.Shards = shards
+		o.KeyFunc = keyFn
+		if o.MonitorInterval == 0 {
+			o.MonitorInterval = 5 * time.Second
+		}
+	}
+}
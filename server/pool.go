@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// RejectPolicy what to do when all workers are busy and the queue is full
+type RejectPolicy int
+
+const (
+	RejectBlock      RejectPolicy = iota // block the gate agent until the queue has space
+	RejectReplyError                     // reply ErrServerBusy to calls and drop pushes
+	RejectDropPush                       // drop pushes and block calls
+)
+
+func (p RejectPolicy) String() string {
+	switch p {
+	case RejectBlock:
+		return "block"
+	case RejectReplyError:
+		return "reply_error"
+	case RejectDropPush:
+		return "drop_push"
+	default:
+		return fmt.Sprintf("INVALID_POLICY(%d)", int(p))
+	}
+}
+
+var ErrServerBusy = errors.New("server busy")
+
+type (
+	// WorkerPool bounded goroutines for asynchronous dispatch. It can be shared by services and gates
+	WorkerPool struct {
+		maxWorkers int32
+		queue      chan func()
+		policy     RejectPolicy
+
+		workers  atomic.Int32 // running workers
+		rejected atomic.Uint64
+	}
+
+	// WorkerPoolStat observable state of worker pool
+	WorkerPoolStat struct {
+		Workers    int // running workers
+		QueueDepth int // waiting tasks
+		Rejected   uint64
+	}
+)
+
+// NewWorkerPool maxWorkers goroutines at most, queueSize(at least 1) tasks waiting for worker.
+// Workers are started on demand and exit when idle
+func NewWorkerPool(maxWorkers int, queueSize int, policy RejectPolicy) *WorkerPool {
+	if maxWorkers <= 0 {
+		maxWorkers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	return &WorkerPool{
+		maxWorkers: int32(maxWorkers),
+		queue:      make(chan func(), queueSize),
+		policy:     policy,
+	}
+}
+
+// QueueDepth tasks waiting for worker
+func (p *WorkerPool) QueueDepth() int {
+	return len(p.queue)
+}
+
+func (p *WorkerPool) Stat() WorkerPoolStat {
+	return WorkerPoolStat{
+		Workers:    int(p.workers.Load()),
+		QueueDepth: len(p.queue),
+		Rejected:   p.rejected.Load(),
+	}
+}
+
+// Submit run task by worker. Returns ErrServerBusy if rejected by policy
+func (p *WorkerPool) Submit(task func(), isPush bool) error {
+	if p.workers.Add(1) <= p.maxWorkers {
+		go p.worker(task)
+		return nil
+	}
+	p.workers.Add(-1)
+
+	select {
+	case p.queue <- task:
+	default:
+		switch {
+		case p.policy == RejectReplyError, p.policy == RejectDropPush && isPush:
+			p.rejected.Add(1)
+			return ErrServerBusy
+		}
+		p.queue <- task
+	}
+	// all workers maybe exited before the task queued
+	if p.workers.Add(1) <= p.maxWorkers {
+		go p.worker(nil)
+	} else {
+		p.workers.Add(-1)
+	}
+	return nil
+}
+
+func (p *WorkerPool) worker(task func()) {
+	for {
+		if task != nil {
+			task()
+		}
+		select {
+		case task = <-p.queue:
+			continue
+		default:
+		}
+
+		p.workers.Add(-1)
+		// recheck task queued while exiting
+		if len(p.queue) == 0 {
+			return
+		}
+		if p.workers.Add(1) > p.maxWorkers {
+			p.workers.Add(-1)
+			return
+		}
+		select {
+		case task = <-p.queue:
+		default:
+			p.workers.Add(-1)
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/changlongH/srpc/codec"
+)
+
+type (
+	msg struct {
+		req   *codec.ReqPack
+		agent *GateAgent
+		call  *serviceCall // decoded by keyed dispatch. nil if not decoded
+	}
+
+	// dispatchQueue messages run one by one in order. It's monitored for endless loop
+	dispatchQueue struct {
+		svc   *service
+		index int // shard index of keyed dispatch
+
+		sessionMutex   sync.Mutex
+		currentMethod  string
+		currentSession uint64    //  monitor sync dispatch (maybe in endless loop)
+		sessionCounter uint64    // increment session id
+		msgQueue       chan *msg // msgqueue
+	}
+)
+
+func newDispatchQueue(svc *service, index int) *dispatchQueue {
+	return &dispatchQueue{
+		svc:      svc,
+		index:    index,
+		msgQueue: make(chan *msg, 5000),
+	}
+}
+
+func (q *dispatchQueue) incCurrentSessionID(method string) uint64 {
+	q.sessionMutex.Lock()
+	defer q.sessionMutex.Unlock()
+
+	q.sessionCounter++
+	q.currentMethod = method
+	q.currentSession = q.sessionCounter
+	return q.currentSession
+}
+
+func (q *dispatchQueue) getCurrentSession() (uint64, string) {
+	q.sessionMutex.Lock()
+	defer q.sessionMutex.Unlock()
+	return q.currentSession, q.currentMethod
+}
+
+func (q *dispatchQueue) resetCurrentSession() {
+	q.sessionMutex.Lock()
+	defer q.sessionMutex.Unlock()
+	q.currentSession = 0
+}
+
+func (q *dispatchQueue) startMonitor() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	var s = q.svc
+	var lastSession uint64
+	var sessionStartTime time.Time
+
+	for {
+		<-ticker.C
+
+		currentSession, currentMethod := q.getCurrentSession()
+		if currentSession == 0 {
+			lastSession = 0
+			continue
+		}
+
+		if currentSession == lastSession && currentSession != 0 {
+			duration := time.Since(sessionStartTime)
+			if duration.Seconds() >= s.Options.MonitorInterval.Seconds() {
+				var err error
+				if s.Options.KeyFunc != nil {
+					err = fmt.Errorf("ERROR: service:[%s] shard:[%d] maybe in endlessloop method [%s] duration:%dms", s.name, q.index, currentMethod, duration.Milliseconds())
+				} else {
+					err = fmt.Errorf("ERROR: service:[%s] maybe in endlessloop method [%s] duration:%dms", s.name, currentMethod, duration.Milliseconds())
+				}
+				recoveryHandle(s.name, err)
+			}
+		} else {
+			lastSession = currentSession
+			sessionStartTime = time.Now()
+		}
+	}
+}
+
+func (q *dispatchQueue) push(m *msg) {
+	q.msgQueue <- m
+}
+
+func (q *dispatchQueue) process() {
+	go q.startMonitor()
+	for msg := range q.msgQueue {
+		var req = msg.req
+		q.incCurrentSessionID(req.Method)
+		if msg.call != nil {
+			msg.agent.runServiceCall(q.svc, req, msg.call)
+		} else {
+			msg.agent.callServiceMethod(q.svc, req)
+		}
+		q.resetCurrentSession()
+	}
+}
+
+// shard of the key. the same key always in the same queue
+func (s *service) shard(key string) *dispatchQueue {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.queues[h.Sum32()%uint32(len(s.queues))]
+}
@@ -7,7 +7,6 @@ import (
 	"go/token"
 	"log"
 	"reflect"
-	"sync"
 	"time"
 
 	"github.com/changlongH/srpc/codec"
@@ -15,10 +14,6 @@ import (
 )
 
 type (
-	msg struct {
-		req   *codec.ReqPack
-		agent *GateAgent
-	}
 	service struct {
 		name    string                 // name of service
 		rcvr    reflect.Value          // receiver of methods for the service
@@ -26,11 +21,16 @@ type (
 		method  map[string]*methodType // registered methods
 		Options Options
 
-		sessionMutex   sync.Mutex
-		currentMethod  string
-		currentSession uint64    //  monitor sync dispatch (maybe in endless loop)
-		sessionCounter uint64    // increment session id
-		msgQueue       chan *msg // msgqueue
+		interceptor Interceptor      // chained Options.Interceptors
+		queues      []*dispatchQueue // ordered queues of sync or keyed dispatch
+	}
+
+	// serviceCall decoded request of method
+	serviceCall struct {
+		ctx    *SkynetContext
+		mtype  *methodType
+		argv   []reflect.Value
+		isPush bool
 	}
 )
 
@@ -51,8 +51,8 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 }
 
 // suitableMethods returns suitable Rpc methods of typ. It will log
-// errors if logErr is true.
-func suitableMethods(typ reflect.Type, logErr bool) map[string]*methodType {
+// errors if logErr is true. multi if payload codec is a codec.MultiPayloadCodec
+func suitableMethods(typ reflect.Type, multi bool, logErr bool) map[string]*methodType {
 	methods := make(map[string]*methodType)
 	for m := 0; m < typ.NumMethod(); m++ {
 		method := typ.Method(m)
@@ -64,16 +64,9 @@ func suitableMethods(typ reflect.Type, logErr bool) map[string]*methodType {
 		}
 		numIn := mtype.NumIn()
 		numOut := mtype.NumOut()
-		if numIn < 2 || numIn > 3 {
-			if logErr {
-				log.Printf("rpc.Register: method %q has %d input parameters; needs exactly two\n", mname, mtype.NumIn())
-			}
-			continue
-		}
-
-		if numOut > 2 {
+		if numIn < 2 {
 			if logErr {
-				log.Printf("rpc.Register: method %q is not exported\n", mname)
+				log.Printf("rpc.Register: method %q has %d input parameters; needs at least two\n", mname, mtype.NumIn())
 			}
 			continue
 		}
@@ -87,61 +80,56 @@ func suitableMethods(typ reflect.Type, logErr bool) map[string]*methodType {
 			continue
 		}
 
-		var argType reflect.Type
-		if numIn > 2 {
-			// Second arg need not be a pointer.
-			argType = mtype.In(2)
+		// Others args need not be a pointer. more than one arg need multi payload codec
+		var argTypes []reflect.Type
+		for i := 2; i < numIn; i++ {
+			argType := mtype.In(i)
 			if !isExportedOrBuiltinType(argType) {
 				if logErr {
-					log.Printf("rpc.Register: second argument type of method %q is not exported: %q\n", mname, argType)
+					log.Printf("rpc.Register: argument %d type of method %q is not exported: %q\n", i-1, mname, argType)
 				}
-				continue
+				break
 			}
+			argTypes = append(argTypes, argType)
+		}
+		if len(argTypes) != numIn-2 {
+			continue
 		}
 
-		// reply must be a pointer.
-		var replyType reflect.Type
-
-		// returns (*reply, error) or (*reply) or (error)
-		var hasReply = false
+		// returns (*reply, error) or (*reply) or (error) or (reply1, reply2, ..., error)
 		var errIndex = -1
-		if numOut > 0 {
-			if returnType := mtype.Out(0); returnType != typeOfError {
-				replyType := mtype.Out(0)
-				if replyType.Kind() != reflect.Pointer {
-					if logErr {
-						log.Printf("rpc.Register: reply type of method %q is not a pointer: %q\n", mname, replyType)
-					}
-					continue
-				}
-				// Reply type must be exported.
-				if !isExportedOrBuiltinType(replyType) {
-					if logErr {
-						log.Printf("rpc.Register: reply type of method %q is not exported: %q\n", mname, replyType)
-					}
-					continue
-				}
-				hasReply = true
-			} else {
-				errIndex = 0
+		var replyTypes []reflect.Type
+		for i := 0; i < numOut; i++ {
+			returnType := mtype.Out(i)
+			if returnType == typeOfError && i == numOut-1 {
+				errIndex = i
+				break
 			}
-		}
-		if numOut > 1 {
-			if returnType := mtype.Out(1); returnType != typeOfError {
+			// Reply type must be exported.
+			if !isExportedOrBuiltinType(returnType) {
 				if logErr {
-					log.Printf("rpc.Register: return type of method %q is %q, must be error\n", mname, returnType)
+					log.Printf("rpc.Register: reply type of method %q is not exported: %q\n", mname, returnType)
 				}
-				continue
+				break
+			}
+			replyTypes = append(replyTypes, returnType)
+		}
+		if len(replyTypes) != numOut && (errIndex < 0 || len(replyTypes) != numOut-1) {
+			continue
+		}
+		// single reply must be a pointer unless it's a lua value of multi payload codec.
+		if !multi && len(replyTypes) == 1 && replyTypes[0].Kind() != reflect.Pointer {
+			if logErr {
+				log.Printf("rpc.Register: reply type of method %q is not a pointer: %q\n", mname, replyTypes[0])
 			}
-			errIndex = 1
+			continue
 		}
 
 		methods[mname] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
-			hasReply:  hasReply,
-			errIndex:  errIndex,
+			method:     method,
+			ArgTypes:   argTypes,
+			ReplyTypes: replyTypes,
+			errIndex:   errIndex,
 		}
 	}
 	return methods
@@ -155,54 +143,50 @@ func NewService(opts ...Option) *service {
 		opt(&options)
 	}
 	svc := &service{
-		Options: options,
+		Options:     options,
+		interceptor: chainInterceptors(options.Interceptors),
+	}
+	switch {
+	case svc.Options.KeyFunc != nil:
+		svc.queues = make([]*dispatchQueue, svc.Options.Shards)
+	case svc.Options.SyncDisptch:
+		svc.queues = make([]*dispatchQueue, 1)
 	}
-	if svc.Options.SyncDisptch {
-		svc.msgQueue = make(chan *msg, 5000)
+	for i := range svc.queues {
+		svc.queues[i] = newDispatchQueue(svc, i)
 	}
 	return svc
 }
 
-func (s *service) call(mtype *methodType, ctx *SkynetContext, data []byte, isPush bool) ([]byte, error) {
-	callVals := make([]reflect.Value, 0, 3)
-	callVals = append(callVals, s.rcvr, reflect.ValueOf(ctx))
-	// Decode the argument value.
-	if mtype.ArgType != nil {
-		var argv reflect.Value
-		argIsValue := false // if true, need to indirect before calling.
-		if mtype.ArgType.Kind() == reflect.Pointer {
-			argv = reflect.New(mtype.ArgType.Elem())
-		} else {
-			argv = reflect.New(mtype.ArgType)
-			argIsValue = true
-		}
-
-		if s.Options.PayloadCodec.IsNull(data) {
-			if argIsValue {
-				return nil, errors.New("missing request parameters")
-			} else {
-				argv = reflect.Zero(mtype.ArgType)
-			}
-		} else {
-			if err := s.Options.PayloadCodec.Unmarshal(data, argv.Interface()); err != nil {
-				return nil, errors.New("unmarshal args err:" + err.Error())
-			}
-		}
-		if argIsValue {
-			argv = argv.Elem()
-		}
-		callVals = append(callVals, argv)
-	}
-
+func (s *service) call(mtype *methodType, ctx *SkynetContext, argv []reflect.Value) (any, error) {
 	mtype.Lock()
 	mtype.numCalls++
 	ctx.numCall = mtype.numCalls
 	mtype.Unlock()
 
-	returnValues := mtype.method.Func.Call(callVals)
-	if isPush {
-		return nil, nil
+	// global interceptors -> service interceptors -> method
+	handler := func(ctx *SkynetContext, req any) (any, error) {
+		return s.invoke(mtype, ctx, req)
 	}
+	handler = withInterceptor(s.interceptor, mtype.info, handler)
+	handler = withInterceptor(GetDispatcher().getInterceptor(), mtype.info, handler)
+	return handler(ctx, packValues(argv))
+}
+
+// invoke call the reflected method. req and reply is packed by packValues
+func (s *service) invoke(mtype *methodType, ctx *SkynetContext, req any) (any, error) {
+	return mtype.invoke(s.rcvr, ctx, req)
+}
+
+func (mtype *methodType) invoke(rcvr reflect.Value, ctx *SkynetContext, req any) (any, error) {
+	argv, err := unpackValues(req, mtype.ArgTypes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid args of %s: %s", mtype.method.Name, err.Error())
+	}
+	callVals := make([]reflect.Value, 0, 2+len(argv))
+	callVals = append(callVals, rcvr, reflect.ValueOf(ctx))
+	callVals = append(callVals, argv...)
+	returnValues := mtype.method.Func.Call(callVals)
 
 	errIndex := mtype.errIndex
 	if errIndex >= 0 && !returnValues[errIndex].IsNil() {
@@ -210,19 +194,146 @@ func (s *service) call(mtype *methodType, ctx *SkynetContext, data []byte, isPus
 			return nil, errInter
 		}
 	}
+	return packValues(returnValues[:len(mtype.ReplyTypes)]), nil
+}
+
+// packValues nil if empty, []any if multi values, otherwise the value
+func packValues(vals []reflect.Value) any {
+	switch len(vals) {
+	case 0:
+		return nil
+	case 1:
+		return vals[0].Interface()
+	}
+	vs := make([]any, len(vals))
+	for i, v := range vals {
+		vs[i] = v.Interface()
+	}
+	return vs
+}
+
+// unpackValues reverse of packValues. values maybe modified by interceptors, check the types
+func unpackValues(v any, types []reflect.Type) ([]reflect.Value, error) {
+	var vs []any
+	switch len(types) {
+	case 0:
+		return nil, nil
+	case 1:
+		vs = []any{v}
+	default:
+		var ok bool
+		if vs, ok = v.([]any); !ok || len(vs) != len(types) {
+			return nil, fmt.Errorf("need []any of %d values, got %T", len(types), v)
+		}
+	}
+
+	vals := make([]reflect.Value, len(types))
+	for i, typ := range types {
+		if vs[i] == nil {
+			switch typ.Kind() {
+			case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+				vals[i] = reflect.Zero(typ)
+				continue
+			}
+			return nil, fmt.Errorf("value %d is nil, need %s", i+1, typ)
+		}
+		val := reflect.ValueOf(vs[i])
+		if !val.Type().AssignableTo(typ) {
+			return nil, fmt.Errorf("value %d type %s not assignable to %s", i+1, val.Type(), typ)
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
+
+func (s *service) decodeArgs(mtype *methodType, data []byte) ([]reflect.Value, error) {
+	if len(mtype.ArgTypes) == 0 {
+		// sealed request is verified even if there are no args
+		if sc, ok := s.Options.PayloadCodec.(codec.SealedPayloadCodec); ok {
+			if err := sc.Verify(data); err != nil {
+				return nil, codec.Errorf(codec.CodeVerifyFailed, "verify args err: %s", err.Error())
+			}
+		}
+		return nil, nil
+	}
+
+	// every lua value is decoded into one arg. missing value is zero
+	if mcodec, ok := s.Options.PayloadCodec.(codec.MultiPayloadCodec); ok {
+		argv := make([]reflect.Value, len(mtype.ArgTypes))
+		ptrs := make([]any, len(mtype.ArgTypes))
+		for i, argType := range mtype.ArgTypes {
+			ptr := reflect.New(argType)
+			ptrs[i] = ptr.Interface()
+			argv[i] = ptr.Elem()
+		}
+		if err := mcodec.UnmarshalMulti(data, ptrs...); err != nil {
+			return nil, errors.New("unmarshal args err:" + err.Error())
+		}
+		return argv, nil
+	}
+
+	argType := mtype.ArgTypes[0]
+	var argv reflect.Value
+	argIsValue := false // if true, need to indirect before calling.
+	if argType.Kind() == reflect.Pointer {
+		argv = reflect.New(argType.Elem())
+	} else {
+		argv = reflect.New(argType)
+		argIsValue = true
+	}
+
+	if s.Options.PayloadCodec.IsNull(data) {
+		if argIsValue {
+			return nil, errors.New("missing request parameters")
+		} else {
+			argv = reflect.Zero(argType)
+		}
+	} else {
+		if err := s.Options.PayloadCodec.Unmarshal(data, argv.Interface()); err != nil {
+			if errors.Is(err, codec.ErrVerifyFailed) {
+				return nil, codec.Errorf(codec.CodeVerifyFailed, "verify args err: %s", err.Error())
+			}
+			return nil, errors.New("unmarshal args err:" + err.Error())
+		}
+	}
+	if argIsValue {
+		argv = argv.Elem()
+	}
+	return []reflect.Value{argv}, nil
+}
+
+func (s *service) encodeReplies(mtype *methodType, reply any) ([]byte, error) {
+	if len(mtype.ReplyTypes) == 0 {
+		return nil, nil
+	}
 
-	if mtype.hasReply {
-		replyVal := returnValues[0]
-		if replyVal.IsNil() {
-			return nil, nil
+	if mcodec, ok := s.Options.PayloadCodec.(codec.MultiPayloadCodec); ok {
+		replies := []any{reply}
+		if len(mtype.ReplyTypes) > 1 {
+			var ok bool
+			if replies, ok = reply.([]any); !ok {
+				return nil, fmt.Errorf("marshal reply err: need []any of %d values, got %T", len(mtype.ReplyTypes), reply)
+			}
 		}
-		if data, err := s.Options.PayloadCodec.Marshal(replyVal.Elem().Interface()); err != nil {
+		if data, err := mcodec.MarshalMulti(replies...); err != nil {
 			return nil, errors.New("marshal reply err:" + err.Error())
 		} else {
 			return data, nil
 		}
 	}
-	return nil, nil
+
+	if reply == nil {
+		return nil, nil
+	}
+	// keep pointer. protobuf message need it
+	if replyVal := reflect.ValueOf(reply); replyVal.Kind() == reflect.Pointer && replyVal.IsNil() {
+		return nil, nil
+	}
+	if data, err := s.Options.PayloadCodec.Marshal(reply); err != nil {
+		return nil, errors.New("marshal reply err:" + err.Error())
+	} else {
+		return data, nil
+	}
 }
 
 func (s *service) getAllMethods() []string {
@@ -233,82 +344,75 @@ func (s *service) getAllMethods() []string {
 	return methods
 }
 
-func (s *service) incCurrentSessionID(method string) uint64 {
-	s.sessionMutex.Lock()
-	defer s.sessionMutex.Unlock()
-
-	s.sessionCounter++
-	s.currentMethod = method
-	s.currentSession = s.sessionCounter
-	return s.currentSession
-}
-
-func (s *service) getCurrentSession() uint64 {
-	s.sessionMutex.Lock()
-	defer s.sessionMutex.Unlock()
-	return s.currentSession
+func (s *service) startDispatchQueues() {
+	for _, q := range s.queues {
+		go q.process()
+	}
 }
 
-func (s *service) resetCurrentSession() {
-	s.sessionMutex.Lock()
-	defer s.sessionMutex.Unlock()
-	s.currentSession = 0
+func (s *service) pushMsgToDispatchQueue(agent *GateAgent, req *codec.ReqPack) {
+	s.queues[0].push(&msg{req: req, agent: agent})
 }
 
-func (s *service) startMonitor() {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-
-	var lastSession uint64
-	var sessionStartTime time.Time
-
-	for {
-		<-ticker.C
-
-		currentSession := s.getCurrentSession()
-		if currentSession == 0 {
-			lastSession = 0
-			continue
-		}
+// prepareCall find method and decode args
+func (s *service) prepareCall(ctx *SkynetContext, methodName string, data []byte, isPush bool) (*serviceCall, error) {
+	mtype := s.method[methodName]
+	if mtype == nil {
+		return nil, fmt.Errorf("not find method (%s.%s)", s.name, methodName)
+	}
+	ctx.service, ctx.method, ctx.isPush = s.name, methodName, isPush
 
-		if currentSession == lastSession && currentSession != 0 {
-			duration := time.Since(sessionStartTime)
-			if duration.Seconds() >= s.Options.MonitorInterval.Seconds() {
-				var err = fmt.Errorf("ERROR: service:[%s] maybe in endlessloop method [%s] duration:%dms", s.name, s.currentMethod, duration.Milliseconds())
-				recoveryHandle(s.name, err)
-			}
-		} else {
-			lastSession = currentSession
-			sessionStartTime = time.Now()
+	// Decode the argument value.
+	argv, err := s.decodeArgs(mtype, data)
+	if err != nil {
+		if s.Options.AccessHdle != nil {
+			s.Options.AccessHdle(ctx, s.name, methodName, 0, err)
 		}
+		return nil, err
 	}
+	return &serviceCall{ctx: ctx, mtype: mtype, argv: argv, isPush: isPush}, nil
 }
 
-func (s *service) pushMsgToDispatchQueue(agent *GateAgent, req *codec.ReqPack) {
-	s.msgQueue <- &msg{req: req, agent: agent}
-}
+// runCall call the method, done is called with encoded replies. It's called later if the reply is deferred by ctx.Defer
+func (s *service) runCall(c *serviceCall, done func([]byte, error)) {
+	ctx := c.ctx
+	cancel := context.CancelFunc(func() {})
+	// interceptors may set an earlier deadline by ctx.WithDeadline
+	if s.Options.Timeout > 0 {
+		ctx.Context, cancel = context.WithTimeout(ctx.Context, s.Options.Timeout)
+	}
 
-func (s *service) processMsgQueue() {
-	go s.startMonitor()
-	for msg := range s.msgQueue {
-		var req = msg.req
-		s.incCurrentSessionID(req.Method)
-		msg.agent.callServiceMethod(s, req.Method, req.Session, req.Payload, req.Push)
-		s.resetCurrentSession()
+	startTime := time.Now()
+	finish := func(reply any, err error) {
+		defer cancel()
+		defer ctx.cancelDeadlines()
+		var replyData []byte
+		if c.isPush {
+			err = nil
+		} else if err == nil {
+			replyData, err = s.encodeReplies(c.mtype, reply)
+		}
+		if s.Options.AccessHdle != nil {
+			s.Options.AccessHdle(ctx, s.name, ctx.method, time.Since(startTime), err)
+		}
+		done(replyData, err)
 	}
-}
+	ctx.mu.Lock()
+	ctx.finish = finish
+	ctx.mu.Unlock()
 
-func (s *service) dispatch(methodName string, data []byte, isPush bool) ([]byte, error) {
-	mtype := s.method[methodName]
-	if mtype == nil {
-		return nil, fmt.Errorf("not find method (%s.%s)", s.name, methodName)
+	reply, err := s.call(c.mtype, ctx, c.argv)
+	if ctx.isDeferred() {
+		return
 	}
+	finish(reply, err)
+}
 
-	startTime := time.Now()
-	ctx := NewSkynetContext(context.Background())
-	replyData, err := s.call(mtype, ctx, data, isPush)
-	if s.Options.AccessHdle != nil {
-		s.Options.AccessHdle(ctx, s.name, methodName, time.Since(startTime), err)
+func (s *service) dispatch(ctx *SkynetContext, methodName string, data []byte, isPush bool, done func([]byte, error)) {
+	c, err := s.prepareCall(ctx, methodName, data, isPush)
+	if err != nil {
+		done(nil, err)
+		return
 	}
-	return replyData, err
+	s.runCall(c, done)
 }
@@ -48,6 +48,25 @@ function srpc.set_default_codec(name)
     return false
 end
 
+-- coded error. golang codec.RemoteError.Code
+local ERR_CODE_PREFIX = "srpcerr:"
+
+-- raise a coded error in router callback. golang client get codec.RemoteError{Code = code}
+function srpc.error(code, msg)
+    error(string.format("%s%d:%s", ERR_CODE_PREFIX, code, msg), 0)
+end
+
+-- parse error of srpc.call. returns code(0 if not coded) and message without lua traceback
+function srpc.parse_error(err)
+    err = tostring(err)
+    local msg = err:match("^(.-)\nstack traceback:") or err
+    local code, text = msg:match(ERR_CODE_PREFIX .. "(%-?%d+):(.*)$")
+    if code then
+        return tonumber(code), text
+    end
+    return 0, msg
+end
+
 function srpc.send(node, sname, cmd, req)
     if req then
         req = srpc.codec.encode(req)
@@ -64,7 +83,9 @@ function srpc.call(node, sname, cmd, req)
     end
     local ok, ret = pcall(cluster.call, node, sname, cmd, req)
     if not ok then
-        return ok, ret
+        -- golang coded error: false, msg, code
+        local code, msg = srpc.parse_error(ret)
+        return ok, msg, code
     end
     if srpc.profile then
         local cost = profile.stop()
@@ -1,8 +1,10 @@
 package srpc
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log"
 
 	"github.com/changlongH/srpc/client"
 	"github.com/changlongH/srpc/cluster"
@@ -49,23 +51,74 @@ func Call(node string, addr any, cmd string, args any, reply any) error {
 	return Invoke(caller)
 }
 
+// SendContext same as Send. returns ctx.Err() wrapped error if ctx is done before sending
+func SendContext(ctx context.Context, node string, addr any, cmd string, args any) error {
+	caller := client.NewCaller(node, addr, cmd, args).WithPush().WithContext(ctx)
+	return Invoke(caller)
+}
+
+// CallContext same as Call. Cancellation or deadline of ctx stop waiting and returns ctx.Err() wrapped error
+func CallContext(ctx context.Context, node string, addr any, cmd string, args any, reply any) error {
+	caller := client.NewCaller(node, addr, cmd, args).WithReply(reply).WithContext(ctx)
+	return Invoke(caller)
+}
+
 /*
 Invoker invoker will query registered client then invoker with caller
 
-caller = client.NewCaller(node, addr, cmd, args).WithTimeout(5*time.Second).WithPayloadCodec("json")
+caller = client.NewCaller(node, addr, cmd, args).WithTimeout(5*time.Second).WithPayloadCodec("json").WithContext(ctx)
 
 return returns its error status. If not push then waits for it to complete or timeout
 */
 func Invoke(caller *client.Caller) error {
+	c, err := queryClient(caller)
+	if err != nil {
+		return err
+	}
+	return c.Invoke(caller)
+}
+
+/*
+Go invokes the caller asynchronously like net/rpc. See [client.Client.Go]
+
+done: nil will allocate a new channel. If non-nil, done must be buffered. Share it to collect many calls
+
+	done := make(chan *client.Req, 2)
+	srpc.Go(client.NewCaller("db", "sdb", "GET", args1).WithReply(reply1), done)
+	srpc.Go(client.NewCaller("db2", "sdb", "GET", args2).WithReply(reply2), done)
+	for i := 0; i < 2; i++ {
+		req := <-done
+	}
+
+return Req.Done receives the same Req when it's complete. check Req.Error
+*/
+func Go(caller *client.Caller, done chan *client.Req) *client.Req {
+	c, err := queryClient(caller)
+	if err != nil {
+		if done == nil {
+			done = make(chan *client.Req, 1)
+		}
+		req := &client.Req{Caller: caller, Error: err, Done: done}
+		select {
+		case done <- req:
+		default:
+			log.Println("srpc: discarding Req reply due to insufficient Done chan capacity")
+		}
+		return req
+	}
+	return c.Go(caller, done)
+}
+
+func queryClient(caller *client.Caller) (*client.Client, error) {
 	var err error
 	if caller, err = caller.Done(); err != nil {
-		return err
+		return nil, err
 	}
 	c := cluster.Query(caller.Node)
 	if c == nil {
-		return errors.New("not found cluster node: " + caller.Node)
+		return nil, errors.New("not found cluster node: " + caller.Node)
 	}
-	return c.Invoke(caller)
+	return c, nil
 }
 
 type NewClientOptsHandle func() []client.Option
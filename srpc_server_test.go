@@ -1,18 +1,27 @@
 package srpc_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/changlongH/srpc"
 	"github.com/changlongH/srpc/client"
 	"github.com/changlongH/srpc/cluster"
+	"github.com/changlongH/srpc/codec"
 	payloadcodec "github.com/changlongH/srpc/payload_codec"
 	"github.com/changlongH/srpc/server"
+	"github.com/changlongH/srpc/server/actor"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type Args struct {
@@ -87,11 +96,134 @@ func (t *Arith) EchoMap(ctx *server.SkynetContext, args map[string]int) *map[str
 	return &args
 }
 
+// DivMod multi args and replies need payload codec luaseri. lua: cluster.call(node, "airthseri", "DivMod", 7, 2)
+func (t *Arith) DivMod(ctx *server.SkynetContext, a int, b int) (int, int, error) {
+	if b == 0 {
+		return 0, 0, errors.New("divide by zero")
+	}
+	return a / b, a % b, nil
+}
+
+// Quo single non-pointer reply is a lua value of luaseri. lua: cluster.call(node, "airthseri", "Quo", 7, 2)
+func (t *Arith) Quo(ctx *server.SkynetContext, a int, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("divide by zero")
+	}
+	return a / b, nil
+}
+
+// Void nil reply
+func (t *Arith) Void(ctx *server.SkynetContext, args *Args) (*Reply, error) {
+	return nil, nil
+}
+
+func (t *Arith) Forbid(ctx *server.SkynetContext) error {
+	return codec.NewError(403, "forbidden")
+}
+
+// Upper protobuf args and reply. nil if empty message
+func (t *Arith) Upper(ctx *server.SkynetContext, args *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	return wrapperspb.String(strings.ToUpper(args.GetValue())), nil
+}
+
+func (t *Arith) Trace(ctx *server.SkynetContext) *string {
+	tag := ctx.Trace()
+	return &tag
+}
+
+// Meta returns request context info and metadata value of key
+func (t *Arith) Meta(ctx *server.SkynetContext, key string) *string {
+	value, _ := ctx.Get(key)
+	_, hasDeadline := ctx.Deadline()
+	info := fmt.Sprintf("%s.%s push=%v session=%v remote=%v deadline=%v %s=%v", ctx.Service(), ctx.Method(), ctx.IsPush(),
+		ctx.Session() > 0, ctx.RemoteAddr() != "", hasDeadline, key, value)
+	return &info
+}
+
 func (t *Arith) SleepMilli(ctx *server.SkynetContext, n int) error {
 	time.Sleep(time.Duration(n) * time.Millisecond)
 	return nil
 }
 
+// Wait returns canceled if the request deadline exceeded in 3 seconds. timeout is read by interceptors
+func (t *Arith) Wait(ctx *server.SkynetContext, timeout int) *string {
+	result := "waited"
+	select {
+	case <-ctx.Done():
+		result = "canceled"
+	case <-time.After(3 * time.Second):
+	}
+	return &result
+}
+
+// Room records join order of every room. A is room id, B is sequence
+type Room struct {
+	sync.Mutex
+	seqs map[int][]int
+}
+
+func (r *Room) Join(ctx *server.SkynetContext, args Args) error {
+	r.Lock()
+	r.seqs[args.A] = append(r.seqs[args.A], args.B)
+	r.Unlock()
+	return nil
+}
+
+type RelayReq struct {
+	Id      int  `json:"id" msgpack:"id"`
+	Forward bool `json:"forward" msgpack:"forward"`
+}
+
+// Relay actor calls another actor of the same system
+type Relay struct {
+	node string
+}
+
+func (r *Relay) Hop(ctx *server.SkynetContext, req *RelayReq) (*string, error) {
+	if !req.Forward {
+		path := fmt.Sprint(req.Id)
+		return &path, nil
+	}
+	var path string
+	if err := srpc.Call(r.node, "relay", "Hop", RelayReq{Id: req.Id + 1}, &path); err != nil {
+		return nil, err
+	}
+	path = fmt.Sprintf("%d->%s", req.Id, path)
+	return &path, nil
+}
+
+// startGate start a gate at a free address with pool, registered as cluster node
+func startGate(t *testing.T, node string, pool *server.WorkerPool) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	gate, err := server.NewGate(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool != nil {
+		gate.SetWorkerPool(pool)
+	}
+	go gate.Start()
+	c, err := cluster.Register(node, addr, client.WithPayloadCodec(&payloadcodec.MsgPack{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cluster.Remove(node)
+		gate.Close(time.Second)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err = c.WaitForReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestRpcServer(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
 	defer cancel()
@@ -152,6 +284,133 @@ func TestRpcServer(t *testing.T) {
 		return
 	}
 
+	// multi-MB request and response
+	var echo any
+	large := strings.Repeat("skynet", 512*1024)
+	if err = srpc.Call(node, sname, "Echo", large, &echo); err != nil || echo != large {
+		t.Errorf("Echo large: round trip failed err=%v", err)
+		return
+	}
+
+	// void reply: nil *Reply or error only, reply is untouched
+	voidReply := &Reply{C: -1}
+	if err = srpc.Call(node, sname, "Void", args, voidReply); err != nil || voidReply.C != -1 {
+		t.Errorf("Void: expected nil reply got %d err=%v", voidReply.C, err)
+		return
+	}
+	if err = srpc.Call(node, sname, "SleepMilli", 1, voidReply); err != nil || voidReply.C != -1 {
+		t.Errorf("SleepMilli: expected nil reply got %d err=%v", voidReply.C, err)
+		return
+	}
+
+	var tag string
+	caller := client.NewCaller(node, sname, "Trace", nil).WithReply(&tag).WithTrace("(go-test-1)trace")
+	if err = srpc.Invoke(caller); err != nil {
+		t.Error(err)
+		return
+	}
+	if tag != "(go-test-1)trace" {
+		t.Errorf("Trace: expected (go-test-1)trace got %q", tag)
+		return
+	}
+
+	seriName := "airthseri"
+	if err := server.Register(arith, seriName, server.WithPayloadCodec(payloadcodec.LuaSeri{})); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	var quo, rem int
+	caller = client.NewCaller(node, seriName, "DivMod", nil).WithPayloadCodec("luaseri").WithMultiArgs(7, 2).WithMultiReply(&quo, &rem)
+	if err = srpc.Invoke(caller); err != nil {
+		t.Error(err)
+		return
+	}
+	if quo != 3 || rem != 1 {
+		t.Errorf("DivMod: expected 3,1 got %d,%d", quo, rem)
+		return
+	}
+	quo = 0
+	caller = client.NewCaller(node, seriName, "Quo", nil).WithPayloadCodec("luaseri").WithMultiArgs(7, 2).WithReply(&quo)
+	if err = srpc.Invoke(caller); err != nil || quo != 3 {
+		t.Errorf("Quo: expected 3 got %d %v", quo, err)
+		return
+	}
+	if methods, _ := server.GetRegisterMethods(sname); slices.Contains(methods, "Quo") {
+		t.Error("Quo registered without multi payload codec")
+		return
+	}
+
+	pbName := "airthpb"
+	if err := server.Register(arith, pbName, server.WithPayloadCodec(payloadcodec.Protobuf{})); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	upper := &wrapperspb.StringValue{}
+	caller = client.NewCaller(node, pbName, "Upper", wrapperspb.String("skynet")).WithPayloadCodec("protobuf").WithReply(upper)
+	if err = srpc.Invoke(caller); err != nil || upper.GetValue() != "SKYNET" {
+		t.Errorf("Upper: expected SKYNET got %q err=%v", upper.GetValue(), err)
+		return
+	}
+
+	// sealed payload. compressed then encrypted, args sealed with unknown key are rejected
+	keys, _ := codec.NewKeyring(1, bytes.Repeat([]byte{1}, 32))
+	sealed := codec.NewSealCodec(codec.NewCompressCodec(payloadcodec.MsgPack{}, codec.Gzip, 0), codec.SealAESGCM, keys)
+	codec.PutPayloadCode(sealed.Name(), sealed)
+	secName := "airthsec"
+	if err := server.Register(arith, secName, server.WithPayloadCodec(sealed)); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	var sum string
+	caller = client.NewCaller(node, secName, "String", &Args{7, 8}).WithPayloadCodec(sealed.Name()).WithReply(&sum)
+	if err = srpc.Invoke(caller); err != nil || sum != "7+8=15" {
+		t.Errorf("sealed String: expected 7+8=15 got %q err=%v", sum, err)
+		return
+	}
+	otherKeys, _ := codec.NewKeyring(2, bytes.Repeat([]byte{2}, 32))
+	codec.PutPayloadCode("msgpack+aesgcm-other", codec.NewSealCodec(payloadcodec.MsgPack{}, codec.SealAESGCM, otherKeys))
+	caller = client.NewCaller(node, secName, "String", &Args{7, 8}).WithPayloadCodec("msgpack+aesgcm-other").WithReply(&sum)
+	if err = srpc.Invoke(caller); codec.ErrorCode(err) != codec.CodeVerifyFailed {
+		t.Errorf("sealed String: expected code %d got %v", codec.CodeVerifyFailed, err)
+		return
+	}
+	// unsealed empty args are not null, methods without args are verified too
+	for _, method := range []string{"String", "Error"} {
+		caller = client.NewCaller(node, secName, method, nil).WithPayloadCodec("msgpack")
+		if err = srpc.Invoke(caller); codec.ErrorCode(err) != codec.CodeVerifyFailed {
+			t.Errorf("sealed %s unsealed empty args: expected code %d got %v", method, codec.CodeVerifyFailed, err)
+			return
+		}
+	}
+	caller = client.NewCaller(node, secName, "Error", nil).WithPayloadCodec(sealed.Name())
+	if err = srpc.Invoke(caller); err == nil || codec.ErrorCode(err) == codec.CodeVerifyFailed {
+		t.Errorf("sealed Error: expected method error got %v", err)
+		return
+	}
+
+	// collect async calls
+	done := make(chan *client.Req, 10)
+	for i := range 10 {
+		srpc.Go(client.NewCaller(node, sname, "Add", Args{i, i}).WithReply(new(Reply)), done)
+	}
+	for range 10 {
+		req := <-done
+		args := req.Caller.Args.(Args)
+		if req.Error != nil || req.Caller.Reply.(*Reply).C != args.A+args.B {
+			t.Errorf("Go Add: %v err=%v", args, req.Error)
+			return
+		}
+	}
+
+	// cancel waiting reply
+	callCtx, callCancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	err = srpc.CallContext(callCtx, node, sname, "SleepMilli", 2000, nil)
+	callCancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CallContext: expected deadline exceeded got %v", err)
+		return
+	}
+
 	var delay = 4 * time.Second
 	err = srpc.Call(node, sname, "SleepMilli", delay.Milliseconds(), nil)
 	if err != nil {
@@ -163,3 +422,246 @@ func TestRpcServer(t *testing.T) {
 	gate.Close(3 * time.Second)
 	fmt.Println("TestRpcServerSuccess")
 }
+
+func TestServerInterceptor(t *testing.T) {
+	startGate(t, "mwnode", nil)
+	// global on dispatcher and per service. modify args and short-circuit
+	var interceptedMu sync.Mutex
+	var intercepted []string
+	intercept := func(s string) {
+		interceptedMu.Lock()
+		intercepted = append(intercepted, s)
+		interceptedMu.Unlock()
+	}
+	server.Use(func(ctx *server.SkynetContext, info *server.MethodInfo, req any, next server.Handler) (any, error) {
+		if info.Service == "airthmw" {
+			intercept("global:" + info.Method)
+		}
+		return next(ctx, req)
+	})
+	t.Cleanup(server.ResetInterceptors)
+	err := server.Register(new(Arith), "airthmw", server.WithInterceptor(func(ctx *server.SkynetContext, info *server.MethodInfo, req any, next server.Handler) (any, error) {
+		intercept("service:" + info.Method)
+		switch info.Method {
+		case "Add":
+			args := req.(Args)
+			args.B *= 10
+			return next(ctx, args)
+		case "Div":
+			return nil, errors.New("forbidden")
+		}
+		return next(ctx, req)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := new(Reply)
+	if err = srpc.Call("mwnode", "airthmw", "Add", Args{1, 2}, reply); err != nil || reply.C != 21 {
+		t.Fatalf("interceptor Add: expected 21 got %d err=%v", reply.C, err)
+	}
+	if err = srpc.Call("mwnode", "airthmw", "Div", Args{1, 2}, reply); err == nil {
+		t.Fatal("interceptor Div: expected forbidden")
+	}
+	interceptedMu.Lock()
+	order := fmt.Sprint(intercepted)
+	interceptedMu.Unlock()
+	if order != "[global:Add service:Add global:Div service:Div]" {
+		t.Fatalf("interceptor order %v", order)
+	}
+}
+
+func TestSkynetContext(t *testing.T) {
+	startGate(t, "metanode", nil)
+	err := server.Register(new(Arith), "airthmeta", server.WithInterceptor(func(ctx *server.SkynetContext, info *server.MethodInfo, req any, next server.Handler) (any, error) {
+		ctx.Set("user", "u1")
+		return next(ctx, req)
+	}), server.WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta string
+	if err = srpc.Call("metanode", "airthmeta", "Meta", "user", &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta != "airthmeta.Meta push=false session=true remote=true deadline=true user=u1" {
+		t.Fatalf("Meta: unexpected context %s", meta)
+	}
+}
+
+func TestRemoteError(t *testing.T) {
+	startGate(t, "errnode", nil)
+	if err := server.Register(new(Arith), "airtherr"); err != nil {
+		t.Fatal(err)
+	}
+	var remoteErr *codec.RemoteError
+	err := srpc.Call("errnode", "airtherr", "Forbid", nil, nil)
+	if !errors.As(err, &remoteErr) || remoteErr.Code != 403 || remoteErr.Message != "forbidden" || remoteErr.Method != "Forbid" {
+		t.Fatalf("Forbid: expected remote error code 403 got %v", err)
+	}
+}
+
+func TestKeyedDispatch(t *testing.T) {
+	startGate(t, "keyednode", nil)
+	// the same room in order
+	room := &Room{seqs: map[int][]int{}}
+	err := server.Register(room, "room", server.WithKeyedDispatch(4, func(ctx *server.SkynetContext, req any) string {
+		return strconv.Itoa(req.(Args).A)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := make(chan *client.Req, 80)
+	for seq := range 20 {
+		for id := range 4 {
+			srpc.Go(client.NewCaller("keyednode", "room", "Join", Args{id, seq}), joined)
+		}
+	}
+	for range 80 {
+		if req := <-joined; req.Error != nil {
+			t.Fatal(req.Error)
+		}
+	}
+	room.Lock()
+	defer room.Unlock()
+	for id, seqs := range room.seqs {
+		if !slices.IsSorted(seqs) || len(seqs) != 20 {
+			t.Fatalf("room %d joined out of order %v", id, seqs)
+		}
+	}
+}
+
+func TestActorRelay(t *testing.T) {
+	startGate(t, "relaynode", nil)
+	// one shard: the actor calls another actor in the same shard without blocking the dispatch queue
+	relays, err := actor.Register("relay", func(id string) any {
+		return &Relay{node: "relaynode"}
+	}, actor.WithShards(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relays.Stop()
+	var path string
+	if err = srpc.Call("relaynode", "relay", "Hop", RelayReq{Id: 1, Forward: true}, &path); err != nil || path != "1->2" {
+		t.Fatalf("actor Hop: expected 1->2 got %q err=%v", path, err)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	pool := server.NewWorkerPool(2, 2, server.RejectDropPush)
+	release := make(chan struct{})
+	var done sync.WaitGroup
+	task := func() {
+		<-release
+		done.Done()
+	}
+
+	// 2 workers + 2 queued
+	done.Add(4)
+	for range 4 {
+		if err := pool.Submit(task, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stat := pool.Stat(); stat.Workers != 2 || stat.QueueDepth != 2 {
+		t.Fatalf("unexpected pool stat %+v", stat)
+	}
+	if err := pool.Submit(task, true); !errors.Is(err, server.ErrServerBusy) {
+		t.Fatalf("expect push dropped got %v", err)
+	}
+
+	// call blocks until queue has space
+	done.Add(1)
+	submitted := make(chan struct{})
+	go func() {
+		pool.Submit(task, false)
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("call should block when pool is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-submitted
+	done.Wait()
+	if stat := pool.Stat(); stat.Rejected != 1 {
+		t.Fatalf("unexpected rejected %+v", stat)
+	}
+
+	busy := server.NewWorkerPool(1, 1, server.RejectReplyError)
+	block := make(chan struct{})
+	busy.Submit(func() { <-block }, false)
+	busy.Submit(func() {}, false)
+	if err := busy.Submit(func() {}, false); !errors.Is(err, server.ErrServerBusy) {
+		t.Fatalf("expect server busy got %v", err)
+	}
+	close(block)
+
+	// async dispatch of the gate runs in its pool, busy pool rejects calls
+	gatePool := server.NewWorkerPool(1, 1, server.RejectReplyError)
+	startGate(t, "pooled", gatePool)
+	if err := server.Register(new(Arith), "airthpool"); err != nil {
+		t.Fatal(err)
+	}
+	reply := new(Reply)
+	if err := srpc.Call("pooled", "airthpool", "Add", Args{1, 2}, reply); err != nil || reply.C != 3 {
+		t.Fatalf("pooled Add: %d err=%v", reply.C, err)
+	}
+	hold, started := make(chan struct{}), make(chan struct{})
+	gatePool.Submit(func() {
+		close(started)
+		<-hold
+	}, false)
+	<-started
+	gatePool.Submit(func() {}, false)
+	err := srpc.Call("pooled", "airthpool", "Add", Args{1, 2}, reply)
+	close(hold)
+	if err == nil || !strings.Contains(err.Error(), server.ErrServerBusy.Error()) {
+		t.Fatalf("expect gate pool busy got %v", err)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	// the caller deadline is carried by args, milliseconds from now
+	deadline := func(ctx *server.SkynetContext, info *server.MethodInfo, req any, next server.Handler) (any, error) {
+		if n, ok := req.(int); ok && n > 0 {
+			ctx.WithTimeout(time.Duration(n) * time.Millisecond)
+		}
+		return next(ctx, req)
+	}
+	arith := new(Arith)
+	if err := server.Register(arith, "airthdl", server.WithTimeout(time.Minute), server.WithInterceptor(deadline)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Register(arith, "airthdlsvc", server.WithTimeout(20*time.Millisecond), server.WithInterceptor(deadline)); err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(sname string, n int) string {
+		t.Helper()
+		data, err := payloadcodec.MsgPack{}.Marshal(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := server.GetDispatcher().DispatchReq(sname, "Wait", data, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result string
+		if err = (payloadcodec.MsgPack{}).Unmarshal(rsp, &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if result := wait("airthdl", 0); result != "waited" {
+		t.Fatalf("no request deadline %s", result)
+	}
+	// request deadline is earlier than service timeout
+	if result := wait("airthdl", 20); result != "canceled" {
+		t.Fatalf("request deadline not work %s", result)
+	}
+	// request deadline never extends service timeout
+	if result := wait("airthdlsvc", 60*1000); result != "canceled" {
+		t.Fatalf("service timeout extended %s", result)
+	}
+}